@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// forward describes a port forward from the host into the virtual network.
+type forward struct {
+	Protocol string `json:"protocol"`
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+var errForwardsNotSupported = errors.New("port forwarding is not supported by the current backend")
+
+// forwardFromConfig converts an entry of types.Configuration.Forwards (e.g. "udp::8888" -> "10.13.37.2:1234")
+func forwardFromConfig(local string, remote string) forward {
+	if strings.HasPrefix(local, "udp:") {
+		return forward{Protocol: "udp", Local: strings.TrimPrefix(local, "udp:"), Remote: remote}
+	}
+	return forward{Protocol: "tcp", Local: local, Remote: remote}
+}
+
+func (f *forward) validate() error {
+	if f.Protocol == "" {
+		f.Protocol = "tcp"
+	}
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol specified (%s), must be tcp or udp", f.Protocol)
+	}
+
+	_, localPort, err := net.SplitHostPort(f.Local)
+	if err != nil {
+		return fmt.Errorf("invalid local address specified (%s): %w", f.Local, err)
+	}
+	if v, e := strconv.Atoi(localPort); e != nil || v < 0 || v > 65535 {
+		return fmt.Errorf("invalid local port specified (%s)", f.Local)
+	}
+
+	if f.Remote == "" {
+		return nil
+	}
+	remoteHost, remotePort, err := net.SplitHostPort(f.Remote)
+	if err != nil {
+		return fmt.Errorf("invalid remote address specified (%s): %w", f.Remote, err)
+	}
+	if net.ParseIP(remoteHost).To4() == nil {
+		return fmt.Errorf("invalid remote address specified (%s): must be an IPv4 address", f.Remote)
+	}
+	if v, e := strconv.Atoi(remotePort); e != nil || v < 0 || v > 65535 {
+		return fmt.Errorf("invalid remote port specified (%s)", f.Remote)
+	}
+	return nil
+}
+
+func sortForwards(forwards []forward) {
+	sort.Slice(forwards, func(i, j int) bool {
+		if forwards[i].Local == forwards[j].Local {
+			return forwards[i].Protocol < forwards[j].Protocol
+		}
+		return forwards[i].Local < forwards[j].Local
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// registerAPI adds the control API endpoints to mux.
+func registerAPI(mux *http.ServeMux, backend Backend, sessions *sessionRegistry, auth *authenticator) {
+	apiOnly := func(h http.HandlerFunc) http.HandlerFunc {
+		return apiOnly(auth, h)
+	}
+
+	mux.HandleFunc("GET /api/sessions", apiOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sessions.list())
+	}))
+	registerImpairmentAPI(mux, sessions, apiOnly)
+	registerScenarioAPI(mux, sessions, apiOnly)
+
+	forwardsHandler := func(h func(w http.ResponseWriter, r *http.Request, fwd Forwarder)) http.HandlerFunc {
+		return apiOnly(func(w http.ResponseWriter, r *http.Request) {
+			fwd, ok := backend.(Forwarder)
+			if !ok {
+				writeAPIError(w, http.StatusNotImplemented, errForwardsNotSupported)
+				return
+			}
+			h(w, r, fwd)
+		})
+	}
+
+	mux.HandleFunc("GET /api/forwards", forwardsHandler(func(w http.ResponseWriter, r *http.Request, fwd Forwarder) {
+		forwards, err := fwd.Forwards(r.URL.Query().Get("session"))
+		if err != nil {
+			writeAPIError(w, forwardErrorStatus(err, http.StatusInternalServerError), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, forwards)
+	}))
+
+	mux.HandleFunc("POST /api/forwards", forwardsHandler(func(w http.ResponseWriter, r *http.Request, fwd Forwarder) {
+		var req forward
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.Remote == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("remote address is required"))
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		sessionID := r.URL.Query().Get("session")
+		if err := fwd.AddForward(sessionID, req); err != nil {
+			writeAPIError(w, forwardErrorStatus(err, http.StatusConflict), err)
+			return
+		}
+		logrus.WithFields(logrus.Fields{"session": sessionID, "protocol": req.Protocol, "local": req.Local, "remote": req.Remote}).Info("port forward added")
+		writeJSON(w, http.StatusCreated, req)
+	}))
+
+	mux.HandleFunc("DELETE /api/forwards", forwardsHandler(func(w http.ResponseWriter, r *http.Request, fwd Forwarder) {
+		req := forward{
+			Protocol: r.URL.Query().Get("protocol"),
+			Local:    r.URL.Query().Get("local"),
+		}
+		if err := req.validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		sessionID := r.URL.Query().Get("session")
+		if err := fwd.RemoveForward(sessionID, req); err != nil {
+			writeAPIError(w, forwardErrorStatus(err, http.StatusNotFound), err)
+			return
+		}
+		logrus.WithFields(logrus.Fields{"session": sessionID, "protocol": req.Protocol, "local": req.Local}).Info("port forward removed")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("/api/", apiOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown API endpoint: %s %s", r.Method, r.URL.Path))
+	}))
+}
+
+func forwardErrorStatus(err error, status int) int {
+	if errors.Is(err, errUnknownSession) {
+		return http.StatusNotFound
+	}
+	return status
+}
+
+// apiOnly rejects requests coming from web pages: browsers always send an Origin header
+// for cross-origin requests, while the command line client never does. When authentication
+// is enabled, API requests need a valid token too.
+func apiOnly(auth *authenticator, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeAPIError(w, http.StatusForbidden, errors.New("the API is not available to web pages"))
+			return
+		}
+		if _, err := auth.authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardsAPI(t *testing.T) {
+	cfg := defaultConfig()
+	initialPort := freePort(t)
+	cfg.Forwards = map[string]string{fmt.Sprintf("127.0.0.1:%d", initialPort): "10.13.37.2:80"}
+
+	backend := NewVsockBackend(&cfg, vsockShared)
+	require.NoError(t, backend.Setup(context.Background()))
+	client := newTestAPIServer(t, backend)
+
+	var forwards []forward
+	require.NoError(t, client.do(http.MethodGet, "/api/forwards", nil, &forwards))
+	assert.Equal(t, []forward{{Protocol: "tcp", Local: fmt.Sprintf("127.0.0.1:%d", initialPort), Remote: "10.13.37.2:80"}}, forwards)
+
+	added := forward{Protocol: "udp", Local: fmt.Sprintf("127.0.0.1:%d", freePort(t)), Remote: "10.13.37.2:1234"}
+	require.NoError(t, client.do(http.MethodPost, "/api/forwards", added, nil))
+
+	err := client.do(http.MethodPost, "/api/forwards", added, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "proxy already running")
+	}
+
+	require.NoError(t, client.do(http.MethodGet, "/api/forwards", nil, &forwards))
+	assert.Len(t, forwards, 2)
+	assert.Contains(t, forwards, added)
+
+	query := url.Values{"protocol": {"udp"}, "local": {added.Local}}
+	require.NoError(t, client.do(http.MethodDelete, "/api/forwards?"+query.Encode(), nil, nil))
+
+	err = client.do(http.MethodDelete, "/api/forwards?"+query.Encode(), nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "proxy not found")
+	}
+
+	require.NoError(t, client.do(http.MethodGet, "/api/forwards", nil, &forwards))
+	assert.Len(t, forwards, 1)
+
+	err = client.do(http.MethodGet, "/api/forwards?session=abcd", nil, &forwards)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sessions share a single network")
+	}
+}
+
+func TestForwardsAPIIsolated(t *testing.T) {
+	cfg := defaultConfig()
+	port := freePort(t)
+	cfg.Forwards = map[string]string{fmt.Sprintf("127.0.0.1:%d", port): "10.13.37.2:80"}
+
+	backend := NewVsockBackend(&cfg, vsockIsolated)
+	require.NoError(t, backend.Setup(context.Background()))
+	client := newTestAPIServer(t, backend)
+
+	first := &session{ID: "first", RemoteAddr: "127.0.0.1:1"}
+	second := &session{ID: "second", RemoteAddr: "127.0.0.1:2"}
+	_, err := backend.createIsolatedNetwork(first)
+	require.NoError(t, err)
+	_, err = backend.createIsolatedNetwork(second)
+	require.NoError(t, err)
+
+	// the configured forward can only be bound by the first session
+	var forwards []forward
+	require.NoError(t, client.do(http.MethodGet, "/api/forwards?session=first", nil, &forwards))
+	assert.Len(t, forwards, 1)
+	require.NoError(t, client.do(http.MethodGet, "/api/forwards?session=second", nil, &forwards))
+	assert.Len(t, forwards, 0)
+
+	err = client.do(http.MethodGet, "/api/forwards", nil, &forwards)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "a session is required")
+	}
+	err = client.do(http.MethodGet, "/api/forwards?session=third", nil, &forwards)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown session")
+	}
+
+	// once the first session is gone, its ports are available again
+	backend.destroyIsolatedNetwork(first)
+	fwd := forward{Protocol: "tcp", Local: fmt.Sprintf("127.0.0.1:%d", port), Remote: "10.13.37.2:80"}
+	require.NoError(t, client.do(http.MethodPost, "/api/forwards?session=second", fwd, nil))
+	require.NoError(t, client.do(http.MethodGet, "/api/forwards?session=second", nil, &forwards))
+	assert.Equal(t, []forward{fwd}, forwards)
+	backend.destroyIsolatedNetwork(second)
+}
+
+func TestForwardsAPIValidation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Forwards = map[string]string{}
+	backend := NewVsockBackend(&cfg, vsockShared)
+	require.NoError(t, backend.Setup(context.Background()))
+	client := newTestAPIServer(t, backend)
+
+	tcs := map[string]struct {
+		fwd       forward
+		errStrPfx string
+	}{
+		"invalid protocol":    {forward{Protocol: "sctp", Local: ":8080", Remote: "10.13.37.2:80"}, "invalid protocol specified"},
+		"missing remote":      {forward{Local: ":8080"}, "remote address is required"},
+		"invalid local":       {forward{Local: "8080", Remote: "10.13.37.2:80"}, "invalid local address specified"},
+		"invalid local port":  {forward{Local: ":99999", Remote: "10.13.37.2:80"}, "invalid local port specified"},
+		"hostname as remote":  {forward{Local: ":8080", Remote: "device:80"}, "must be an IPv4 address"},
+		"invalid remote port": {forward{Local: ":8080", Remote: "10.13.37.2:http"}, "invalid remote port specified"},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := client.do(http.MethodPost, "/api/forwards", tc.fwd, nil)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.errStrPfx)
+			}
+		})
+	}
+}
+
+func TestForwardsAPIRejectsBrowsers(t *testing.T) {
+	cfg := defaultConfig()
+	mux := http.NewServeMux()
+	registerAPI(mux, NewVsockBackend(&cfg, vsockShared), newSessionRegistry(), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/forwards", nil)
+	req.Header.Set("Origin", "https://wokwi.com")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestForwardsAPINotSupported(t *testing.T) {
+	cfg := defaultConfig()
+	client := newTestAPIServer(t, NewWaterBackend(&cfg))
+
+	err := client.do(http.MethodGet, "/api/forwards", nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), errForwardsNotSupported.Error())
+	}
+}
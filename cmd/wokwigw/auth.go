@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errMissingToken = errors.New("missing authentication token")
+	errInvalidToken = errors.New("invalid authentication token")
+)
+
+type authToken struct {
+	identity string
+	token    []byte
+}
+
+// authenticator checks the token of incoming requests. Tokens are given as "name:token", where the
+// name identifies the token holder in the logs, or just "token".
+type authenticator struct {
+	tokens []authToken
+}
+
+func newAuthenticator(tokens []string, tokenFile string) (*authenticator, error) {
+	a := &authenticator{}
+	for _, token := range tokens {
+		if err := a.add(token, "--authToken"); err != nil {
+			return nil, err
+		}
+	}
+
+	if tokenFile != "" {
+		file, err := os.Open(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token file: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := a.add(line, fmt.Sprintf("%s:%d", tokenFile, lineNo)); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading token file: %w", err)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *authenticator) add(entry string, source string) error {
+	identity, token, found := strings.Cut(entry, ":")
+	if !found {
+		identity, token = fmt.Sprintf("token #%d", len(a.tokens)+1), entry
+	}
+	if token == "" {
+		return fmt.Errorf("empty authentication token specified (%s)", source)
+	}
+	a.tokens = append(a.tokens, authToken{identity: identity, token: []byte(token)})
+	return nil
+}
+
+func (a *authenticator) enabled() bool {
+	return a != nil && len(a.tokens) > 0
+}
+
+// requestToken extracts the token from the Authorization header ("Bearer <token>"), or from the
+// token query parameter, since browsers can't set headers on WebSocket connections.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate returns the identity of the token holder. When authentication is disabled, it
+// accepts every request with an empty identity.
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	if !a.enabled() {
+		return "", nil
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		return "", errMissingToken
+	}
+
+	identity := ""
+	for _, candidate := range a.tokens {
+		// Check every token, so the response time doesn't depend on which one matched
+		if subtle.ConstantTimeCompare([]byte(token), candidate.token) == 1 && identity == "" {
+			identity = candidate.identity
+		}
+	}
+	if identity == "" {
+		return "", errInvalidToken
+	}
+	return identity, nil
+}
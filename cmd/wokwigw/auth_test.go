@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticator(t *testing.T) {
+	tokenFile := writeConfigFile(t, "tokens", "# CI runners\nci:s3cr3t\n\nanonymous-token\n")
+	auth, err := newAuthenticator([]string{"alice:alice-token"}, tokenFile)
+	require.NoError(t, err)
+	assert.True(t, auth.enabled())
+
+	tcs := map[string]struct {
+		header   string
+		query    string
+		identity string
+		err      error
+	}{
+		"bearer header":    {"Bearer alice-token", "", "alice", nil},
+		"lowercase bearer": {"bearer s3cr3t", "", "ci", nil},
+		"query parameter":  {"", "anonymous-token", "token #3", nil},
+		"invalid token":    {"Bearer nope", "", "", errInvalidToken},
+		"token prefix":     {"", "alice", "", errInvalidToken},
+		"missing token":    {"", "", "", errMissingToken},
+		"basic auth":       {"Basic YWxpY2U6YWxpY2U=", "", "", errMissingToken},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?token="+tc.query, nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			identity, err := auth.authenticate(r)
+			assert.Equal(t, tc.identity, identity)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+
+	disabled, err := newAuthenticator(nil, "")
+	require.NoError(t, err)
+	identity, err := disabled.authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "", identity)
+
+	_, err = newAuthenticator([]string{"alice:"}, "")
+	assert.ErrorContains(t, err, "empty authentication token specified")
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	useTestFlags(t, flagCfg{
+		allowedOrigins: []string{defaultOriginsKeyword},
+		authTokens:     []string{"alice:alice-token"},
+	})
+
+	server := httptest.NewServer(newWebSocketHandler(context.Background(), nullBackend{}))
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://wokwi.com"}})}
+
+	t.Run("rejected", func(t *testing.T) {
+		conn := dialTestWebSocket(t, dialer, wsURL+"/?token=nope")
+
+		msg, op, err := wsutil.ReadServerData(conn)
+		require.NoError(t, err)
+		assert.Equal(t, ws.OpText, op)
+		var reply errorMessage
+		require.NoError(t, json.Unmarshal(msg, &reply))
+		assert.Equal(t, makeErrorMessage("unauthorized", errInvalidToken.Error()), reply)
+
+		_, _, err = wsutil.ReadServerData(conn)
+		var closed wsutil.ClosedError
+		if assert.ErrorAs(t, err, &closed) {
+			assert.Equal(t, ws.StatusPolicyViolation, closed.Code)
+		}
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		conn := dialTestWebSocket(t, dialer, wsURL+"/?token=alice-token")
+
+		msg, _, err := wsutil.ReadServerData(conn)
+		require.NoError(t, err)
+		var reply alohaMessage
+		require.NoError(t, json.Unmarshal(msg, &reply))
+		assert.Equal(t, "aloha", reply.Type)
+	})
+}
+
+func TestAPIAuth(t *testing.T) {
+	auth, err := newAuthenticator([]string{"alice:alice-token"}, "")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	registerAPI(mux, nullBackend{}, newSessionRegistry(), auth)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client := newAPIClient(&flagCfg{gatewayURL: server.URL})
+	assert.ErrorContains(t, client.do(http.MethodGet, "/api/sessions", nil, nil), errMissingToken.Error())
+
+	client = newAPIClient(&flagCfg{gatewayURL: server.URL, clientToken: "alice-token"})
+	assert.NoError(t, client.do(http.MethodGet, "/api/sessions", nil, nil))
+}
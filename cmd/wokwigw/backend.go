@@ -10,6 +10,14 @@ import (
 
 type Backend interface {
 	Setup(ctx context.Context) error
-	HandleConnection(ctx context.Context, conn net.Conn, remoteAddr string) error
+	HandleConnection(ctx context.Context, conn net.Conn, s *session) error
 	Cleanup() error
 }
+
+// Forwarder is implemented by backends that can change port forwards at runtime.
+// An empty sessionID refers to the network shared by all the sessions.
+type Forwarder interface {
+	Forwards(sessionID string) ([]forward, error)
+	AddForward(sessionID string, fwd forward) error
+	RemoveForward(sessionID string, fwd forward) error
+}
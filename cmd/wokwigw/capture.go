@@ -0,0 +1,299 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	captureSnapLen = 65535
+	// Frames buffered for every viewer. When a viewer can't keep up, the following frames are dropped.
+	captureBufferFrames = 1024
+)
+
+type capturedFrame struct {
+	session   string
+	timestamp time.Time
+	data      []byte
+}
+
+// captureViewer receives the frames of one live capture, optionally of a single session or
+// selected by a filter
+type captureViewer struct {
+	session string
+	filter  *captureFilter
+	frames  chan capturedFrame
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// captureRecorder keeps the frames of all the sessions: the capture file and the ring buffer
+type captureRecorder interface {
+	sessionStarted(s *session) error
+	writeFrame(s *session, direction string, timestamp time.Time, frame []byte) error
+	writeEvent(s *session, timestamp time.Time, comment string) error
+	sessionEnded(s *session) error
+	Close() error
+}
+
+// captureHub copies the frames exchanged with the simulators to the capture file, the ring
+// buffer and the live capture viewers
+type captureHub struct {
+	lock    sync.Mutex
+	viewers map[*captureViewer]struct{}
+	active  atomic.Int32
+	file    atomic.Pointer[captureFile]
+	ring    atomic.Pointer[captureRing]
+	filter  atomic.Pointer[captureFilter] // of the recorders (--captureFilter)
+}
+
+var captures = newCaptureHub()
+
+func newCaptureHub() *captureHub {
+	return &captureHub{
+		viewers: make(map[*captureViewer]struct{}),
+	}
+}
+
+// openFile starts writing the frames of all the sessions to a pcapng file
+func (h *captureHub) openFile(path string, options captureFileOptions) error {
+	file, err := createCaptureFile(path, options)
+	if err != nil {
+		return err
+	}
+	h.file.Store(file)
+	return nil
+}
+
+// startRing starts keeping the most recent frames of all the sessions in memory
+func (h *captureHub) startRing(limit int64) {
+	h.ring.Store(newCaptureRing(limit))
+}
+
+// stop stops writing the capture file and the ring buffer, once the sessions are gone
+func (h *captureHub) stop() {
+	if file := h.file.Swap(nil); file != nil {
+		if err := file.Close(); err != nil {
+			logrus.WithError(err).Error("error closing capture file")
+		}
+	}
+	h.ring.Store(nil)
+}
+
+func (h *captureHub) recorders() []captureRecorder {
+	var recorders []captureRecorder
+	if file := h.file.Load(); file != nil {
+		recorders = append(recorders, file)
+	}
+	if ring := h.ring.Load(); ring != nil {
+		recorders = append(recorders, ring)
+	}
+	return recorders
+}
+
+// setFilter selects the frames written to the capture file and the ring buffer. nil selects all.
+func (h *captureHub) setFilter(filter *captureFilter) {
+	h.filter.Store(filter)
+}
+
+// subscribe starts a live capture of the given session, or of all the sessions when empty, with
+// an optional filter
+func (h *captureHub) subscribe(session string, filter *captureFilter) *captureViewer {
+	v := &captureViewer{
+		session: session,
+		filter:  filter,
+		frames:  make(chan capturedFrame, captureBufferFrames),
+		done:    make(chan struct{}),
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.viewers[v] = struct{}{}
+	h.active.Add(1)
+	return v
+}
+
+// unsubscribe ends a live capture. It's safe to call more than once.
+func (h *captureHub) unsubscribe(v *captureViewer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remove(v)
+}
+
+func (h *captureHub) remove(v *captureViewer) {
+	if _, ok := h.viewers[v]; ok {
+		delete(h.viewers, v)
+		h.active.Add(-1)
+		close(v.done)
+	}
+}
+
+// sessionStarted records the connection of a simulator
+func (h *captureHub) sessionStarted(s *session) {
+	for _, recorder := range h.recorders() {
+		if err := recorder.sessionStarted(s); err != nil {
+			s.log().WithError(err).Error("error writing to capture file")
+		}
+	}
+}
+
+// capture copies a frame to the recorders and to the viewers of the session. Direction in is
+// from the simulator.
+func (h *captureHub) capture(s *session, direction string, frame []byte) {
+	recorders := h.recorders()
+	if len(recorders) == 0 && h.active.Load() == 0 {
+		return
+	}
+
+	timestamp := time.Now()
+	filtered := filterFrame{frame: frame}
+	defer filtered.release()
+	if len(recorders) > 0 && !h.filter.Load().matchesPacket(&filtered) {
+		recorders = nil
+	}
+	for _, recorder := range recorders {
+		if err := recorder.writeFrame(s, direction, timestamp, frame); err != nil {
+			s.log().WithError(err).Error("error writing to capture file")
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var captured *capturedFrame
+	for v := range h.viewers {
+		if (v.session != "" && v.session != s.ID) || !v.filter.matchesPacket(&filtered) {
+			continue
+		}
+		if captured == nil {
+			captured = &capturedFrame{session: s.ID, timestamp: timestamp, data: append([]byte(nil), frame...)}
+		}
+		select {
+		case v.frames <- *captured:
+		default:
+			v.dropped.Add(1)
+		}
+	}
+}
+
+// event records something that happened to a session, e.g. a scenario step, as a comment
+func (h *captureHub) event(s *session, comment string) {
+	timestamp := time.Now()
+	for _, recorder := range h.recorders() {
+		if err := recorder.writeEvent(s, timestamp, comment); err != nil {
+			s.log().WithError(err).Error("error writing to capture file")
+		}
+	}
+}
+
+// sessionEnded records the disconnection of a simulator, and ends the live captures of the session
+func (h *captureHub) sessionEnded(s *session) {
+	for _, recorder := range h.recorders() {
+		if err := recorder.sessionEnded(s); err != nil {
+			s.log().WithError(err).Error("error writing to capture file")
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for v := range h.viewers {
+		if v.session == s.ID {
+			h.remove(v)
+		}
+	}
+}
+
+// close ends all the live captures, e.g. on shutdown
+func (h *captureHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for v := range h.viewers {
+		h.remove(v)
+	}
+}
+
+var errNoCaptureRing = errors.New("the capture ring buffer is not enabled, start the gateway with --captureRingBuffer")
+
+// registerCapture streams a live pcap on /capture, for all the sessions or for the one given with
+// ?session=, optionally selected with ?filter= (see captureFilter), and serves the ring buffer on
+// /api/capture/buffer. They have the same access rules as the API.
+func registerCapture(mux *http.ServeMux, sessions *sessionRegistry, auth *authenticator) {
+	mux.HandleFunc("GET /api/capture/buffer", apiOnly(auth, func(w http.ResponseWriter, r *http.Request) {
+		ring := captures.ring.Load()
+		if ring == nil {
+			writeAPIError(w, http.StatusNotFound, errNoCaptureRing)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="wokwigw-%s.pcapng"`, time.Now().Format(captureRotatedTimeFormat)))
+		if err := ring.dump(w); err != nil {
+			logrus.WithError(err).Warn("error sending capture ring buffer")
+		}
+	}))
+
+	mux.HandleFunc("GET /capture", apiOnly(auth, func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.URL.Query().Get("session")
+		if sessionID != "" && sessions.get(sessionID) == nil {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w (%s)", errUnknownSession, sessionID))
+			return
+		}
+		filter, err := parseCaptureFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+
+		viewer := captures.subscribe(sessionID, filter)
+		defer captures.unsubscribe(viewer)
+
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Cache-Control", "no-store")
+		writer := pcapgo.NewWriter(w)
+		if err := writer.WriteFileHeader(captureSnapLen, layers.LinkTypeEthernet); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		log := logrus.WithFields(logrus.Fields{"remoteAddr": remoteAddr(r), "session": sessionID, "filter": filter.String()})
+		log.Info("live capture started")
+		defer func() {
+			log.WithField("dropped", viewer.dropped.Load()).Info("live capture ended")
+		}()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-viewer.done:
+				return
+			case frame := <-viewer.frames:
+				ci := gopacket.CaptureInfo{
+					Timestamp:     frame.timestamp,
+					CaptureLength: len(frame.data),
+					Length:        len(frame.data),
+				}
+				if err := writer.WritePacket(ci, frame.data); err != nil {
+					return
+				}
+				if len(viewer.frames) == 0 {
+					flusher.Flush()
+				}
+			}
+		}
+	}))
+}
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openCapture(t *testing.T, url string) *pcapgo.Reader {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/vnd.tcpdump.pcap", resp.Header.Get("Content-Type"))
+	reader, err := pcapgo.NewReader(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, layers.LinkTypeEthernet, reader.LinkType())
+	return reader
+}
+
+func TestLiveCapture(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, &drainBackend{})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/"
+
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://wokwi.com"}})}
+	connect := func() (*session, func(frame []byte)) {
+		known := make(map[string]bool)
+		for _, s := range sessions.list() {
+			known[s.ID] = true
+		}
+		conn := dialTestWebSocket(t, dialer, wsURL)
+		_, _, err := wsutil.ReadServerData(conn) // aloha
+		require.NoError(t, err)
+		var started *session
+		require.Eventually(t, func() bool {
+			for _, s := range sessions.list() {
+				if !known[s.ID] {
+					started = s
+				}
+			}
+			return started != nil
+		}, time.Second, 10*time.Millisecond)
+		return started, func(frame []byte) {
+			require.NoError(t, wsutil.WriteClientBinary(conn, frame))
+		}
+	}
+	first, sendFirst := connect()
+	_, sendSecond := connect()
+
+	all1 := openCapture(t, server.URL+"/capture")
+	all2 := openCapture(t, server.URL+"/capture")
+	filtered := openCapture(t, server.URL+"/capture?session="+first.ID)
+
+	frame1 := []byte("\xff\xff\xff\xff\xff\xff\x02\x00\x00\x00\x00\x01\x08\x06first")
+	frame2 := []byte("\xff\xff\xff\xff\xff\xff\x02\x00\x00\x00\x00\x02\x08\x06second")
+	sendSecond(frame2)
+	sendFirst(frame1)
+
+	for _, reader := range []*pcapgo.Reader{all1, all2} {
+		var captured [][]byte
+		for range 2 {
+			data, ci, err := reader.ReadPacketData()
+			require.NoError(t, err)
+			assert.Equal(t, len(data), ci.Length)
+			captured = append(captured, data)
+		}
+		assert.ElementsMatch(t, [][]byte{frame1, frame2}, captured)
+	}
+
+	data, _, err := filtered.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, frame1, data)
+}
+
+func TestLiveCaptureSessionEnded(t *testing.T) {
+	hub := newCaptureHub()
+	s := &session{ID: "1"}
+	viewer := hub.subscribe(s.ID, nil)
+	other := hub.subscribe("", nil)
+
+	hub.capture(s, directionIn, []byte{1, 2, 3})
+	frame := <-viewer.frames
+	assert.Equal(t, []byte{1, 2, 3}, frame.data)
+	assert.Equal(t, "1", frame.session)
+
+	hub.sessionEnded(s)
+	<-viewer.done
+	select {
+	case <-other.done:
+		t.Fatal("the capture of all the sessions should go on")
+	default:
+	}
+
+	hub.close()
+	<-other.done
+	hub.unsubscribe(other)
+	assert.Zero(t, hub.active.Load())
+}
+
+func TestLiveCaptureDroppedFrames(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, echoBackend{})
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	defer sim.conn.Close()
+	viewer := captures.subscribe(sim.session.ID, nil)
+	defer captures.unsubscribe(viewer)
+
+	step := &scenarioStep{Action: faultDrop, Duration: "1m", Direction: directionIn, Filter: "udp port 53"}
+	require.NoError(t, step.parse(false))
+	sim.session.faults.start(step, nil)
+
+	// The frame dropped on its way in isn't captured, like the frames dropped on their way out
+	dns := udpFrame(t, net.IP{10, 13, 37, 1}, 53)
+	other := udpFrame(t, net.IP{10, 13, 37, 1}, 123)
+	require.NoError(t, wsutil.WriteClientBinary(sim.conn, dns))
+	require.NoError(t, wsutil.WriteClientBinary(sim.conn, other))
+	require.NoError(t, sim.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	echo, _, err := wsutil.ReadServerData(sim.conn)
+	require.NoError(t, err)
+	assert.Equal(t, other, echo)
+
+	// The echo is captured once it's written
+	require.Eventually(t, func() bool { return len(viewer.frames) == 2 }, time.Second, 5*time.Millisecond)
+	for range 2 {
+		assert.Equal(t, other, (<-viewer.frames).data)
+	}
+}
+
+func TestLiveCaptureSlowViewer(t *testing.T) {
+	hub := newCaptureHub()
+	viewer := hub.subscribe("", nil)
+	for range captureBufferFrames + 10 {
+		hub.capture(&session{ID: "1"}, directionOut, []byte{0})
+	}
+	assert.Len(t, viewer.frames, captureBufferFrames)
+	assert.Equal(t, uint64(10), viewer.dropped.Load())
+}
+
+func TestLiveCaptureUnknownSession(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, nullBackend{})
+
+	resp, err := http.Get(server.URL + "/capture?session=nope")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "nope")
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/capture", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://wokwi.com")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newCaptureCmd(flags *flagCfg) *cobra.Command {
+	captureCmd := &cobra.Command{
+		Use:   "capture",
+		Short: "Manage the packet capture of a running gateway",
+	}
+	captureCmd.PersistentFlags().StringVar(&flags.gatewayURL, "gateway", flags.gatewayURL, "URL of the running gateway, or unix:/path/to/socket (default: the first --listen address)")
+	captureCmd.PersistentFlags().StringVar(&flags.clientToken, "token", flags.clientToken, "authentication token of the running gateway")
+
+	captureCmd.AddCommand(&cobra.Command{
+		Use:   "dump file.pcapng",
+		Short: "Save the capture ring buffer (see --captureRingBuffer) to a file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := newAPIClient(flags).download("/api/capture/buffer", args[0]); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Capture saved to %s\n", args[0])
+			return nil
+		},
+	})
+
+	return captureCmd
+}
@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const captureRotatedTimeFormat = "20060102-150405.000"
+
+// captureFileOptions limit the size of the capture file. Zero values mean no limit.
+type captureFileOptions struct {
+	maxSize     int64
+	maxDuration time.Duration
+	maxFiles    int // including the current file
+}
+
+// captureFile is the capture file given with --captureFile. When it gets too large or too old,
+// it's renamed with the time it was created (e.g. capture-20250102-150405.000.pcapng), and a new
+// file is started.
+type captureFile struct {
+	lock    sync.Mutex
+	path    string
+	options captureFileOptions
+	file    *os.File
+	size    int64
+	created time.Time
+	writer  *pcapngWriter
+}
+
+func createCaptureFile(path string, options captureFileOptions) (*captureFile, error) {
+	f := &captureFile{path: path, options: options}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *captureFile) open() error {
+	file, err := os.Create(f.path)
+	if err != nil {
+		return fmt.Errorf("error creating capture file: %w", err)
+	}
+	f.file = file
+	f.size = 0
+	f.created = time.Now()
+	writer, err := newPCAPNGWriter(&countingWriter{w: file, n: &f.size})
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error writing capture file header: %w", err)
+	}
+	f.writer = writer
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func (f *captureFile) rotationDue() bool {
+	return (f.options.maxSize > 0 && f.size >= f.options.maxSize) ||
+		(f.options.maxDuration > 0 && time.Since(f.created) >= f.options.maxDuration)
+}
+
+// rotate starts a new file and deletes the oldest ones. The sessions get their interface in
+// the new file with their next frame.
+func (f *captureFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(f.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), f.created.Format(captureRotatedTimeFormat), ext)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	logrus.WithField("file", rotated).Debug("capture file rotated")
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.prune()
+}
+
+func (f *captureFile) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(f.path)
+	files, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, file := range files {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(file, strings.TrimSuffix(f.path, ext)+"-"), ext)
+		if _, err := time.Parse(captureRotatedTimeFormat, stamp); err == nil {
+			rotated = append(rotated, file)
+		}
+	}
+	// The time format sorts in chronological order
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// prune deletes the oldest rotated files, keeping maxFiles files including the current one
+func (f *captureFile) prune() error {
+	if f.options.maxFiles <= 0 {
+		return nil
+	}
+	rotated, err := f.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > f.options.maxFiles-1 {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func (f *captureFile) sessionStarted(s *session) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writer.sessionStarted(s)
+}
+
+func (f *captureFile) writeFrame(s *session, direction string, timestamp time.Time, frame []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.rotationDue() {
+		if err := f.rotate(); err != nil {
+			return fmt.Errorf("error rotating capture file: %w", err)
+		}
+	}
+	return f.writer.writeFrame(s, direction, timestamp, frame)
+}
+
+func (f *captureFile) writeEvent(s *session, timestamp time.Time, comment string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writer.writeEvent(s, timestamp, comment)
+}
+
+func (f *captureFile) sessionEnded(s *session) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writer.sessionEnded(s)
+}
+
+func (f *captureFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+// parseSize parses a size such as 512KB, 100MB or 1GB (in powers of 1024). Plain numbers are bytes.
+func parseSize(text string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	value, multiplier := strings.ToUpper(strings.TrimSpace(text)), int64(1)
+	for _, unit := range units {
+		if number, found := strings.CutSuffix(value, unit.suffix); found {
+			value, multiplier = strings.TrimSpace(number), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size specified (%s)", text)
+	}
+	return n * multiplier, nil
+}
+
+// validateCaptureFlags parses the capture rotation, filter and ring buffer flags
+func validateCaptureFlags(flags *flagCfg) error {
+	var err error
+	if flags.captureMaxSize != "" {
+		if flags.captureRotation.maxSize, err = parseSize(flags.captureMaxSize); err != nil {
+			return fmt.Errorf("invalid capture max size: %w", err)
+		}
+	}
+	if flags.captureMaxDuration < 0 {
+		return fmt.Errorf("invalid capture max duration specified (%s)", flags.captureMaxDuration)
+	}
+	flags.captureRotation.maxDuration = flags.captureMaxDuration
+	if flags.captureMaxFiles < 0 {
+		return fmt.Errorf("invalid capture max files specified (%d)", flags.captureMaxFiles)
+	}
+	flags.captureRotation.maxFiles = flags.captureMaxFiles
+	if flags.captureFile == "" && flags.captureRotation != (captureFileOptions{}) {
+		return fmt.Errorf("--captureMaxSize, --captureMaxDuration and --captureMaxFiles require --captureFile")
+	}
+
+	if flags.captureFilterExpr, err = parseCaptureFilter(flags.captureFilter); err != nil {
+		return err
+	}
+
+	if flags.captureRingBuffer != "" {
+		if flags.captureRingSize, err = parseSize(flags.captureRingBuffer); err != nil {
+			return fmt.Errorf("invalid capture ring buffer size: %w", err)
+		}
+	}
+	return nil
+}
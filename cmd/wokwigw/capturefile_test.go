@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tcs := map[string]int64{
+		"100":    100,
+		"100B":   100,
+		"512KB":  512 << 10,
+		"64mb":   64 << 20,
+		"64M":    64 << 20,
+		"1GB":    1 << 30,
+		" 2 MB ": 2 << 20,
+	}
+	for text, want := range tcs {
+		size, err := parseSize(text)
+		if assert.NoError(t, err, text) {
+			assert.Equal(t, want, size, text)
+		}
+	}
+
+	for _, text := range []string{"", "MB", "-1MB", "1TB", "1.5MB"} {
+		_, err := parseSize(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestCaptureFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.pcapng")
+	file, err := createCaptureFile(path, captureFileOptions{maxSize: 1000, maxFiles: 3})
+	require.NoError(t, err)
+
+	s := &session{ID: "aaaa", RemoteAddr: "127.0.0.1:5000", Started: time.Now()}
+	require.NoError(t, file.sessionStarted(s))
+	frame := make([]byte, 300)
+	for range 20 {
+		require.NoError(t, file.writeFrame(s, directionIn, time.Now(), frame))
+		// The rotated files are named after the time they were created
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.NoError(t, file.sessionEnded(s))
+	require.NoError(t, file.Close())
+
+	rotated, err := filepath.Glob(filepath.Join(dir, "capture-*.pcapng"))
+	require.NoError(t, err)
+	assert.Len(t, rotated, 2)
+
+	// Every file is a complete capture, with the interface of the session
+	for _, name := range append(rotated, path) {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 1000+400)
+		reader, err := pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions)
+		require.NoError(t, err, name)
+		_, _, err = reader.ReadPacketData()
+		require.NoError(t, err, name)
+		intf, err := reader.Interface(0)
+		require.NoError(t, err)
+		assert.Equal(t, "session aaaa", intf.Name)
+	}
+}
+
+func TestCaptureFileMaxDuration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	file, err := createCaptureFile(path, captureFileOptions{maxDuration: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer file.Close()
+
+	s := &session{ID: "aaaa", Started: time.Now()}
+	require.NoError(t, file.writeFrame(s, directionIn, time.Now(), []byte{1}))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, file.writeFrame(s, directionIn, time.Now(), []byte{2}))
+
+	rotated, err := file.rotatedFiles()
+	require.NoError(t, err)
+	assert.Len(t, rotated, 1)
+}
+
+func TestCaptureRing(t *testing.T) {
+	ring := newCaptureRing(1000)
+	first := &session{ID: "aaaa", Started: time.Now()}
+	second := &session{ID: "bbbb", Started: time.Now()}
+	for i := range 10 {
+		frame := bytes.Repeat([]byte{byte(i)}, 300)
+		require.NoError(t, ring.writeFrame(first, directionIn, time.Now(), frame))
+	}
+	require.NoError(t, ring.sessionEnded(first))
+	require.NoError(t, ring.writeFrame(second, directionOut, time.Now(), []byte("last")))
+
+	var buf bytes.Buffer
+	require.NoError(t, ring.dump(&buf))
+	reader, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	var frames [][]byte
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		frames = append(frames, data)
+	}
+	// Only the most recent frames that fit in 1000 bytes
+	require.Len(t, frames, 4)
+	assert.Equal(t, byte(7), frames[0][0])
+	assert.Equal(t, byte(9), frames[2][0])
+	assert.Equal(t, []byte("last"), frames[3])
+	assert.Equal(t, 2, reader.NInterfaces())
+}
+
+func TestCaptureRingDump(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, nullBackend{})
+	flags := &flagCfg{gatewayURL: server.URL}
+	path := filepath.Join(t.TempDir(), "failed.pcapng")
+
+	err := newAPIClient(flags).download("/api/capture/buffer", path)
+	assert.ErrorContains(t, err, "--captureRingBuffer")
+
+	captures.startRing(1 << 20)
+	t.Cleanup(captures.stop)
+	captures.capture(&session{ID: "aaaa", Started: time.Now()}, directionIn, []byte("frame"))
+
+	cmd := newCaptureCmd(flags)
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"dump", path})
+	require.NoError(t, cmd.Execute())
+	assert.Contains(t, out.String(), path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	reader, err := pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	frame, _, err := reader.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("frame"), frame)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/capture/buffer", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://wokwi.com")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
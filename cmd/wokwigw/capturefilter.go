@@ -0,0 +1,408 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// captureFilter selects the frames to capture, with a subset of the tcpdump (pcap-filter) syntax:
+//
+//	primitives:  ether, arp, ip, ip6, tcp, udp, icmp, icmp6, broadcast, multicast
+//	             [proto] [src|dst] host ADDR      (ADDR is an IP address, or a MAC address after ether)
+//	             [ip|ip6] [src|dst] net CIDR
+//	             [tcp|udp] [src|dst] port N
+//	             [tcp|udp] [src|dst] portrange N-M
+//	             src ADDR, dst ADDR              (short for src host ADDR, dst host ADDR)
+//	operators:   not (!), and (&&), or (||), parentheses
+//
+// e.g. "tcp port 1883 or udp port 53", "host 10.13.37.2 and not arp".
+type captureFilter struct {
+	text  string
+	match func(p *filterPacket) bool
+}
+
+// filterPacket holds the layers of a frame that the filters look at. The packets are pooled, with
+// their parser, since a frame is decoded for every filter that isn't empty.
+type filterPacket struct {
+	eth     layers.Ethernet
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	arp     layers.ARP
+	tcp     layers.TCP
+	udp     layers.UDP
+	icmp4   layers.ICMPv4
+	icmp6   layers.ICMPv6
+	payload gopacket.Payload
+	decoded []gopacket.LayerType
+	parser  *gopacket.DecodingLayerParser
+}
+
+var filterPackets = sync.Pool{
+	New: func() any {
+		p := &filterPacket{}
+		p.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+			&p.eth, &p.ip4, &p.ip6, &p.arp, &p.tcp, &p.udp, &p.icmp4, &p.icmp6, &p.payload)
+		p.parser.IgnoreUnsupported = true
+		return p
+	},
+}
+
+// decodeFilterPacket decodes a frame for the filters. The packet refers to the frame, and goes
+// back to the pool with release.
+func decodeFilterPacket(frame []byte) *filterPacket {
+	p := filterPackets.Get().(*filterPacket)
+	// The Ethernet filters don't check that the layer was decoded
+	p.eth = layers.Ethernet{}
+	// Truncated frames keep the layers decoded so far
+	_ = p.parser.DecodeLayers(frame, &p.decoded)
+	return p
+}
+
+func (p *filterPacket) release() {
+	filterPackets.Put(p)
+}
+
+func (p *filterPacket) has(layerType gopacket.LayerType) bool {
+	for _, decoded := range p.decoded {
+		if decoded == layerType {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCaptureFilter compiles a filter expression. An empty expression returns nil, which matches
+// every frame.
+func parseCaptureFilter(text string) (*captureFilter, error) {
+	tokens := tokenizeCaptureFilter(text)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	parser := &filterParser{tokens: tokens}
+	match, err := parser.parseOr()
+	if err == nil && parser.pos < len(tokens) {
+		err = fmt.Errorf("unexpected %q", tokens[parser.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture filter specified (%s): %w", text, err)
+	}
+	return &captureFilter{text: text, match: match}, nil
+}
+
+// matches returns whether the filter selects the frame. A nil filter selects every frame.
+func (f *captureFilter) matches(frame []byte) bool {
+	if f == nil {
+		return true
+	}
+	p := decodeFilterPacket(frame)
+	defer p.release()
+	return f.match(p)
+}
+
+// matchesPacket is matches, for a frame already decoded (see filterFrame)
+func (f *captureFilter) matchesPacket(p *filterFrame) bool {
+	return f == nil || f.match(p.packet())
+}
+
+// filterFrame decodes a frame for the filters when the first one that isn't empty needs it, so
+// the frame is decoded once for all of them
+type filterFrame struct {
+	frame   []byte
+	decoded *filterPacket
+}
+
+func (p *filterFrame) packet() *filterPacket {
+	if p.decoded == nil {
+		p.decoded = decodeFilterPacket(p.frame)
+	}
+	return p.decoded
+}
+
+func (p *filterFrame) release() {
+	if p.decoded != nil {
+		p.decoded.release()
+		p.decoded = nil
+	}
+}
+
+func (f *captureFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.text
+}
+
+func tokenizeCaptureFilter(text string) []string {
+	for _, op := range []string{"(", ")", "!", "&&", "||"} {
+		text = strings.ReplaceAll(text, op, " "+op+" ")
+	}
+	return strings.Fields(text)
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+type filterMatch = func(p *filterPacket) bool
+
+func (fp *filterParser) peek() string {
+	if fp.pos < len(fp.tokens) {
+		return fp.tokens[fp.pos]
+	}
+	return ""
+}
+
+func (fp *filterParser) next() string {
+	token := fp.peek()
+	if token != "" {
+		fp.pos++
+	}
+	return token
+}
+
+func (fp *filterParser) parseOr() (filterMatch, error) {
+	left, err := fp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek() == "or" || fp.peek() == "||" {
+		fp.next()
+		right, err := fp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *filterPacket) bool { return l(p) || right(p) }
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseAnd() (filterMatch, error) {
+	left, err := fp.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek() == "and" || fp.peek() == "&&" {
+		fp.next()
+		right, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *filterPacket) bool { return l(p) && right(p) }
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseNot() (filterMatch, error) {
+	if fp.peek() == "not" || fp.peek() == "!" {
+		fp.next()
+		inner, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *filterPacket) bool { return !inner(p) }, nil
+	}
+	if fp.peek() == "(" {
+		fp.next()
+		inner, err := fp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if fp.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+	return fp.parsePrimitive()
+}
+
+var filterProtocols = map[string]gopacket.LayerType{
+	"ether": layers.LayerTypeEthernet,
+	"arp":   layers.LayerTypeARP,
+	"ip":    layers.LayerTypeIPv4,
+	"ip6":   layers.LayerTypeIPv6,
+	"tcp":   layers.LayerTypeTCP,
+	"udp":   layers.LayerTypeUDP,
+	"icmp":  layers.LayerTypeICMPv4,
+	"icmp6": layers.LayerTypeICMPv6,
+}
+
+func (fp *filterParser) parsePrimitive() (filterMatch, error) {
+	switch fp.peek() {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "broadcast":
+		fp.next()
+		return func(p *filterPacket) bool { return bytes.Equal(p.eth.DstMAC, layers.EthernetBroadcast) }, nil
+	case "multicast":
+		fp.next()
+		return func(p *filterPacket) bool { return len(p.eth.DstMAC) > 0 && p.eth.DstMAC[0]&1 != 0 }, nil
+	}
+
+	var proto, dir, kind string
+	if _, ok := filterProtocols[fp.peek()]; ok {
+		proto = fp.next()
+	}
+	if fp.peek() == "src" || fp.peek() == "dst" {
+		dir = fp.next()
+	}
+	switch fp.peek() {
+	case "host", "net", "port", "portrange":
+		kind = fp.next()
+	}
+
+	if kind == "" && dir == "" {
+		if proto == "" {
+			return nil, fmt.Errorf("unexpected %q", fp.peek())
+		}
+		layerType := filterProtocols[proto]
+		return func(p *filterPacket) bool { return p.has(layerType) }, nil
+	}
+	if kind == "" {
+		kind = "host"
+	}
+	value := fp.next()
+	if value == "" || value == "(" || value == ")" {
+		return nil, fmt.Errorf("missing value after %s", kind)
+	}
+
+	switch kind {
+	case "host":
+		return hostFilter(proto, dir, value)
+	case "net":
+		return netFilter(proto, dir, value)
+	default:
+		return portFilter(proto, dir, kind, value)
+	}
+}
+
+// matchDir applies a match on the source and/or the destination of a frame, depending on the
+// direction qualifier
+func matchDir(dir string, src, dst func(p *filterPacket) bool) filterMatch {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return func(p *filterPacket) bool { return src(p) || dst(p) }
+}
+
+func hostFilter(proto, dir, value string) (filterMatch, error) {
+	if proto == "ether" {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q", value)
+		}
+		return matchDir(dir,
+			func(p *filterPacket) bool { return bytes.Equal(p.eth.SrcMAC, mac) },
+			func(p *filterPacket) bool { return bytes.Equal(p.eth.DstMAC, mac) },
+		), nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", value)
+	}
+	switch proto {
+	case "", "ip", "ip6", "arp":
+	default:
+		return nil, fmt.Errorf("host cannot be used with %s", proto)
+	}
+	return matchDir(dir,
+		func(p *filterPacket) bool { src, _ := ipAddresses(p, proto); return ip.Equal(src) },
+		func(p *filterPacket) bool { _, dst := ipAddresses(p, proto); return ip.Equal(dst) },
+	), nil
+}
+
+// ipAddresses returns the source and destination addresses of an IPv4, IPv6 or ARP packet, when
+// it has the protocol qualifier (or any of them, when empty)
+func ipAddresses(p *filterPacket, proto string) (src, dst net.IP) {
+	switch {
+	case (proto == "" || proto == "ip") && p.has(layers.LayerTypeIPv4):
+		return p.ip4.SrcIP, p.ip4.DstIP
+	case (proto == "" || proto == "ip6") && p.has(layers.LayerTypeIPv6):
+		return p.ip6.SrcIP, p.ip6.DstIP
+	case (proto == "" || proto == "arp") && p.has(layers.LayerTypeARP):
+		return p.arp.SourceProtAddress, p.arp.DstProtAddress
+	}
+	return nil, nil
+}
+
+func netFilter(proto, dir, value string) (filterMatch, error) {
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", value)
+	}
+	switch proto {
+	case "", "ip", "ip6":
+	default:
+		return nil, fmt.Errorf("net cannot be used with %s", proto)
+	}
+	return matchDir(dir,
+		func(p *filterPacket) bool { src, _ := ipAddresses(p, proto); return src != nil && ipNet.Contains(src) },
+		func(p *filterPacket) bool { _, dst := ipAddresses(p, proto); return dst != nil && ipNet.Contains(dst) },
+	), nil
+}
+
+func parseFilterPort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
+
+func portFilter(proto, dir, kind, value string) (filterMatch, error) {
+	low, high := 0, 0
+	var err error
+	if kind == "portrange" {
+		first, last, found := strings.Cut(value, "-")
+		if !found {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+		if low, err = parseFilterPort(first); err != nil {
+			return nil, err
+		}
+		if high, err = parseFilterPort(last); err != nil {
+			return nil, err
+		}
+	} else {
+		if low, err = parseFilterPort(value); err != nil {
+			return nil, err
+		}
+		high = low
+	}
+	switch proto {
+	case "", "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("%s cannot be used with %s", kind, proto)
+	}
+
+	ports := func(p *filterPacket) (src, dst int, ok bool) {
+		if (proto == "" || proto == "tcp") && p.has(layers.LayerTypeTCP) {
+			return int(p.tcp.SrcPort), int(p.tcp.DstPort), true
+		}
+		if (proto == "" || proto == "udp") && p.has(layers.LayerTypeUDP) {
+			return int(p.udp.SrcPort), int(p.udp.DstPort), true
+		}
+		return 0, 0, false
+	}
+	inRange := func(port int) bool { return port >= low && port <= high }
+	return matchDir(dir,
+		func(p *filterPacket) bool { src, _, ok := ports(p); return ok && inRange(src) },
+		func(p *filterPacket) bool { _, dst, ok := ports(p); return ok && inRange(dst) },
+	), nil
+}
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// udpFrame is a UDP datagram from the simulator (10.13.37.2:50000) to the given address
+func udpFrame(t *testing.T, dstIP net.IP, dstPort layers.UDPPort) []byte {
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: testSimMAC, DstMAC: testGatewayMAC, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 13, 37, 2}.To4(), DstIP: dstIP.To4()},
+		&layers.UDP{SrcPort: 50000, DstPort: dstPort},
+		dnsQuery("query"))
+}
+
+func tcp6Frame(t *testing.T, dstPort layers.TCPPort) []byte {
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("fd00::1")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: dstPort, SYN: true, Window: 1024}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: testSimMAC, DstMAC: testGatewayMAC, EthernetType: layers.EthernetTypeIPv6},
+		ip, tcp)
+}
+
+func dnsQuery(s string) *layers.DNS {
+	return &layers.DNS{ID: 1, QDCount: 1, Questions: []layers.DNSQuestion{{Name: []byte(s), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+}
+
+func TestCaptureFilter(t *testing.T) {
+	mqtt := tcpFrame(t, true, false, 1883)
+	dns := udpFrame(t, net.IP{8, 8, 8, 8}, 53)
+	ntp := udpFrame(t, net.IP{162, 159, 200, 1}, 123)
+	arp := arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast)
+	https6 := tcp6Frame(t, 443)
+	frames := map[string][]byte{"mqtt": mqtt, "dns": dns, "ntp": ntp, "arp": arp, "https6": https6}
+
+	tcs := map[string][]string{
+		"":                                   {"mqtt", "dns", "ntp", "arp", "https6"},
+		"tcp port 1883 or udp port 53":       {"mqtt", "dns"},
+		"tcp port 1883 || udp port 53":       {"mqtt", "dns"},
+		"tcp":                                {"mqtt", "https6"},
+		"udp and not port 53":                {"ntp"},
+		"!(udp)":                             {"mqtt", "arp", "https6"},
+		"arp":                                {"arp"},
+		"ip6":                                {"https6"},
+		"ip":                                 {"mqtt", "dns", "ntp"},
+		"port 53":                            {"dns"},
+		"udp dst port 123":                   {"ntp"},
+		"src port 40000":                     {"mqtt", "https6"},
+		"dst port 40000":                     {},
+		"portrange 1-1024":                   {"dns", "ntp", "https6"},
+		"host 8.8.8.8":                       {"dns"},
+		"dst 8.8.8.8":                        {"dns"},
+		"src 8.8.8.8":                        {},
+		"host 10.13.37.2 and udp":            {"dns", "ntp"},
+		"arp host 10.13.37.1":                {"arp"},
+		"host fd00::1":                       {"https6"},
+		"net 10.13.37.0/24":                  {"mqtt", "dns", "ntp", "arp"},
+		"ip dst net 162.159.0.0/16":          {"ntp"},
+		"broadcast":                          {"arp"},
+		"multicast":                          {"arp"},
+		"ether src 24:0a:c4:00:01:10":        {"dns", "ntp", "arp", "https6"},
+		"ether host 42:13:37:55:aa:01":       {"mqtt", "dns", "ntp", "https6"},
+		"not (tcp port 443 or udp port 123)": {"mqtt", "dns", "arp"},
+		"tcp and (port 1883 or port 443)":    {"mqtt", "https6"},
+	}
+
+	for expr, want := range tcs {
+		filter, err := parseCaptureFilter(expr)
+		require.NoError(t, err, expr)
+		var got []string
+		for name, frame := range frames {
+			if filter.matches(frame) {
+				got = append(got, name)
+			}
+		}
+		assert.ElementsMatch(t, want, got, expr)
+	}
+
+	// Truncated frames are matched on the layers that are there
+	filter, err := parseCaptureFilter("ip")
+	require.NoError(t, err)
+	assert.True(t, filter.matches(mqtt[:ethHeaderLen+20]))
+	assert.False(t, filter.matches(mqtt[:10]))
+
+	// The pooled packets don't keep the layers of the previous frame
+	filter, err = parseCaptureFilter("broadcast")
+	require.NoError(t, err)
+	assert.True(t, filter.matches(frames["arp"]))
+	assert.False(t, filter.matches(frames["arp"][:10]))
+}
+
+func TestCaptureFilterErrors(t *testing.T) {
+	tcs := map[string]string{
+		"tcp port":            "missing value after port",
+		"port http":           "invalid port",
+		"port 70000":          "invalid port",
+		"portrange 80":        "invalid port range",
+		"host 10.0.0":         "invalid IP address",
+		"ether host 10.0.0.1": "invalid MAC address",
+		"net 10.0.0.0":        "invalid network",
+		"tcp host 10.0.0.1":   "host cannot be used with tcp",
+		"arp port 53":         "port cannot be used with arp",
+		"(tcp":                "missing )",
+		"tcp)":                "unexpected \")\"",
+		"tcp or":              "unexpected end of expression",
+		"vlan":                "unexpected \"vlan\"",
+		"tcp udp":             "unexpected \"udp\"",
+	}
+	for expr, want := range tcs {
+		_, err := parseCaptureFilter(expr)
+		if assert.Error(t, err, expr) {
+			assert.Contains(t, err.Error(), "invalid capture filter specified", expr)
+			assert.Contains(t, err.Error(), want, expr)
+		}
+	}
+}
+
+func TestCaptureFilterRecorders(t *testing.T) {
+	hub := newCaptureHub()
+	filter, err := parseCaptureFilter("udp port 53")
+	require.NoError(t, err)
+	hub.setFilter(filter)
+	hub.startRing(1 << 20)
+	require.NoError(t, hub.openFile(filepath.Join(t.TempDir(), "capture.pcapng"), captureFileOptions{}))
+	t.Cleanup(hub.stop)
+
+	// The live captures have their own filter
+	all := hub.subscribe("", nil)
+	arpOnly, err := parseCaptureFilter("arp")
+	require.NoError(t, err)
+	arpViewer := hub.subscribe("", arpOnly)
+
+	s := &session{ID: "aaaa", Started: time.Now()}
+	hub.capture(s, directionOut, tcpFrame(t, true, false, 1883))
+	hub.capture(s, directionIn, udpFrame(t, net.IP{8, 8, 8, 8}, 53))
+	hub.capture(s, directionIn, arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+
+	ring := hub.ring.Load()
+	require.Len(t, ring.records, 1)
+	assert.Equal(t, directionIn, ring.records[0].direction)
+	assert.Len(t, all.frames, 3)
+	assert.Len(t, arpViewer.frames, 1)
+}
+
+func TestLiveCaptureInvalidFilter(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, nullBackend{})
+
+	resp, err := http.Get(server.URL + "/capture?filter=tcp+port")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
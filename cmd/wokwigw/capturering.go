@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type captureRecord struct {
+	session   *session
+	direction string
+	timestamp time.Time
+	frame     []byte // nil for events
+	comment   string // of an event, empty when the session ended
+}
+
+// captureRing keeps the most recent frames in memory, up to a total size, so they can be saved
+// when something goes wrong (e.g. a test fails) without capturing a whole soak test to disk.
+type captureRing struct {
+	lock    sync.Mutex
+	limit   int64
+	size    int64
+	records []captureRecord
+}
+
+func newCaptureRing(limit int64) *captureRing {
+	return &captureRing{limit: limit}
+}
+
+// sessionStarted does nothing: the sessions get their interface when the buffer is dumped
+func (r *captureRing) sessionStarted(s *session) error {
+	return nil
+}
+
+func (r *captureRing) writeFrame(s *session, direction string, timestamp time.Time, frame []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, captureRecord{
+		session:   s,
+		direction: direction,
+		timestamp: timestamp,
+		frame:     append([]byte(nil), frame...),
+	})
+	r.size += int64(len(frame))
+	for r.size > r.limit && len(r.records) > 0 {
+		r.size -= int64(len(r.records[0].frame))
+		r.records[0] = captureRecord{}
+		r.records = r.records[1:]
+	}
+	return nil
+}
+
+func (r *captureRing) writeEvent(s *session, timestamp time.Time, comment string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, captureRecord{session: s, timestamp: timestamp, comment: comment})
+	return nil
+}
+
+func (r *captureRing) sessionEnded(s *session) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, captureRecord{session: s, timestamp: time.Now()})
+	return nil
+}
+
+func (r *captureRing) Close() error {
+	return nil
+}
+
+// dump writes the buffered frames as a pcapng capture
+func (r *captureRing) dump(w io.Writer) error {
+	r.lock.Lock()
+	records := append([]captureRecord(nil), r.records...)
+	r.lock.Unlock()
+
+	writer, err := newPCAPNGWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		switch {
+		case record.comment != "":
+			err = writer.writeEvent(record.session, record.timestamp, record.comment)
+		case record.frame == nil:
+			err = writer.sessionEnded(record.session)
+		default:
+			err = writer.writeFrame(record.session, record.direction, record.timestamp, record.frame)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
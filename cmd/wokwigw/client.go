@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiClient talks to the control API of a running gateway.
+type apiClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func newAPIClient(flags *flagCfg) *apiClient {
+	scheme := "http://"
+	if flags.tlsEnabled() {
+		scheme = "https://"
+	}
+
+	// The gateway is reached through a Unix socket for unix:/path URLs, or when it's the first
+	// endpoint the gateway listens on
+	var socket *listenEndpoint
+	baseURL := flags.gatewayURL
+	if path, found := strings.CutPrefix(baseURL, unixPrefix); found {
+		socket = &listenEndpoint{network: "unix", address: path}
+	} else if baseURL == "" {
+		endpoint := listenEndpoint{network: "tcp", address: net.JoinHostPort(defaultListenAddr, strconv.Itoa(flags.listenPort))}
+		if len(flags.listeners) > 0 {
+			endpoint = flags.listeners[0]
+		}
+		if endpoint.network == "unix" {
+			socket = &endpoint
+		} else {
+			baseURL = scheme + endpoint.clientAddress()
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if socket != nil {
+		baseURL = scheme + "localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialEndpoint(ctx, *socket)
+		}
+	}
+	if flags.tlsEnabled() {
+		// Trust the certificate of the gateway, which is usually self-signed
+		if certFile, err := flags.tlsCertFile(); err == nil {
+			if pemData, err := os.ReadFile(certFile); err == nil {
+				pool := x509.NewCertPool()
+				if pool.AppendCertsFromPEM(pemData) {
+					transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+				}
+			}
+		}
+	}
+
+	token := flags.clientToken
+	if token == "" && flags.auth.enabled() {
+		// Running on the same machine, with the same configuration as the gateway
+		token = string(flags.auth.tokens[0].token)
+	}
+	return &apiClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+// request sends an API request. The caller closes the body of the response, which has a success status.
+func (c *apiClient) request(method string, path string, body any) (*http.Response, error) {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the gateway at %s: %w", c.baseURL, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr apiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return nil, fmt.Errorf("gateway returned %s", resp.Status)
+		}
+		return nil, fmt.Errorf("gateway returned an error: %s", apiErr.Error)
+	}
+	return resp, nil
+}
+
+func (c *apiClient) do(method string, path string, body any, result any) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// download saves the response to a GET request in a file
+func (c *apiClient) download(path string, file string) error {
+	resp, err := c.request(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return fmt.Errorf("error downloading %s: %w", path, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+// compressionParameters are the permessage-deflate parameters the gateway accepts: without context
+// takeover in both directions, every message is compressed on its own, so the compressors can be
+// shared between the sessions and the simulator doesn't keep a window per connection.
+var compressionParameters = wsflate.Parameters{
+	ServerNoContextTakeover: true,
+	ClientNoContextTakeover: true,
+}
+
+// compressionMinSize is the smallest message the gateway compresses: the shorter ones (e.g. TCP
+// acknowledgments) don't get any smaller
+const compressionMinSize = 128
+
+// compressionOverhead is the most a deflate stream can add to a message that doesn't compress,
+// for the stored blocks of the largest frame
+const compressionOverhead = 64
+
+// deflaters compress the messages sent to the simulators. BestSpeed keeps up with the frame
+// rate of the backends, and still shrinks the text protocols a lot.
+var deflaters = sync.Pool{
+	New: func() any {
+		return wsflate.NewWriter(nil, func(w io.Writer) wsflate.Compressor {
+			fw, _ := flate.NewWriter(w, flate.BestSpeed)
+			return fw
+		})
+	},
+}
+
+// deflate appends the compressed payload to buf, without the tail of the deflate block, and
+// reports whether it's smaller than the payload. Otherwise buf is left as it was.
+func deflate(buf *bytes.Buffer, payload []byte) bool {
+	start := buf.Len()
+	fw := deflaters.Get().(*wsflate.Writer)
+	defer deflaters.Put(fw)
+	fw.Reset(buf)
+	if _, err := fw.Write(payload); err != nil || fw.Flush() != nil || buf.Len()-start >= len(payload) {
+		buf.Truncate(start)
+		return false
+	}
+	return true
+}
+
+// inflater is a flate reader that wsflate.Reader resets for every message, instead of
+// allocating a new one
+type inflater struct {
+	io.ReadCloser
+}
+
+func newInflater(r io.Reader) wsflate.Decompressor {
+	return &inflater{flate.NewReader(r)}
+}
+
+func (f *inflater) Reset(r io.Reader) {
+	_ = f.ReadCloser.(flate.Resetter).Reset(r, nil)
+}
+
+// compressedMessage returns the header and the payload of a message sent on a session with
+// compression: the data messages that shrink are sent compressed, with the RSV1 bit set. The
+// payload is appended to scratch when it's compressed.
+func compressedMessage(scratch *bytes.Buffer, op ws.OpCode, payload []byte) (ws.Header, []byte) {
+	hdr := ws.Header{Fin: true, OpCode: op, Length: int64(len(payload))}
+	if !op.IsData() || len(payload) < compressionMinSize || !deflate(scratch, payload) {
+		return hdr, payload
+	}
+	hdr, _ = wsflate.SetBit(hdr)
+	hdr.Length = int64(scratch.Len())
+	return hdr, scratch.Bytes()
+}
+
+// countingReader counts the bytes of the compressed messages read from the simulator
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
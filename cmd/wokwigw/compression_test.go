@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// textFrame returns an Ethernet frame with a text payload, which compresses well
+func textFrame(size int) []byte {
+	frame := make([]byte, ethHeaderLen, size)
+	for len(frame) < size {
+		frame = append(frame, `{"temperature":21.5,"humidity":40}`...)
+	}
+	return frame[:size]
+}
+
+// compressedClientFrame encodes a compressed message the way a client sends it
+func compressedClientFrame(t testing.TB, op ws.OpCode, payload []byte) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = fw.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, fw.Flush())
+	frame := ws.NewFrame(op, true, bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff}))
+	frame.Header, err = wsflate.SetBit(frame.Header)
+	require.NoError(t, err)
+	return clientFrames(t, frame)
+}
+
+// readServerMessage reads a message of the gateway, and reports whether it was compressed
+func readServerMessage(t *testing.T, conn net.Conn) ([]byte, bool) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	defer conn.SetReadDeadline(time.Time{})
+	frame, err := ws.ReadFrame(conn)
+	require.NoError(t, err)
+	compressed, err := wsflate.IsCompressed(frame.Header)
+	require.NoError(t, err)
+	frame, err = wsflate.DecompressFrame(frame)
+	require.NoError(t, err)
+	return frame.Payload, compressed
+}
+
+func TestSessionCompression(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, echoBackend{})
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{compression: true})
+	conn, s := sim.conn, sim.session
+	require.Len(t, sim.handshake.Extensions, 1)
+	assert.Equal(t, wsflate.ExtensionName, string(sim.handshake.Extensions[0].Name))
+	assert.True(t, s.Compression)
+
+	compressionBytes := func(direction string, stage string) float64 {
+		return testutil.ToFloat64(metrics.compressionBytes.WithLabelValues(s.Backend, direction, stage))
+	}
+	inBefore, outBefore := compressionBytes(directionIn, compressionStageCompressed), compressionBytes(directionOut, compressionStageCompressed)
+	inUncompressed, outUncompressed := compressionBytes(directionIn, compressionStageUncompressed), compressionBytes(directionOut, compressionStageUncompressed)
+
+	// A compressed frame is decompressed for the network, and the echo comes back compressed
+	frame := textFrame(1000)
+	_, err := conn.Write(compressedClientFrame(t, ws.OpBinary, frame))
+	require.NoError(t, err)
+	echo, compressed := readServerMessage(t, conn)
+	assert.Equal(t, frame, echo)
+	assert.True(t, compressed)
+	assert.Equal(t, uint64(1000), s.stats.bytesIn.Load())
+
+	assert.Equal(t, inUncompressed+1000, compressionBytes(directionIn, compressionStageUncompressed))
+	assert.Equal(t, outUncompressed+1000, compressionBytes(directionOut, compressionStageUncompressed))
+	assert.Less(t, compressionBytes(directionIn, compressionStageCompressed)-inBefore, 200.0)
+	assert.Less(t, compressionBytes(directionOut, compressionStageCompressed)-outBefore, 200.0)
+
+	// The small frames aren't worth compressing, and the simulator may send them as they are
+	assert.True(t, echoFrame(t, conn, testFrame(1)[:64], time.Second))
+
+	// A frame that expands beyond the maximum frame size closes the session
+	_, err = conn.Write(compressedClientFrame(t, ws.OpBinary, make([]byte, 64*1024)))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	closeFrame, err := ws.ReadFrame(conn)
+	require.NoError(t, err)
+	require.Equal(t, ws.OpClose, closeFrame.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(closeFrame.Payload)
+	assert.Equal(t, ws.StatusMessageTooBig, code)
+}
+
+func TestSessionNoCompression(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, noCompression: true})
+	server := newTestGateway(t, echoBackend{})
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{compression: true})
+	conn := sim.conn
+	assert.Empty(t, sim.handshake.Extensions)
+	assert.False(t, sim.session.Compression)
+
+	frame := textFrame(1000)
+	require.NoError(t, wsutil.WriteClientBinary(conn, frame))
+	echo, compressed := readServerMessage(t, conn)
+	assert.Equal(t, frame, echo)
+	assert.False(t, compressed)
+
+	// Without the extension, the compression bit is a protocol error
+	_, err := conn.Write(compressedClientFrame(t, ws.OpBinary, frame))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = ws.ReadFrame(conn)
+	assert.Error(t, err)
+}
+
+func TestFrameReaderCompression(t *testing.T) {
+	frame := textFrame(1000)
+	tcs := map[string]struct {
+		stream []byte
+		want   []byte
+		op     ws.OpCode
+		tooBig bool
+	}{
+		"compressed":      {stream: compressedClientFrame(t, ws.OpBinary, frame), want: frame, op: ws.OpBinary},
+		"uncompressed":    {stream: clientFrames(t, ws.NewBinaryFrame(frame)), want: frame, op: ws.OpBinary},
+		"text":            {stream: compressedClientFrame(t, ws.OpText, []byte("hello")), want: []byte("hello"), op: ws.OpText},
+		"at the limit":    {stream: compressedClientFrame(t, ws.OpBinary, textFrame(1518)), want: textFrame(1518), op: ws.OpBinary},
+		"expands":         {stream: compressedClientFrame(t, ws.OpBinary, textFrame(1519)), tooBig: true},
+		"bomb":            {stream: compressedClientFrame(t, ws.OpBinary, make([]byte, 1<<20)), tooBig: true},
+		"too large as is": {stream: clientFrames(t, ws.NewBinaryFrame(make([]byte, 1519))), tooBig: true},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			rw := &testReadWriter{Reader: bytes.NewReader(tc.stream)}
+			frames := newFrameReader(rw, rw, 1518, true)
+			data, op, err := frames.next()
+			if tc.tooBig {
+				assert.ErrorIs(t, err, errFrameTooLarge)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.op, op)
+			assert.Equal(t, tc.want, data)
+		})
+	}
+
+	// Compressed text must be valid UTF-8 once decompressed
+	rw := &testReadWriter{Reader: bytes.NewReader(compressedClientFrame(t, ws.OpText, []byte{0xff, 0xfe}))}
+	_, _, err := newFrameReader(rw, rw, 1518, true).next()
+	assert.ErrorIs(t, err, wsutil.ErrInvalidUTF8)
+}
+
+func TestCompressedMessage(t *testing.T) {
+	var scratch bytes.Buffer
+	frame := textFrame(1000)
+	hdr, payload := compressedMessage(&scratch, ws.OpBinary, frame)
+	compressed, err := wsflate.IsCompressed(hdr)
+	require.NoError(t, err)
+	assert.True(t, compressed)
+	assert.Equal(t, int64(len(payload)), hdr.Length)
+	decompressed, err := wsflate.DefaultHelper.Decompress(payload)
+	require.NoError(t, err)
+	assert.Equal(t, frame, decompressed)
+
+	// Random-looking data doesn't shrink, and leaves as it is
+	scratch.Reset()
+	noise := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(noise)
+	hdr, payload = compressedMessage(&scratch, ws.OpBinary, noise)
+	compressed, _ = wsflate.IsCompressed(hdr)
+	assert.False(t, compressed)
+	assert.Equal(t, noise, payload)
+	assert.Zero(t, scratch.Len())
+}
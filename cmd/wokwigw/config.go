@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 )
@@ -10,9 +11,14 @@ import (
 const (
 	defaultListenPort     = 9011
 	defaultListenAddr     = "127.0.0.1"
+	defaultGracePeriod    = 5 * time.Second
+	defaultPingInterval   = 30 * time.Second
+	defaultIdleTimeout    = 90 * time.Second
+	defaultResumeWindow   = 30 * time.Second
 	defaultHostAddr       = "10.13.37.254"
 	defaultGatewayAddr    = "10.13.37.1"
 	defaultGatewayMACAddr = "42:13:37:55:aa:01"
+	defaultMTU            = 1500
 
 	/* Forwarding */
 	defaultForwardPort = 9080
@@ -23,15 +29,62 @@ const (
 type flagCfg struct {
 	forwardList []string
 	listenPort  int
+	listen      []string
+	listeners   []listenEndpoint
+	gracePeriod time.Duration
+	logLevel    string
+	logFormat   string
 	captureFile string
 	bridge      bool
+	isolate     bool
+	lan         bool
+	configFile  string
+	gatewayURL  string
+
+	captureMaxSize     string
+	captureMaxDuration time.Duration
+	captureMaxFiles    int
+	captureRotation    captureFileOptions
+	captureRingBuffer  string
+	captureRingSize    int64
+	captureFilter      string
+	captureFilterExpr  *captureFilter
+
+	impair     string
+	impairment *impairment
+
+	scenarioFile string
+	scenario     *scenario
+
+	// 0 until validateAndMapFlags derives it from the MTU
+	maxFrameSize  int
+	coalesce      bool
+	noCompression bool
+
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+	resumeWindow time.Duration
+
+	allowedOrigins []string
+	origins        *originPolicy
+
+	authTokens    []string
+	authTokenFile string
+	auth          *authenticator
+	clientToken   string
+
+	tlsCert        string
+	tlsKey         string
+	tlsSelfSigned  bool
+	tlsDir         string
+	tlsFingerprint string
 }
 
 func defaultConfig() types.Configuration {
 	return types.Configuration{
 		Debug:             false,
 		CaptureFile:       "",
-		MTU:               1500,
+		MTU:               defaultMTU,
 		Subnet:            defaultSubnet,
 		GatewayIP:         defaultGatewayAddr,
 		GatewayMacAddress: defaultGatewayMACAddr,
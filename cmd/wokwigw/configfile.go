@@ -0,0 +1,432 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "WOKWIGW_"
+
+// fileConfig mirrors types.Configuration and our own command line flags. Pointer and nil
+// values mean "not present in the file", so the defaults are kept.
+type fileConfig struct {
+	// Command line flags
+	ListenPort  *int     `yaml:"listenPort" toml:"listenPort"`
+	Listen      []string `yaml:"listen" toml:"listen"`
+	GracePeriod *string  `yaml:"gracePeriod" toml:"gracePeriod"`
+	LogLevel    *string  `yaml:"logLevel" toml:"logLevel"`
+	LogFormat   *string  `yaml:"logFormat" toml:"logFormat"`
+	Forwards    []string `yaml:"forwards" toml:"forwards"`
+	CaptureFile *string  `yaml:"captureFile" toml:"captureFile"`
+	Bridge      *bool    `yaml:"bridge" toml:"bridge"`
+	Isolate     *bool    `yaml:"isolate" toml:"isolate"`
+	LAN         *bool    `yaml:"lan" toml:"lan"`
+
+	CaptureMaxSize     *string `yaml:"captureMaxSize" toml:"captureMaxSize"`
+	CaptureMaxDuration *string `yaml:"captureMaxDuration" toml:"captureMaxDuration"`
+	CaptureMaxFiles    *int    `yaml:"captureMaxFiles" toml:"captureMaxFiles"`
+	CaptureRingBuffer  *string `yaml:"captureRingBuffer" toml:"captureRingBuffer"`
+	CaptureFilter      *string `yaml:"captureFilter" toml:"captureFilter"`
+	Impair             *string `yaml:"impair" toml:"impair"`
+	Scenario           *string `yaml:"scenario" toml:"scenario"`
+	MaxFrameSize       *int    `yaml:"maxFrameSize" toml:"maxFrameSize"`
+	Coalesce           *bool   `yaml:"coalesce" toml:"coalesce"`
+	NoCompression      *bool   `yaml:"noCompression" toml:"noCompression"`
+	PingInterval       *string `yaml:"pingInterval" toml:"pingInterval"`
+	IdleTimeout        *string `yaml:"idleTimeout" toml:"idleTimeout"`
+	ResumeWindow       *string `yaml:"resumeWindow" toml:"resumeWindow"`
+
+	AllowedOrigins []string `yaml:"allowedOrigins" toml:"allowedOrigins"`
+	AuthTokens     []string `yaml:"authTokens" toml:"authTokens"`
+	AuthTokenFile  *string  `yaml:"authTokenFile" toml:"authTokenFile"`
+	TLSCert        *string  `yaml:"tlsCert" toml:"tlsCert"`
+	TLSKey         *string  `yaml:"tlsKey" toml:"tlsKey"`
+	TLSSelfSigned  *bool    `yaml:"tlsSelfSigned" toml:"tlsSelfSigned"`
+	TLSDir         *string  `yaml:"tlsDir" toml:"tlsDir"`
+
+	// Virtual network (types.Configuration)
+	Debug             *bool             `yaml:"debug" toml:"debug"`
+	MTU               *int              `yaml:"mtu" toml:"mtu"`
+	Subnet            *string           `yaml:"subnet" toml:"subnet"`
+	GatewayIP         *string           `yaml:"gatewayIP" toml:"gatewayIP"`
+	GatewayMacAddress *string           `yaml:"gatewayMacAddress" toml:"gatewayMacAddress"`
+	DNS               []fileZone        `yaml:"dns" toml:"dns"`
+	DNSSearchDomains  []string          `yaml:"dnsSearchDomains" toml:"dnsSearchDomains"`
+	NAT               map[string]string `yaml:"nat" toml:"nat"`
+	GatewayVirtualIPs []string          `yaml:"gatewayVirtualIPs" toml:"gatewayVirtualIPs"`
+	DHCPStaticLeases  map[string]string `yaml:"dhcpStaticLeases" toml:"dhcpStaticLeases"`
+}
+
+type fileZone struct {
+	Name      string       `yaml:"name" toml:"name"`
+	DefaultIP string       `yaml:"defaultIP" toml:"defaultIP"`
+	Records   []fileRecord `yaml:"records" toml:"records"`
+}
+
+type fileRecord struct {
+	Name   string `yaml:"name" toml:"name"`
+	IP     string `yaml:"ip" toml:"ip"`
+	Regexp string `yaml:"regexp" toml:"regexp"`
+}
+
+// loadConfigFile reads a YAML or TOML configuration file and merges it into flags and cfg.
+// Flags that were explicitly set (on the command line or through the environment) win over the file.
+func loadConfigFile(path string, fs *pflag.FlagSet, flags *flagCfg, cfg *types.Configuration) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	fc, err := parseConfigFile(path, data)
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	fc.resolvePaths(filepath.Dir(path))
+
+	if err := fc.apply(fs, flags, cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func parseConfigFile(path string, data []byte) (*fileConfig, error) {
+	fc := &fileConfig{}
+	if err := decodeConfigFile(path, data, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// decodeConfigFile decodes a YAML or TOML file into v, depending on the extension of path.
+// Unknown keys are errors.
+func decodeConfigFile(path string, data []byte, v any) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+	case ".toml":
+		md, err := toml.Decode(string(data), v)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+
+	default:
+		return fmt.Errorf("unsupported config file format (%s), use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+
+	return nil
+}
+
+// resolvePaths makes the relative file paths of the config file relative to dir, its directory,
+// so they don't depend on where the gateway is started from.
+func (fc *fileConfig) resolvePaths(dir string) {
+	for _, path := range []*string{fc.Scenario, fc.CaptureFile, fc.AuthTokenFile, fc.TLSCert, fc.TLSKey, fc.TLSDir} {
+		if path != nil && *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+}
+
+func (fc *fileConfig) apply(fs *pflag.FlagSet, flags *flagCfg, cfg *types.Configuration) error {
+	changed := func(name string) bool {
+		return fs != nil && fs.Changed(name)
+	}
+
+	if fc.ListenPort != nil && !changed("listenPort") {
+		flags.listenPort = *fc.ListenPort
+	}
+	if fc.Listen != nil && !changed("listen") {
+		flags.listen = fc.Listen
+	}
+	if fc.GracePeriod != nil && !changed("gracePeriod") {
+		gracePeriod, err := time.ParseDuration(*fc.GracePeriod)
+		if err != nil {
+			return fmt.Errorf("invalid grace period specified (%s): %w", *fc.GracePeriod, err)
+		}
+		flags.gracePeriod = gracePeriod
+	}
+	if fc.LogLevel != nil && !changed("log-level") {
+		flags.logLevel = *fc.LogLevel
+	}
+	if fc.LogFormat != nil && !changed("log-format") {
+		flags.logFormat = *fc.LogFormat
+	}
+	if fc.CaptureFile != nil && !changed("captureFile") {
+		flags.captureFile = *fc.CaptureFile
+	}
+	if fc.CaptureMaxSize != nil && !changed("captureMaxSize") {
+		flags.captureMaxSize = *fc.CaptureMaxSize
+	}
+	if fc.CaptureMaxDuration != nil && !changed("captureMaxDuration") {
+		maxDuration, err := time.ParseDuration(*fc.CaptureMaxDuration)
+		if err != nil {
+			return fmt.Errorf("invalid capture max duration specified (%s): %w", *fc.CaptureMaxDuration, err)
+		}
+		flags.captureMaxDuration = maxDuration
+	}
+	if fc.CaptureMaxFiles != nil && !changed("captureMaxFiles") {
+		flags.captureMaxFiles = *fc.CaptureMaxFiles
+	}
+	if fc.CaptureRingBuffer != nil && !changed("captureRingBuffer") {
+		flags.captureRingBuffer = *fc.CaptureRingBuffer
+	}
+	if fc.CaptureFilter != nil && !changed("captureFilter") {
+		flags.captureFilter = *fc.CaptureFilter
+	}
+	if fc.Impair != nil && !changed("impair") {
+		flags.impair = *fc.Impair
+	}
+	if fc.Scenario != nil && !changed("scenario") {
+		flags.scenarioFile = *fc.Scenario
+	}
+	if fc.MaxFrameSize != nil && !changed("maxFrameSize") {
+		flags.maxFrameSize = *fc.MaxFrameSize
+	}
+	if fc.Coalesce != nil && !changed("coalesce") {
+		flags.coalesce = *fc.Coalesce
+	}
+	if fc.NoCompression != nil && !changed("noCompression") {
+		flags.noCompression = *fc.NoCompression
+	}
+	if fc.PingInterval != nil && !changed("pingInterval") {
+		pingInterval, err := time.ParseDuration(*fc.PingInterval)
+		if err != nil {
+			return fmt.Errorf("invalid ping interval specified (%s): %w", *fc.PingInterval, err)
+		}
+		flags.pingInterval = pingInterval
+	}
+	if fc.IdleTimeout != nil && !changed("idleTimeout") {
+		idleTimeout, err := time.ParseDuration(*fc.IdleTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid idle timeout specified (%s): %w", *fc.IdleTimeout, err)
+		}
+		flags.idleTimeout = idleTimeout
+	}
+	if fc.ResumeWindow != nil && !changed("resumeWindow") {
+		resumeWindow, err := time.ParseDuration(*fc.ResumeWindow)
+		if err != nil {
+			return fmt.Errorf("invalid resume window specified (%s): %w", *fc.ResumeWindow, err)
+		}
+		flags.resumeWindow = resumeWindow
+	}
+	if fc.Bridge != nil && !changed("bridge") {
+		flags.bridge = *fc.Bridge
+	}
+	if fc.Isolate != nil && !changed("isolate") {
+		flags.isolate = *fc.Isolate
+	}
+	if fc.LAN != nil && !changed("lan") {
+		flags.lan = *fc.LAN
+	}
+	if fc.AllowedOrigins != nil && !changed("allowOrigin") {
+		flags.allowedOrigins = fc.AllowedOrigins
+	}
+	if fc.AuthTokens != nil && !changed("authToken") {
+		flags.authTokens = fc.AuthTokens
+	}
+	if fc.AuthTokenFile != nil && !changed("authTokenFile") {
+		flags.authTokenFile = *fc.AuthTokenFile
+	}
+	if fc.TLSCert != nil && !changed("tls-cert") {
+		flags.tlsCert = *fc.TLSCert
+	}
+	if fc.TLSKey != nil && !changed("tls-key") {
+		flags.tlsKey = *fc.TLSKey
+	}
+	if fc.TLSSelfSigned != nil && !changed("tls-self-signed") {
+		flags.tlsSelfSigned = *fc.TLSSelfSigned
+	}
+	if fc.TLSDir != nil && !changed("tls-dir") {
+		flags.tlsDir = *fc.TLSDir
+	}
+	if fc.Forwards != nil {
+		// Forwards from the file replace the built-in default forward; --forward flags are added on top
+		cfg.Forwards = map[string]string{}
+		flags.forwardList = append(append([]string{}, fc.Forwards...), flags.forwardList...)
+	}
+
+	if fc.Debug != nil {
+		cfg.Debug = *fc.Debug
+	}
+	if fc.MTU != nil {
+		cfg.MTU = *fc.MTU
+	}
+	if fc.Subnet != nil {
+		cfg.Subnet = *fc.Subnet
+	}
+	if fc.GatewayIP != nil {
+		cfg.GatewayIP = *fc.GatewayIP
+	}
+	if fc.GatewayMacAddress != nil {
+		cfg.GatewayMacAddress = *fc.GatewayMacAddress
+	}
+	if fc.DNSSearchDomains != nil {
+		cfg.DNSSearchDomains = fc.DNSSearchDomains
+	}
+	if fc.NAT != nil {
+		cfg.NAT = fc.NAT
+	}
+	if fc.GatewayVirtualIPs != nil {
+		cfg.GatewayVirtualIPs = fc.GatewayVirtualIPs
+	}
+	if fc.DHCPStaticLeases != nil {
+		cfg.DHCPStaticLeases = fc.DHCPStaticLeases
+	}
+	if fc.DNS != nil {
+		zones, err := fc.zones()
+		if err != nil {
+			return err
+		}
+		cfg.DNS = zones
+	}
+
+	return validateNetworkConfig(cfg)
+}
+
+func (fc *fileConfig) zones() ([]types.Zone, error) {
+	zones := []types.Zone{}
+	for _, z := range fc.DNS {
+		zone := types.Zone{Name: z.Name}
+		if z.Name == "" {
+			return nil, fmt.Errorf("dns zone without a name")
+		}
+		if z.DefaultIP != "" {
+			if zone.DefaultIP = net.ParseIP(z.DefaultIP); zone.DefaultIP == nil {
+				return nil, fmt.Errorf("invalid default IP specified for dns zone %s (%s)", z.Name, z.DefaultIP)
+			}
+		}
+		for _, r := range z.Records {
+			record := types.Record{Name: r.Name}
+			if record.IP = net.ParseIP(r.IP); record.IP == nil {
+				return nil, fmt.Errorf("invalid IP specified for dns record %s.%s (%s)", r.Name, z.Name, r.IP)
+			}
+			if r.Regexp != "" {
+				re, err := regexp.Compile(r.Regexp)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regexp specified for dns record %s.%s: %w", r.Name, z.Name, err)
+				}
+				record.Regexp = re
+			}
+			zone.Records = append(zone.Records, record)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// validateNetworkConfig checks the virtual network settings before they reach gvisor-tap-vsock,
+// which would otherwise fail (or silently misbehave) much later.
+func validateNetworkConfig(cfg *types.Configuration) error {
+	if cfg.MTU < 576 || cfg.MTU > 65535 {
+		return fmt.Errorf("invalid mtu specified (%d), must be between 576 and 65535", cfg.MTU)
+	}
+
+	_, subnet, err := net.ParseCIDR(cfg.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet specified (%s): %w", cfg.Subnet, err)
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("invalid subnet specified (%s): only IPv4 subnets are supported", cfg.Subnet)
+	}
+
+	inSubnet := func(what string, addr string) error {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid %s specified (%s)", what, addr)
+		}
+		if !subnet.Contains(ip) {
+			return fmt.Errorf("invalid %s specified (%s): not in subnet %s", what, addr, cfg.Subnet)
+		}
+		return nil
+	}
+
+	if err := inSubnet("gateway IP", cfg.GatewayIP); err != nil {
+		return err
+	}
+	if _, err := net.ParseMAC(cfg.GatewayMacAddress); err != nil {
+		return fmt.Errorf("invalid gateway MAC address specified (%s): %w", cfg.GatewayMacAddress, err)
+	}
+	for ip, mac := range cfg.DHCPStaticLeases {
+		if err := inSubnet("static lease IP", ip); err != nil {
+			return err
+		}
+		if _, err := net.ParseMAC(mac); err != nil {
+			return fmt.Errorf("invalid static lease MAC address specified for %s (%s): %w", ip, mac, err)
+		}
+	}
+	for _, ip := range cfg.GatewayVirtualIPs {
+		if err := inSubnet("gateway virtual IP", ip); err != nil {
+			return err
+		}
+	}
+	for src, dst := range cfg.NAT {
+		if net.ParseIP(src).To4() == nil {
+			return fmt.Errorf("invalid NAT source specified (%s)", src)
+		}
+		if net.ParseIP(dst).To4() == nil {
+			return fmt.Errorf("invalid NAT destination specified for %s (%s)", src, dst)
+		}
+	}
+
+	return nil
+}
+
+// applyEnvironment sets every flag that wasn't given on the command line from its matching
+// environment variable, e.g. --listenPort from WOKWIGW_LISTEN_PORT.
+func applyEnvironment(fs *pflag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid value specified in environment variable %s (%s): %w", name, value, e)
+			}
+		}
+	})
+	return err
+}
+
+func envName(flag string) string {
+	var sb strings.Builder
+	sb.WriteString(envPrefix)
+	for i, r := range flag {
+		switch {
+		case r == '-':
+			sb.WriteRune('_')
+		case unicode.IsUpper(r) && i > 0:
+			sb.WriteRune('_')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testYAMLConfig = `
+listenPort: 9100
+gracePeriod: 10s
+forwards:
+  - 8080:10.20.0.2:80
+  - udp:8888:10.20.0.2:1234
+mtu: 1400
+subnet: 10.20.0.0/24
+gatewayIP: 10.20.0.1
+gatewayMacAddress: 42:13:37:55:aa:02
+dhcpStaticLeases:
+  10.20.0.2: 24:0a:c4:00:01:10
+nat:
+  10.20.0.254: 127.0.0.1
+gatewayVirtualIPs: [10.20.0.254]
+dns:
+  - name: example.internal.
+    records:
+      - name: host
+        ip: 10.20.0.254
+`
+
+const testTOMLConfig = `
+listenPort = 9100
+gracePeriod = "10s"
+forwards = ["8080:10.20.0.2:80", "udp:8888:10.20.0.2:1234"]
+mtu = 1400
+subnet = "10.20.0.0/24"
+gatewayIP = "10.20.0.1"
+gatewayMacAddress = "42:13:37:55:aa:02"
+gatewayVirtualIPs = ["10.20.0.254"]
+
+[dhcpStaticLeases]
+"10.20.0.2" = "24:0a:c4:00:01:10"
+
+[nat]
+"10.20.0.254" = "127.0.0.1"
+
+[[dns]]
+name = "example.internal."
+
+[[dns.records]]
+name = "host"
+ip = "10.20.0.254"
+`
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	tcs := map[string]struct {
+		name    string
+		content string
+	}{
+		"yaml": {"wokwigw.yaml", testYAMLConfig},
+		"toml": {"wokwigw.toml", testTOMLConfig},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigFile(t, tc.name, tc.content)
+
+			f := flagCfg{listenPort: defaultListenPort}
+			cfg := defaultConfig()
+			cmd := newRootCmd(&f, &cfg)
+			cmd.SetArgs([]string{"--config", path, "--forward", "9000:10.20.0.3:22"})
+			cmd.RunE = func(_ *cobra.Command, _ []string) error { return nil }
+
+			assert.NoError(t, cmd.Execute())
+			assert.Equal(t, 9100, f.listenPort)
+			assert.Equal(t, 10*time.Second, f.gracePeriod)
+			assert.Equal(t, 1400, cfg.MTU)
+			assert.Equal(t, "10.20.0.0/24", cfg.Subnet)
+			assert.Equal(t, "10.20.0.1", cfg.GatewayIP)
+			assert.Equal(t, map[string]string{
+				":8080":     "10.20.0.2:80",
+				"udp::8888": "10.20.0.2:1234",
+				":9000":     "10.20.0.3:22",
+			}, cfg.Forwards)
+			assert.Equal(t, map[string]string{"10.20.0.254": "127.0.0.1"}, cfg.NAT)
+			if assert.Len(t, cfg.DNS, 1) && assert.Len(t, cfg.DNS[0].Records, 1) {
+				assert.Equal(t, "10.20.0.254", cfg.DNS[0].Records[0].IP.String())
+			}
+		})
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	path := writeConfigFile(t, "wokwigw.yaml", "listenPort: 9100\ncaptureFile: file.pcap\n")
+
+	t.Setenv("WOKWIGW_CAPTURE_FILE", "env.pcap")
+
+	f := flagCfg{listenPort: defaultListenPort}
+	cfg := defaultConfig()
+	cmd := newRootCmd(&f, &cfg)
+	cmd.SetArgs([]string{"--config", path, "--listenPort", "9200"})
+	cmd.RunE = func(_ *cobra.Command, _ []string) error { return nil }
+
+	assert.NoError(t, cmd.Execute())
+	assert.Equal(t, 9200, f.listenPort)
+	assert.Equal(t, "env.pcap", cfg.CaptureFile)
+}
+
+func TestConfigFileRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "scenario.yaml"), []byte(testYAMLScenario), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tokens"), []byte("ci:s3cr3t\n"), 0o600))
+	path := filepath.Join(dir, "wokwigw.yaml")
+	content := "scenario: scenario.yaml\nauthTokenFile: tokens\ntlsCert: certs/cert.pem\ntlsKey: /etc/wokwigw/key.pem\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	// The paths are relative to the directory of the file, not to the working directory
+	f := flagCfg{listenPort: defaultListenPort}
+	cfg := defaultConfig()
+	cmd := newRootCmd(&f, &cfg)
+	cmd.SetArgs([]string{"--config", path})
+	cmd.RunE = func(_ *cobra.Command, _ []string) error { return nil }
+
+	require.NoError(t, cmd.Execute())
+	assert.Equal(t, filepath.Join(dir, "scenario.yaml"), f.scenarioFile)
+	assert.NotNil(t, f.scenario)
+	assert.Equal(t, filepath.Join(dir, "tokens"), f.authTokenFile)
+	assert.Equal(t, filepath.Join(dir, "certs", "cert.pem"), f.tlsCert)
+	assert.Equal(t, "/etc/wokwigw/key.pem", f.tlsKey)
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tcs := map[string]struct {
+		name      string
+		content   string
+		errStrPfx string
+	}{
+		"unknown yaml key":         {"c.yaml", "listenAddr: 0.0.0.0\n", "field listenAddr not found"},
+		"unknown toml key":         {"c.toml", "listenAddr = \"0.0.0.0\"\n", "unknown key \"listenAddr\""},
+		"unsupported format":       {"c.json", "{}", "unsupported config file format"},
+		"invalid subnet":           {"c.yaml", "subnet: 10.20.0.0\n", "invalid subnet specified"},
+		"gateway outside subnet":   {"c.yaml", "gatewayIP: 10.20.0.1\n", "invalid gateway IP specified (10.20.0.1): not in subnet"},
+		"invalid gateway mac":      {"c.yaml", "gatewayMacAddress: nope\n", "invalid gateway MAC address specified"},
+		"invalid static lease":     {"c.yaml", "dhcpStaticLeases: {10.13.37.2: nope}\n", "invalid static lease MAC address specified"},
+		"invalid mtu":              {"c.yaml", "mtu: 100\n", "invalid mtu specified"},
+		"invalid dns record":       {"c.yaml", "dns: [{name: x., records: [{name: a, ip: nope}]}]\n", "invalid IP specified for dns record a.x."},
+		"invalid forward":          {"c.yaml", "forwards: [99999:host:80]\n", "invalid local port specified in forward argument"},
+		"bridge with forwards":     {"c.yaml", "bridge: true\nforwards: [8080:host:80]\n", "bridge mode does not support port forwarding"},
+		"invalid listen port":      {"c.toml", "listenPort = 99999\n", "invalid listen port specified"},
+		"invalid grace period":     {"c.yaml", "gracePeriod: soon\n", "invalid grace period specified"},
+		"invalid capture size":     {"c.yaml", "captureFile: c.pcapng\ncaptureMaxSize: huge\n", "invalid capture max size"},
+		"invalid capture duration": {"c.yaml", "captureFile: c.pcapng\ncaptureMaxDuration: long\n", "invalid capture max duration specified"},
+		"rotation without file":    {"c.toml", "captureMaxFiles = 3\n", "require --captureFile"},
+		"invalid capture filter":   {"c.yaml", "captureFilter: tcp port\n", "invalid capture filter specified"},
+		"invalid ring buffer":      {"c.toml", "captureRingBuffer = \"-1MB\"\n", "invalid capture ring buffer size"},
+		"missing scenario":         {"c.yaml", "scenario: missing.yaml\n", "error reading scenario file"},
+		"max frame size below mtu": {"c.yaml", "mtu: 9000\nmaxFrameSize: 1518\n", "invalid max frame size specified"},
+		"invalid nat destination":  {"c.toml", "[nat]\n\"10.13.37.254\" = \"localhost\"\n", "invalid NAT destination specified"},
+		"invalid ping interval":    {"c.yaml", "pingInterval: often\n", "invalid ping interval specified"},
+		"idle timeout too short":   {"c.toml", "pingInterval = \"30s\"\nidleTimeout = \"10s\"\n", "must be longer than the ping interval"},
+		"negative resume window":   {"c.yaml", "resumeWindow: -1s\n", "invalid resume window specified"},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigFile(t, tc.name, tc.content)
+
+			f := flagCfg{listenPort: defaultListenPort}
+			cfg := defaultConfig()
+			cmd := newRootCmd(&f, &cfg)
+			cmd.SetOut(&bytes.Buffer{})
+			cmd.SetErr(&bytes.Buffer{})
+			cmd.SetArgs([]string{"--config", path})
+			cmd.RunE = func(_ *cobra.Command, _ []string) error { return nil }
+
+			err := cmd.Execute()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.errStrPfx)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "WOKWIGW_LISTEN_PORT", envName("listenPort"))
+	assert.Equal(t, "WOKWIGW_FORWARD", envName("forward"))
+	assert.Equal(t, "WOKWIGW_TLS_CERT", envName("tls-cert"))
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How long browsers may cache a preflight response, in seconds
+const corsMaxAge = "600"
+
+// webPageAccessible returns whether web pages may access path: the WebSocket and the health
+// checks are, while the API, the status, the metrics and the live capture are not (see apiOnly).
+func webPageAccessible(path string) bool {
+	return !strings.HasPrefix(path, "/api/") && path != "/status" && path != "/metrics" && path != "/capture"
+}
+
+// withCORS answers the CORS preflight requests of allowed origins, including the Private Network
+// Access preflight that browsers send before a public web page (e.g. https://wokwi.com) reaches
+// the gateway on localhost or on the local network.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if webPageAccessible(r.URL.Path) && checkOrigin(flags.origins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Private-Network")
+		log := logrus.WithFields(logrus.Fields{"remoteAddr": remoteAddr(r), "origin": origin, "path": r.URL.Path})
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !webPageAccessible(r.URL.Path) || method != http.MethodGet || !checkOrigin(flags.origins, origin) {
+			log.WithField("method", method).Warn("preflight request rejected")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", http.MethodGet)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		if r.Header.Get("Access-Control-Request-Private-Network") == "true" {
+			w.Header().Set("Access-Control-Allow-Private-Network", "true")
+		}
+		log.Debug("preflight request allowed")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
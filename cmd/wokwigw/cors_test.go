@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func preflight(t *testing.T, url string, origin string, method string) *http.Response {
+	req, err := http.NewRequest(http.MethodOptions, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	req.Header.Set("Access-Control-Request-Private-Network", "true")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestPrivateNetworkAccessPreflight(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, nullBackend{})
+
+	// https://wokwi.com connecting to ws://127.0.0.1:9011: the browser sends a preflight first...
+	resp := preflight(t, server.URL+"/", "https://wokwi.com", http.MethodGet)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://wokwi.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Private-Network"))
+	assert.Equal(t, "GET", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.NotEmpty(t, resp.Header.Get("Access-Control-Max-Age"))
+	assert.Contains(t, resp.Header.Values("Vary"), "Origin")
+
+	// ...and then opens the WebSocket
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://wokwi.com"}})}
+	conn := dialTestWebSocket(t, dialer, "ws"+strings.TrimPrefix(server.URL, "http")+"/")
+	msg, _, err := wsutil.ReadServerData(conn)
+	require.NoError(t, err)
+	var aloha alohaMessage
+	require.NoError(t, json.Unmarshal(msg, &aloha))
+	assert.Equal(t, "aloha", aloha.Type)
+}
+
+func TestPreflightRejected(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, nullBackend{})
+
+	tcs := map[string]struct {
+		path   string
+		origin string
+		method string
+	}{
+		"unknown origin":       {"/", "https://evil.example", http.MethodGet},
+		"http wokwi.com":       {"/", "http://wokwi.com", http.MethodGet},
+		"api":                  {"/api/forwards", "https://wokwi.com", http.MethodGet},
+		"status":               {"/status", "https://wokwi.com", http.MethodGet},
+		"metrics":              {"/metrics", "https://wokwi.com", http.MethodGet},
+		"method not allowed":   {"/", "https://wokwi.com", http.MethodDelete},
+		"api method not found": {"/api/forwards", "https://wokwi.com", http.MethodPost},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			resp := preflight(t, server.URL+tc.path, tc.origin, tc.method)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+			assert.Empty(t, resp.Header.Get("Access-Control-Allow-Private-Network"))
+		})
+	}
+}
+
+func TestCORSHealthCheck(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, nullBackend{})
+
+	get := func(path string, origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// A web page can check that the gateway is running
+	resp := get("/healthz", "https://wokwi.com")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://wokwi.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = get("/healthz", "https://evil.example")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// ...but can't read the status
+	resp = get("/status", "https://wokwi.com")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,320 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The actions of the scenario steps
+const (
+	faultDrop        = "drop"         // drop the frames, optionally of one direction or matching a filter
+	faultDNSServfail = "dns-servfail" // answer the DNS queries of the simulator with SERVFAIL
+	faultTCPReset    = "tcp-reset"    // reset the TCP connections, optionally of one port
+	faultImpair      = "impair"       // change the network impairment (see impairment.go)
+	faultDisconnect  = "disconnect"   // close the WebSocket connection
+
+	// The drop steps apply to directionIn, directionOut or both
+	faultDirectionBoth = "both"
+)
+
+var errNetworkInjectionNotSupported = errors.New("the backend doesn't support sending frames to the network")
+
+// activeFault is a step that lasts for a while: drop, dns-servfail or impair
+type activeFault struct {
+	Step    *scenarioStep `json:"step"`
+	Session string        `json:"session,omitempty"` // empty for all the sessions
+	Started time.Time     `json:"started"`
+	Until   time.Time     `json:"until"`
+
+	timer    *time.Timer
+	previous *impairment // restored when an impair step ends
+}
+
+// faultSet holds the faults in progress of a session, or of all the sessions (gatewayFaults)
+type faultSet struct {
+	lock   sync.Mutex
+	faults []*activeFault
+	count  atomic.Int32 // checked for every frame, so the frames skip the lock when there are no faults
+}
+
+// gatewayFaults holds the faults of the steps that apply to all the sessions, including the
+// sessions that connect while they last
+var gatewayFaults faultSet
+
+// start starts a step on s, or on all the sessions when s is nil, and ends it after its duration
+func (f *faultSet) start(step *scenarioStep, s *session) *activeFault {
+	now := time.Now()
+	fault := &activeFault{Step: step, Started: now, Until: now.Add(step.duration)}
+	if s != nil {
+		fault.Session = s.ID
+	}
+	if step.Action == faultImpair {
+		fault.previous = s.currentImpairment()
+		s.setImpairment(step.impairment)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faults = append(f.faults, fault)
+	f.count.Add(1)
+	fault.timer = time.AfterFunc(step.duration, func() {
+		if !f.remove(fault) {
+			return
+		}
+		if step.Action == faultImpair {
+			s.setImpairment(fault.previous)
+		}
+		stepEnded(step, s)
+	})
+	return fault
+}
+
+func (f *faultSet) remove(fault *activeFault) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, other := range f.faults {
+		if other == fault {
+			f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			f.count.Add(-1)
+			return true
+		}
+	}
+	return false
+}
+
+// clear ends the faults right away, without logging, e.g. when the session ends
+func (f *faultSet) clear() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, fault := range f.faults {
+		fault.timer.Stop()
+	}
+	f.faults = nil
+	f.count.Store(0)
+}
+
+func (f *faultSet) list() []*activeFault {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*activeFault(nil), f.faults...)
+}
+
+// dropped returns true when a drop step in progress applies to the frame. Direction in is from
+// the simulator.
+func (f *faultSet) dropped(direction string, frame []byte) bool {
+	if f.count.Load() == 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, fault := range f.faults {
+		step := fault.Step
+		if step.Action == faultDrop && (step.Direction == "" || step.Direction == faultDirectionBoth || step.Direction == direction) && step.filter.matches(frame) {
+			return true
+		}
+	}
+	return false
+}
+
+// has returns true when a step with the given action is in progress
+func (f *faultSet) has(action string) bool {
+	if f.count.Load() == 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, fault := range f.faults {
+		if fault.Step.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// servfail returns true when a dns-servfail step in progress applies to the query
+func (f *faultSet) servfail(query *layers.DNS) bool {
+	if f.count.Load() == 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, fault := range f.faults {
+		if fault.Step.Action == faultDNSServfail && fault.Step.matchesQuery(query) {
+			return true
+		}
+	}
+	return false
+}
+
+// faultFromSimulator applies the faults to a frame from the simulator, and returns true when the
+// frame doesn't reach the network
+func (s *session) faultFromSimulator(frame []byte) bool {
+	s.tcpConns.track(directionIn, frame)
+	if s.faults.count.Load() == 0 && gatewayFaults.count.Load() == 0 {
+		return false
+	}
+	if s.faults.dropped(directionIn, frame) || gatewayFaults.dropped(directionIn, frame) {
+		return true
+	}
+	if !s.faults.has(faultDNSServfail) && !gatewayFaults.has(faultDNSServfail) {
+		return false
+	}
+	if query, reply := dnsServfailReply(frame); query != nil && (s.faults.servfail(query) || gatewayFaults.servfail(query)) {
+		if reply != nil {
+			_ = s.writeMessage(ws.OpBinary, reply)
+		}
+		return true
+	}
+	return false
+}
+
+// faultToSimulator applies the faults to a frame for the simulator, and returns true when the
+// frame is dropped
+func (s *session) faultToSimulator(frame []byte) bool {
+	if s.faults.dropped(directionOut, frame) || gatewayFaults.dropped(directionOut, frame) {
+		return true
+	}
+	s.tcpConns.track(directionOut, frame)
+	return false
+}
+
+// setNetworkWriter sets the function that sends frames to the network as if they came from the
+// simulator. The backends set it while they handle the session.
+func (s *session) setNetworkWriter(w func(frame []byte) error) {
+	if w == nil {
+		s.networkWriter.Store(nil)
+		return
+	}
+	s.networkWriter.Store(&w)
+}
+
+func (s *session) writeToNetwork(frame []byte) error {
+	w := s.networkWriter.Load()
+	if w == nil {
+		return errNetworkInjectionNotSupported
+	}
+	return (*w)(frame)
+}
+
+// resetTCP resets the TCP connections of the session to or from the given port (any port when 0),
+// on both ends, and returns how many were reset
+func (s *session) resetTCP(port int) int {
+	resets := s.tcpConns.reset(port)
+	for _, reset := range resets {
+		if err := s.writeMessage(ws.OpBinary, reset.toSimulator); err != nil {
+			s.log().WithError(err).Warn("error sending TCP reset to the simulator")
+		}
+		if err := s.writeToNetwork(reset.toNetwork); err != nil {
+			s.log().WithError(err).Warn("error sending TCP reset to the network")
+		}
+	}
+	return len(resets)
+}
+
+// dnsServfailReply decodes a DNS query from the simulator, and returns it with a SERVFAIL reply.
+// The query is nil when the frame isn't a DNS query.
+func dnsServfailReply(frame []byte) (*layers.DNS, []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if udp == nil || udp.DstPort != 53 {
+		return nil, nil
+	}
+	query, _ := packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if query == nil || query.QR {
+		return nil, nil
+	}
+
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	reply := []gopacket.SerializableLayer{&layers.Ethernet{SrcMAC: eth.DstMAC, DstMAC: eth.SrcMAC, EthernetType: eth.EthernetType}}
+	replyUDP := &layers.UDP{SrcPort: udp.DstPort, DstPort: udp.SrcPort}
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		replyIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: ip.DstIP, DstIP: ip.SrcIP}
+		_ = replyUDP.SetNetworkLayerForChecksum(replyIP)
+		reply = append(reply, replyIP)
+	case *layers.IPv6:
+		replyIP := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: ip.DstIP, DstIP: ip.SrcIP}
+		_ = replyUDP.SetNetworkLayerForChecksum(replyIP)
+		reply = append(reply, replyIP)
+	default:
+		return query, nil
+	}
+	reply = append(reply, replyUDP, &layers.DNS{
+		ID:           query.ID,
+		QR:           true,
+		OpCode:       query.OpCode,
+		RD:           query.RD,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeServFail,
+		Questions:    query.Questions,
+	})
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, reply...); err != nil {
+		return query, nil
+	}
+	return query, buf.Bytes()
+}
+
+// matchesQuery returns true when a dns-servfail step applies to a query: all the queries, or the
+// queries for the step domain and its subdomains
+func (st *scenarioStep) matchesQuery(query *layers.DNS) bool {
+	if st.Domain == "" {
+		return true
+	}
+	domain := strings.ToLower(strings.TrimSuffix(st.Domain, "."))
+	for _, question := range query.Questions {
+		name := strings.ToLower(strings.TrimSuffix(string(question.Name), "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe explains what a step does, for the logs and the capture comments
+func (st *scenarioStep) describe() string {
+	var text string
+	switch st.Action {
+	case faultDrop:
+		text = "drop all frames"
+		switch st.Direction {
+		case directionIn:
+			text = "drop the frames from the simulator"
+		case directionOut:
+			text = "drop the frames to the simulator"
+		}
+		if st.Filter != "" {
+			text += fmt.Sprintf(" matching %q", st.Filter)
+		}
+	case faultDNSServfail:
+		text = "fail the DNS queries"
+		if st.Domain != "" {
+			text += " for " + st.Domain
+		}
+	case faultTCPReset:
+		text = "reset the TCP connections"
+		if st.Port != 0 {
+			text += fmt.Sprintf(" of port %d", st.Port)
+		}
+	case faultImpair:
+		text = "impair the network: " + st.Impair
+	case faultDisconnect:
+		text = "disconnect the simulator"
+	}
+	if st.Duration != "" {
+		text += " for " + st.Duration
+	}
+	return text
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serverSegment is a TCP segment between the simulator (port 50000) and a server port
+func serverSegment(t *testing.T, fromSim bool, port layers.TCPPort, tcp layers.TCP) []byte {
+	tcp.SrcPort, tcp.DstPort = port, 50000
+	return tcpSegmentFrame(t, fromSim, net.IP{93, 184, 216, 34}, tcp)
+}
+
+// useTCPTracking turns the tracking of the TCP connections on for the test
+func useTCPTracking(t *testing.T) {
+	saved := tcpTracking.Load()
+	t.Cleanup(func() { tcpTracking.Store(saved) })
+	tcpTracking.Store(true)
+}
+
+// handshake opens a TCP connection from the simulator through the tracker
+func handshake(t *testing.T, tracker *tcpTracker, port layers.TCPPort) {
+	tracker.track(directionIn, serverSegment(t, true, port, layers.TCP{SYN: true, Seq: 1000}))
+	tracker.track(directionOut, serverSegment(t, false, port, layers.TCP{SYN: true, ACK: true, Seq: 5000, Ack: 1001}))
+	tracker.track(directionIn, serverSegment(t, true, port, layers.TCP{ACK: true, Seq: 1001, Ack: 5001}))
+}
+
+func TestTCPTracker(t *testing.T) {
+	var tracker tcpTracker
+	useTCPTracking(t)
+	// Without a scenario, the connections aren't tracked
+	tcpTracking.Store(false)
+	handshake(t, &tracker, 8883)
+	assert.Equal(t, 0, tracker.count())
+
+	tcpTracking.Store(true)
+	handshake(t, &tracker, 8883)
+	handshake(t, &tracker, 443)
+	// Data from the remote end, acknowledged by the simulator
+	tracker.track(directionOut, serverSegment(t, false, 8883, layers.TCP{ACK: true, PSH: true, Seq: 5001, Ack: 1001, BaseLayer: layers.BaseLayer{Payload: []byte("hi")}}))
+	tracker.track(directionIn, serverSegment(t, true, 8883, layers.TCP{ACK: true, Seq: 1001, Ack: 5003}))
+	// Connections that were open before are not tracked
+	tracker.track(directionIn, serverSegment(t, true, 1883, layers.TCP{ACK: true, Seq: 1, Ack: 1}))
+	assert.Equal(t, 2, tracker.count())
+
+	assert.Empty(t, tracker.reset(1883))
+	resets := tracker.reset(8883)
+	require.Len(t, resets, 1)
+	assert.Equal(t, 1, tracker.count())
+
+	toSim := gopacket.NewPacket(resets[0].toSimulator, layers.LayerTypeEthernet, gopacket.Default)
+	require.Nil(t, toSim.ErrorLayer())
+	assert.Equal(t, testSimMAC, toSim.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC)
+	assert.Equal(t, net.IP{10, 13, 37, 2}.To4(), toSim.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP)
+	tcp := toSim.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	assert.True(t, tcp.RST)
+	assert.Equal(t, layers.TCPPort(8883), tcp.SrcPort)
+	assert.Equal(t, layers.TCPPort(50000), tcp.DstPort)
+	assert.Equal(t, uint32(5003), tcp.Seq, "the next sequence number the simulator expects")
+
+	toNet := gopacket.NewPacket(resets[0].toNetwork, layers.LayerTypeEthernet, gopacket.Default)
+	require.Nil(t, toNet.ErrorLayer())
+	assert.Equal(t, testGatewayMAC, toNet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC)
+	tcp = toNet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	assert.True(t, tcp.RST)
+	assert.Equal(t, layers.TCPPort(8883), tcp.DstPort)
+	assert.Equal(t, uint32(1001), tcp.Seq, "the next sequence number the remote end expects")
+
+	// Closed connections are forgotten
+	tracker.track(directionIn, serverSegment(t, true, 443, layers.TCP{FIN: true, ACK: true, Seq: 1001, Ack: 5001}))
+	tracker.track(directionOut, serverSegment(t, false, 443, layers.TCP{FIN: true, ACK: true, Seq: 5001, Ack: 1002}))
+	assert.Equal(t, 0, tracker.count())
+
+	// Connections that are not established can't be reset
+	tracker.track(directionIn, serverSegment(t, true, 443, layers.TCP{SYN: true, Seq: 1000}))
+	assert.Empty(t, tracker.reset(0))
+}
+
+func TestSessionResetTCP(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	s := &session{ID: "reset", conn: server}
+	useTCPTracking(t)
+	var toNetwork [][]byte
+	s.setNetworkWriter(func(frame []byte) error {
+		toNetwork = append(toNetwork, frame)
+		return nil
+	})
+	handshake(t, &s.tcpConns, 8883)
+
+	received := make(chan []byte, 1)
+	go func() {
+		frame, _, _ := wsutil.ReadServerData(client)
+		received <- frame
+	}()
+	assert.Equal(t, 1, s.resetTCP(0))
+	require.Len(t, toNetwork, 1)
+	packet := gopacket.NewPacket(<-received, layers.LayerTypeEthernet, gopacket.Default)
+	assert.True(t, packet.Layer(layers.LayerTypeTCP).(*layers.TCP).RST)
+	assert.Equal(t, 0, s.resetTCP(0))
+}
+
+func TestDNSServfailReply(t *testing.T) {
+	query, reply := dnsServfailReply(udpFrame(t, net.IP{10, 13, 37, 1}, 53))
+	require.NotNil(t, query)
+	require.NotNil(t, reply)
+
+	packet := gopacket.NewPacket(reply, layers.LayerTypeEthernet, gopacket.Default)
+	require.Nil(t, packet.ErrorLayer())
+	assert.Equal(t, testSimMAC, packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC)
+	assert.Equal(t, net.IP{10, 13, 37, 2}.To4(), packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP)
+	assert.Equal(t, layers.UDPPort(50000), packet.Layer(layers.LayerTypeUDP).(*layers.UDP).DstPort)
+	dns := packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	assert.True(t, dns.QR)
+	assert.Equal(t, query.ID, dns.ID)
+	assert.Equal(t, layers.DNSResponseCodeServFail, dns.ResponseCode)
+	assert.Equal(t, "query", string(dns.Questions[0].Name))
+
+	query, _ = dnsServfailReply(udpFrame(t, net.IP{10, 13, 37, 1}, 5353))
+	assert.Nil(t, query)
+	query, _ = dnsServfailReply(tcpFrame(t, true, false, 53))
+	assert.Nil(t, query)
+}
+
+func TestDNSServfailDomain(t *testing.T) {
+	step := &scenarioStep{Action: faultDNSServfail, Duration: "1s", Domain: "example.com."}
+	require.NoError(t, step.parse(false))
+	assert.True(t, step.matchesQuery(dnsQuery("example.com")))
+	assert.True(t, step.matchesQuery(dnsQuery("mqtt.EXAMPLE.com.")))
+	assert.False(t, step.matchesQuery(dnsQuery("notexample.com")))
+	assert.False(t, step.matchesQuery(dnsQuery("example.org")))
+}
+
+func TestFaultSetDrop(t *testing.T) {
+	var faults faultSet
+	step := &scenarioStep{Action: faultDrop, Duration: "50ms", Direction: directionIn, Filter: "udp port 53"}
+	require.NoError(t, step.parse(false))
+
+	dns := udpFrame(t, net.IP{10, 13, 37, 1}, 53)
+	other := udpFrame(t, net.IP{10, 13, 37, 1}, 123)
+	assert.False(t, faults.dropped(directionIn, dns))
+
+	fault := faults.start(step, nil)
+	assert.Equal(t, 50*time.Millisecond, fault.Until.Sub(fault.Started))
+	assert.True(t, faults.dropped(directionIn, dns))
+	assert.False(t, faults.dropped(directionOut, dns))
+	assert.False(t, faults.dropped(directionIn, other))
+	assert.Len(t, faults.list(), 1)
+
+	require.Eventually(t, func() bool { return !faults.dropped(directionIn, dns) }, time.Second, 5*time.Millisecond)
+	assert.Empty(t, faults.list())
+
+	faults.start(step, nil)
+	faults.clear()
+	assert.False(t, faults.dropped(directionIn, dns))
+}
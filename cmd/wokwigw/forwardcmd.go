@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newForwardCmd(flags *flagCfg) *cobra.Command {
+	forwardCmd := &cobra.Command{
+		Use:   "forward",
+		Short: "Manage the port forwards of a running gateway",
+	}
+	var sessionID string
+	forwardCmd.PersistentFlags().StringVar(&flags.gatewayURL, "gateway", flags.gatewayURL, "URL of the running gateway, or unix:/path/to/socket (default: the first --listen address)")
+	forwardCmd.PersistentFlags().StringVar(&flags.clientToken, "token", flags.clientToken, "authentication token of the running gateway")
+	forwardCmd.PersistentFlags().StringVar(&sessionID, "session", "", "session ID, when every session has an isolated network (see --isolate)")
+
+	// forwardsPath returns the API path for the forwards of the selected session
+	forwardsPath := func(query url.Values) string {
+		if sessionID != "" {
+			query.Set("session", sessionID)
+		}
+		if len(query) == 0 {
+			return "/api/forwards"
+		}
+		return "/api/forwards?" + query.Encode()
+	}
+
+	forwardCmd.AddCommand(&cobra.Command{
+		Use:   "ls",
+		Short: "List port forwards",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var forwards []forward
+			if err := newAPIClient(flags).do(http.MethodGet, forwardsPath(url.Values{}), nil, &forwards); err != nil {
+				return err
+			}
+			for _, fwd := range forwards {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s -> %s\n", fwd.Protocol, fwd.Local, fwd.Remote)
+			}
+			return nil
+		},
+	})
+
+	forwardCmd.AddCommand(&cobra.Command{
+		Use:   "add [udp:]localPort:remoteAddress:remotePort",
+		Short: "Add a port forward",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			local, remote, err := parseForward(args[0])
+			if err != nil {
+				return err
+			}
+			fwd := forwardFromConfig(local, remote)
+			if err := newAPIClient(flags).do(http.MethodPost, forwardsPath(url.Values{}), fwd, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Added %s %s -> %s\n", fwd.Protocol, fwd.Local, fwd.Remote)
+			return nil
+		},
+	})
+
+	forwardCmd.AddCommand(&cobra.Command{
+		Use:   "rm [udp:]localPort",
+		Short: "Remove a port forward",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			protocol, port, found := strings.Cut(args[0], ":")
+			if !found {
+				protocol, port = "tcp", args[0]
+			}
+			if v, e := strconv.Atoi(port); e != nil || v < 0 || v > 65535 || (protocol != "tcp" && protocol != "udp") {
+				return fmt.Errorf("arg ``%s`` is not formatted using the syntax '[udp:]localPort'", args[0])
+			}
+
+			query := url.Values{"protocol": {protocol}, "local": {":" + port}}
+			if err := newAPIClient(flags).do(http.MethodDelete, forwardsPath(query), nil, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed %s :%s\n", protocol, port)
+			return nil
+		},
+	})
+
+	return forwardCmd
+}
@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wokwi/wokwigw/pkg/loopback"
+)
+
+func TestSessionCoalesce(t *testing.T) {
+	client, server, err := loopback.ConnLoopback()
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+	s := &session{ID: "coalesce", Backend: "test", conn: server, coalesce: true}
+
+	received := func() []string {
+		var messages []string
+		for {
+			require.NoError(t, client.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+			msg, _, err := wsutil.ReadServerData(client)
+			if err != nil {
+				var netErr net.Error
+				require.ErrorAs(t, err, &netErr)
+				return messages
+			}
+			messages = append(messages, string(msg))
+		}
+	}
+
+	// The frames followed by more are held until the last one of the burst
+	require.NoError(t, s.writeFrame([]byte("first"), true))
+	require.NoError(t, s.writeFrame([]byte("second"), true))
+	assert.Empty(t, received())
+	require.NoError(t, s.writeFrame([]byte("third"), false))
+	assert.Equal(t, []string{"first", "second", "third"}, received())
+
+	// Another message flushes the held frames first
+	require.NoError(t, s.writeFrame([]byte("held"), true))
+	require.NoError(t, s.writeMessage(ws.OpText, []byte("text")))
+	assert.Equal(t, []string{"held", "text"}, received())
+
+	// So does the last frame of a burst when it's dropped
+	require.NoError(t, s.writeFrame([]byte("kept"), true))
+	s.faults.start(&scenarioStep{Action: faultDrop, Direction: directionOut, duration: time.Minute}, s)
+	require.NoError(t, s.writeFrame([]byte("dropped"), false))
+	s.faults.clear()
+	assert.Equal(t, []string{"kept"}, received())
+
+	// Without --coalesce, every frame leaves right away
+	s.coalesce = false
+	require.NoError(t, s.writeFrame([]byte("alone"), true))
+	assert.Equal(t, []string{"alone"}, received())
+}
+
+// forwardingBackends run the forwarding loop of a backend between a session and the network end
+// of a pipe, which stands for the gvisor switch or the TAP interface
+var forwardingBackends = map[string]func(ctx context.Context, s *session, network net.Conn) error{
+	"vsock": func(ctx context.Context, s *session, network net.Conn) error {
+		return handleWebSocketCommunication(ctx, network, s, nil, nil)
+	},
+	"tap": func(ctx context.Context, s *session, network net.Conn) error {
+		return handleWebSocketWithTAP(ctx, network, s)
+	},
+}
+
+// BenchmarkForwarding measures the frames per second and the throughput of the forwarding loops,
+// with the simulator on a TCP connection
+func BenchmarkForwarding(b *testing.B) {
+	for _, backend := range []string{"vsock", "tap"} {
+		for _, size := range []int{64, 1500} {
+			b.Run(fmt.Sprintf("%s/to-simulator/%dB", backend, size), func(b *testing.B) {
+				benchmarkForwarding(b, backend, size, true, false)
+			})
+			if backend == "vsock" {
+				// Only the vsock backend knows when more frames follow
+				b.Run(fmt.Sprintf("%s/to-simulator-coalesced/%dB", backend, size), func(b *testing.B) {
+					benchmarkForwarding(b, backend, size, true, true)
+				})
+			}
+			b.Run(fmt.Sprintf("%s/from-simulator/%dB", backend, size), func(b *testing.B) {
+				benchmarkForwarding(b, backend, size, false, false)
+			})
+		}
+	}
+}
+
+func benchmarkForwarding(b *testing.B, backend string, size int, toSimulator bool, coalesce bool) {
+	client, server, err := loopback.ConnLoopback()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	network, gateway := loopback.Pipe(loopback.DefaultPipeBuffer)
+	defer network.Close()
+
+	s := &session{ID: "bench", Backend: "bench", conn: server, coalesce: coalesce}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = forwardingBackends[backend](context.Background(), s, gateway)
+	}()
+
+	frame := bytes.Repeat([]byte{0xaa}, size)
+	errs := make(chan error, 1)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	if toSimulator {
+		go func() {
+			for i := 0; i < b.N; i++ {
+				if _, err := network.Write(frame); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		reader := bufio.NewReader(client)
+		buf := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			hdr, err := ws.ReadHeader(reader)
+			if err == nil && hdr.Length != int64(size) {
+				err = fmt.Errorf("received a message of %d bytes, want %d", hdr.Length, size)
+			}
+			if err == nil {
+				_, err = io.ReadFull(reader, buf)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	} else {
+		var encoded bytes.Buffer
+		if err := ws.WriteFrame(&encoded, ws.MaskFrame(ws.NewBinaryFrame(frame))); err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(encoded.Bytes()); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		buf := make([]byte, size+1)
+		for i := 0; i < b.N; i++ {
+			n, err := network.Read(buf)
+			if err == nil && n != size {
+				err = fmt.Errorf("received a frame of %d bytes, want %d", n, size)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := <-errs; err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "frames/s")
+
+	b.StopTimer()
+	client.Close()
+	network.Close()
+	<-done
+}
@@ -0,0 +1,269 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/sirupsen/logrus"
+)
+
+// vlanTagLen is the size of an 802.1Q tag, which the maximum frame size allows for
+const vlanTagLen = 4
+
+// The reasons a frame is invalid, for the wokwigw_invalid_frames_total metric
+const (
+	invalidFrameTooShort = "too-short" // shorter than the Ethernet header
+	invalidFrameTooLarge = "too-large" // larger than the maximum frame size
+)
+
+// maxFrameSizeLimit is the largest frame size that can be configured: the read buffer of the
+// vsock backend, which fits the largest MTU
+const maxFrameSizeLimit = vsockMaxFrame
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// maxFrameSizeForMTU returns the default maximum frame size for an MTU: the MTU, plus the
+// Ethernet header with a VLAN tag
+func maxFrameSizeForMTU(mtu int) int {
+	return mtu + ethHeaderLen + vlanTagLen
+}
+
+// validateMaxFrameSize checks the --maxFrameSize flag against the MTU, or derives it from the MTU
+// when it's not set
+func validateMaxFrameSize(flags *flagCfg, mtu int) error {
+	if flags.maxFrameSize == 0 {
+		flags.maxFrameSize = maxFrameSizeForMTU(mtu)
+		return nil
+	}
+	if flags.maxFrameSize < mtu+ethHeaderLen || flags.maxFrameSize > maxFrameSizeLimit {
+		return fmt.Errorf("invalid max frame size specified (%d), must be between %d (the mtu plus the Ethernet header) and %d", flags.maxFrameSize, mtu+ethHeaderLen, maxFrameSizeLimit)
+	}
+	return nil
+}
+
+// frameLimit returns the maximum size of the frames of the session
+func (s *session) frameLimit() int {
+	if s.maxFrameSize == 0 {
+		return maxFrameSizeForMTU(defaultMTU)
+	}
+	return s.maxFrameSize
+}
+
+// checkFrame returns why a frame is invalid, or an empty string when it's valid
+func (s *session) checkFrame(frame []byte) string {
+	switch {
+	case len(frame) < ethHeaderLen:
+		return invalidFrameTooShort
+	case len(frame) > s.frameLimit():
+		return invalidFrameTooLarge
+	}
+	return ""
+}
+
+// invalidFrame counts a frame dropped because it's invalid. Direction in is from the simulator.
+func (s *session) invalidFrame(direction string, reason string) {
+	if direction == directionIn {
+		s.stats.invalidIn.Add(1)
+	} else {
+		s.stats.invalidOut.Add(1)
+	}
+	metrics.invalidFrames.WithLabelValues(s.Backend, direction, reason).Inc()
+	s.log().WithFields(logrus.Fields{"direction": direction, "reason": reason}).Debug("invalid frame dropped")
+}
+
+// frameBufferSize is the size of the pooled frame buffers: a frame of the default MTU fits
+const frameBufferSize = 2048
+
+// frameBuffers recycles the buffers of the frames read from the simulators (see recycleFrame)
+var frameBuffers = sync.Pool{
+	New: func() any { return new([frameBufferSize]byte) },
+}
+
+// newFrameBuffer returns a buffer for a frame of the given size, with the pooled buffer that holds
+// it, or nil when the frame doesn't fit
+func newFrameBuffer(size int) ([]byte, *[frameBufferSize]byte) {
+	if size > frameBufferSize {
+		return make([]byte, size), nil
+	}
+	buffer := frameBuffers.Get().(*[frameBufferSize]byte)
+	return buffer[:size], buffer
+}
+
+// recycleFrame returns a pooled buffer to the pool, if there's one. Nothing may use the frame it
+// holds afterwards.
+func recycleFrame(buffer *[frameBufferSize]byte) {
+	if buffer != nil {
+		frameBuffers.Put(buffer)
+	}
+}
+
+// frameReader reads the data messages of the simulator, like wsutil.ReadClientData, but it fails
+// with errFrameTooLarge instead of buffering a message larger than limit, and it reads the
+// messages that fit into pooled buffers. With compression, the limit applies to the decompressed
+// messages.
+type frameReader struct {
+	rd      wsutil.Reader
+	control wsutil.FrameHandlerFunc
+	limit   int
+
+	// Compression (see compression.go), nil when it's not negotiated
+	message *wsflate.MessageState
+	inflate *wsflate.Reader
+	counter countingReader
+	// compressedSize is the size on the wire of the last message, when it was compressed
+	compressedSize int
+	// buffer is the pooled buffer of the last message, nil when the message isn't in the pool
+	buffer *[frameBufferSize]byte
+}
+
+// newFrameReader returns a reader of the messages of r. The replies to the control frames
+// (e.g. the pongs) are written to w.
+func newFrameReader(r io.Reader, w io.Writer, limit int, compression bool) *frameReader {
+	control := wsutil.ControlFrameHandler(w, ws.StateServerSide)
+	fr := &frameReader{
+		rd: wsutil.Reader{
+			Source:         r,
+			State:          ws.StateServerSide,
+			CheckUTF8:      true,
+			OnIntermediate: control,
+			MaxFrameSize:   int64(limit),
+		},
+		control: control,
+		limit:   limit,
+	}
+	if compression {
+		fr.message = &wsflate.MessageState{}
+		fr.rd.State |= ws.StateExtended
+		// The compressed payload isn't UTF-8: next checks the text messages once decompressed
+		fr.rd.CheckUTF8 = false
+		fr.rd.Extensions = []wsutil.RecvExtension{fr.message}
+		// A frame that doesn't compress grows a little
+		fr.rd.MaxFrameSize += compressionOverhead
+		fr.counter.r = &fr.rd
+		fr.inflate = wsflate.NewReader(&fr.counter, newInflater)
+	}
+	return fr
+}
+
+func (fr *frameReader) next() ([]byte, ws.OpCode, error) {
+	for {
+		hdr, err := fr.rd.NextFrame()
+		if errors.Is(err, wsutil.ErrFrameTooLarge) {
+			return nil, 0, fmt.Errorf("%w: %d bytes, the maximum is %d", errFrameTooLarge, hdr.Length, fr.limit)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := fr.control(hdr, &fr.rd); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if hdr.OpCode&(ws.OpText|ws.OpBinary) == 0 {
+			if err := fr.rd.Discard(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		fr.compressedSize = 0
+		fr.buffer = nil
+		if fr.message != nil {
+			data, err := fr.readExtended(hdr)
+			if err == nil && hdr.OpCode == ws.OpText && !utf8.Valid(data) {
+				recycleFrame(fr.buffer)
+				fr.buffer = nil
+				return nil, 0, wsutil.ErrInvalidUTF8
+			}
+			return data, hdr.OpCode, err
+		}
+		data, err := fr.read(hdr)
+		return data, hdr.OpCode, err
+	}
+}
+
+// readExtended reads a message of a session with compression
+func (fr *frameReader) readExtended(hdr ws.Header) ([]byte, error) {
+	if fr.message.IsCompressed() {
+		return fr.inflateMessage()
+	}
+	if hdr.Fin && hdr.Length > int64(fr.limit) {
+		// Only the compressed frames may exceed the limit
+		return nil, fmt.Errorf("%w: %d bytes, the maximum is %d", errFrameTooLarge, hdr.Length, fr.limit)
+	}
+	return fr.read(hdr)
+}
+
+// read reads a message that isn't compressed
+func (fr *frameReader) read(hdr ws.Header) ([]byte, error) {
+	if hdr.Fin {
+		// The usual case: the message is a single frame, and its size is known
+		data, buffer := newFrameBuffer(int(hdr.Length))
+		if _, err := io.ReadFull(&fr.rd, data); err != nil {
+			recycleFrame(buffer)
+			return nil, err
+		}
+		fr.buffer = buffer
+		return data, nil
+	}
+
+	// A fragmented message can be larger than its frames
+	data, err := io.ReadAll(io.LimitReader(&fr.rd, int64(fr.limit)+1))
+	if err != nil && !errors.Is(err, wsutil.ErrFrameTooLarge) {
+		return nil, err
+	}
+	if err != nil || len(data) > fr.limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errFrameTooLarge, fr.limit)
+	}
+	return data, nil
+}
+
+// inflateMessage decompresses the message being read, and fails as soon as it's larger than the
+// limit, so a small message can't expand into a huge one
+func (fr *frameReader) inflateMessage() ([]byte, error) {
+	fr.counter.n = 0
+	fr.inflate.Reset(&fr.counter)
+	data, buffer := newFrameBuffer(frameBufferSize)
+	data = data[:0]
+	for {
+		if len(data) == cap(data) {
+			// The message outgrows the pooled buffer
+			data = append(data, 0)[:len(data)]
+			recycleFrame(buffer)
+			buffer = nil
+		}
+		n, err := fr.inflate.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if len(data) > fr.limit {
+			recycleFrame(buffer)
+			return nil, fmt.Errorf("%w: more than %d bytes once decompressed", errFrameTooLarge, fr.limit)
+		}
+		if err == io.EOF {
+			// Drop what follows a final deflate block, if the simulator sent one
+			if err := fr.rd.Discard(); err != nil {
+				recycleFrame(buffer)
+				return nil, err
+			}
+			fr.compressedSize = fr.counter.n
+			fr.buffer = buffer
+			return data, nil
+		}
+		if err != nil {
+			recycleFrame(buffer)
+			if errors.Is(err, wsutil.ErrFrameTooLarge) {
+				return nil, fmt.Errorf("%w: more than %d bytes", errFrameTooLarge, fr.limit)
+			}
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateMaxFrameSize(t *testing.T) {
+	flags := &flagCfg{}
+	require.NoError(t, validateMaxFrameSize(flags, 1500))
+	assert.Equal(t, 1518, flags.maxFrameSize)
+
+	flags = &flagCfg{maxFrameSize: 9018}
+	require.NoError(t, validateMaxFrameSize(flags, 9000))
+	assert.Equal(t, 9018, flags.maxFrameSize)
+
+	for _, size := range []int{1513, maxFrameSizeLimit + 1} {
+		flags = &flagCfg{maxFrameSize: size}
+		assert.ErrorContains(t, validateMaxFrameSize(flags, 1500), "invalid max frame size specified")
+	}
+}
+
+// clientFrames encodes WebSocket frames the way a client sends them, masked
+func clientFrames(t testing.TB, frames ...ws.Frame) []byte {
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		require.NoError(t, ws.WriteFrame(&buf, ws.MaskFrame(frame)))
+	}
+	return buf.Bytes()
+}
+
+// testReadWriter reads the frames of the client, and records the replies of the server
+type testReadWriter struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (rw *testReadWriter) Read(p []byte) (int, error) { return rw.Reader.Read(p) }
+
+func TestFrameReader(t *testing.T) {
+	frame := bytes.Repeat([]byte{0x42}, 100)
+	tcs := map[string]struct {
+		frames  []ws.Frame
+		want    []byte
+		tooBig  bool
+		replied bool
+	}{
+		"binary":            {frames: []ws.Frame{ws.NewBinaryFrame(frame)}, want: frame},
+		"at the limit":      {frames: []ws.Frame{ws.NewBinaryFrame(bytes.Repeat([]byte{1}, 128))}, want: bytes.Repeat([]byte{1}, 128)},
+		"too large":         {frames: []ws.Frame{ws.NewBinaryFrame(bytes.Repeat([]byte{1}, 129))}, tooBig: true},
+		"huge length":       {frames: []ws.Frame{{Header: ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 1 << 40}}}, tooBig: true},
+		"ping before":       {frames: []ws.Frame{ws.NewPingFrame([]byte("ping")), ws.NewBinaryFrame(frame)}, want: frame, replied: true},
+		"fragments":         {frames: fragments(frame[:60], frame[60:]), want: frame},
+		"fragments too big": {frames: fragments(frame, frame), tooBig: true},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			rw := &testReadWriter{Reader: bytes.NewReader(clientFrames(t, tc.frames...))}
+			data, op, err := newFrameReader(rw, rw, 128, false).next()
+			if tc.tooBig {
+				assert.ErrorIs(t, err, errFrameTooLarge)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, ws.OpBinary, op)
+			assert.Equal(t, tc.want, data)
+			assert.Equal(t, tc.replied, rw.Len() > 0)
+		})
+	}
+}
+
+func TestFrameReaderSequence(t *testing.T) {
+	rw := &testReadWriter{Reader: bytes.NewReader(clientFrames(t,
+		ws.NewBinaryFrame([]byte("first")),
+		ws.NewTextFrame([]byte("text")),
+		ws.NewBinaryFrame(nil),
+		fragments([]byte("frag"), []byte("mented"))[0],
+		ws.NewPingFrame(nil),
+		fragments([]byte("frag"), []byte("mented"))[1],
+		ws.NewBinaryFrame([]byte("last")),
+	))}
+	frames := newFrameReader(rw, rw, 128, false)
+	for _, want := range []struct {
+		data string
+		op   ws.OpCode
+	}{{"first", ws.OpBinary}, {"text", ws.OpText}, {"", ws.OpBinary}, {"fragmented", ws.OpBinary}, {"last", ws.OpBinary}} {
+		data, op, err := frames.next()
+		require.NoError(t, err)
+		assert.Equal(t, want.op, op)
+		assert.Equal(t, want.data, string(data))
+		// Only the single frames are read into the pool, whatever the capacity of the others
+		assert.Equal(t, want.data != "fragmented", frames.buffer != nil, want.data)
+		recycleFrame(frames.buffer)
+	}
+	_, _, err := frames.next()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Positive(t, rw.Len(), "the ping is answered")
+}
+
+func fragments(parts ...[]byte) []ws.Frame {
+	frames := make([]ws.Frame, len(parts))
+	for i, part := range parts {
+		op := ws.OpContinuation
+		if i == 0 {
+			op = ws.OpBinary
+		}
+		frames[i] = ws.NewFrame(op, i == len(parts)-1, part)
+	}
+	return frames
+}
+
+func FuzzFrameReader(f *testing.F) {
+	f.Add(clientFrames(f, ws.NewBinaryFrame([]byte("frame"))), false)
+	f.Add(clientFrames(f, ws.NewTextFrame([]byte("text"))), false)
+	f.Add(clientFrames(f, ws.NewPingFrame(nil), ws.NewBinaryFrame(bytes.Repeat([]byte{1}, 200))), false)
+	f.Add(clientFrames(f, fragments([]byte("first"), []byte("second"))...), false)
+	f.Add(clientFrames(f, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye"))), false)
+	f.Add(compressedClientFrame(f, ws.OpBinary, make([]byte, 300)), true)
+	f.Add(compressedClientFrame(f, ws.OpText, []byte("text")), true)
+	f.Fuzz(func(t *testing.T, stream []byte, compression bool) {
+		const limit = 128
+		rw := &testReadWriter{Reader: bytes.NewReader(stream)}
+		frames := newFrameReader(rw, rw, limit, compression)
+		for {
+			data, _, err := frames.next()
+			if err != nil {
+				return
+			}
+			if len(data) > limit {
+				t.Fatalf("read a message of %d bytes, larger than the limit (%d)", len(data), limit)
+			}
+		}
+	})
+}
+
+func TestSessionFrameLimits(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, echoBackend{})
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	conn, id := sim.conn, sim.session.ID
+	defer conn.Close()
+	s := sessions.get(id)
+	require.NotNil(t, s)
+	invalid := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.invalidFrames.WithLabelValues(s.Backend, directionIn, reason))
+	}
+	tooShort, tooLarge := invalid(invalidFrameTooShort), invalid(invalidFrameTooLarge)
+
+	// Frames shorter than the Ethernet header are dropped
+	assert.False(t, echoFrame(t, conn, []byte{1, 2, 3}, 100*time.Millisecond))
+	assert.Equal(t, tooShort+1, invalid(invalidFrameTooShort))
+	assert.Equal(t, uint64(1), s.stats.invalidIn.Load())
+	assert.Equal(t, uint64(0), s.stats.framesIn.Load())
+
+	assert.True(t, echoFrame(t, conn, testFrame(1), time.Second))
+	assert.True(t, echoFrame(t, conn, bytes.Repeat([]byte{0xff}, flags.maxFrameSize), time.Second))
+
+	// A larger frame closes the session
+	require.NoError(t, wsutil.WriteClientBinary(conn, bytes.Repeat([]byte{0xff}, flags.maxFrameSize+1)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	frame, err := ws.ReadFrame(conn)
+	require.NoError(t, err)
+	require.Equal(t, ws.OpClose, frame.Header.OpCode)
+	code, reason := ws.ParseCloseFrameData(frame.Payload)
+	assert.Equal(t, ws.StatusMessageTooBig, code)
+	assert.Contains(t, reason, "frame too large")
+	assert.Equal(t, tooLarge+1, invalid(invalidFrameTooLarge))
+}
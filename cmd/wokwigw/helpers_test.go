@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/stretchr/testify/require"
+)
+
+// nullBackend closes every connection right away
+type nullBackend struct{}
+
+func (nullBackend) Setup(ctx context.Context) error { return nil }
+
+func (nullBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	return conn.Close()
+}
+
+func (nullBackend) Cleanup() error { return nil }
+
+// useTestFlags replaces the global flags for the duration of the test
+func useTestFlags(t *testing.T, f flagCfg) {
+	saved := flags
+	t.Cleanup(func() { flags = saved })
+	flags = f
+	require.NoError(t, validateAndMapFlags(&flags, &config))
+}
+
+type testWebSocket struct {
+	io.Reader
+	net.Conn
+}
+
+func (c testWebSocket) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// dialTestWebSocket connects to a test server, reading through the buffer of the dialer when the
+// server sent data right after the handshake
+func dialTestWebSocket(t *testing.T, dialer ws.Dialer, url string) testWebSocket {
+	conn, br, _, err := dialer.Dial(context.Background(), url)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	if br != nil {
+		return testWebSocket{Reader: br, Conn: conn}
+	}
+	return testWebSocket{Reader: conn, Conn: conn}
+}
+
+// testSessionOptions select how dialTestSession connects the simulator
+type testSessionOptions struct {
+	compression bool   // negotiate permessage-deflate
+	resume      string // the resume token of the session to resume
+}
+
+// testSession is a simulator connected to a test gateway, with its session
+type testSession struct {
+	conn      net.Conn
+	handshake ws.Handshake
+	aloha     alohaMessage
+	session   *session
+}
+
+// dialTestSession connects a simulator to a test gateway, and reads the aloha message
+func dialTestSession(t *testing.T, serverURL string, opts testSessionOptions) testSession {
+	known := make(map[string]bool)
+	for _, s := range sessions.list() {
+		known[s.ID] = true
+	}
+	url := "ws" + strings.TrimPrefix(serverURL, "http") + "/"
+	if opts.resume != "" {
+		url += "?resume=" + opts.resume
+	}
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://wokwi.com"}})}
+	if opts.compression {
+		dialer.Extensions = []httphead.Option{wsflate.DefaultParameters.Option()}
+	}
+	var sim testSession
+	conn, br, hs, err := dialer.Dial(context.Background(), url)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	sim.conn, sim.handshake = testWebSocket{Reader: conn, Conn: conn}, hs
+	if br != nil {
+		sim.conn = testWebSocket{Reader: br, Conn: conn}
+	}
+
+	data, _ := readServerMessage(t, sim.conn)
+	require.NoError(t, json.Unmarshal(data, &sim.aloha))
+	require.Equal(t, "aloha", sim.aloha.Type)
+
+	// A resumed session isn't new
+	if sim.aloha.Resumed {
+		sim.session = sessions.byResumeToken(sim.aloha.ResumeToken)
+	}
+	for _, s := range sessions.list() {
+		if sim.session == nil && !known[s.ID] {
+			sim.session = s
+		}
+	}
+	require.NotNil(t, sim.session, "session not found")
+	return sim
+}
+
+// newTestGateway serves the simulators, the API, the status and the metrics, like the gateway
+func newTestGateway(t *testing.T, backend Backend) *httptest.Server {
+	status := newGatewayStatus(backend, sessions)
+	status.ready.Store(true)
+	server := httptest.NewServer(newGatewayHandler(context.Background(), backend, status))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestAPIServer serves the API alone, and returns a client of it
+func newTestAPIServer(t *testing.T, backend Backend) *apiClient {
+	mux := http.NewServeMux()
+	registerAPI(mux, backend, newSessionRegistry(), nil)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return newAPIClient(&flagCfg{gatewayURL: server.URL})
+}
+
+// freePort returns a TCP port of localhost that nothing listens on
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+func newImpairCmd(flags *flagCfg) *cobra.Command {
+	impairCmd := &cobra.Command{
+		Use:   "impair session [spec|off]",
+		Short: "Show or change the network impairment of a session of a running gateway",
+		Long: `Show or change the network impairment of a session of a running gateway.
+
+The spec is a profile name and/or comma separated settings, e.g. "3g,out.loss=10%,seed=42".
+Settings: delay, jitter, loss, duplicate, reorder, corrupt and rate, for both directions or
+with an in. (from the simulator) or out. (to the simulator) prefix.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := newAPIClient(flags)
+			path := "/api/sessions/" + url.PathEscape(args[0]) + "/impairment"
+			var status impairmentStatus
+			var err error
+			switch {
+			case len(args) == 1:
+				err = client.do(http.MethodGet, path, nil, &status)
+			case args[1] == "off":
+				if err = client.do(http.MethodDelete, path, nil, nil); err == nil {
+					fmt.Fprintln(cmd.OutOrStdout(), "Network impairment removed")
+				}
+				return err
+			default:
+				err = client.do(http.MethodPut, path, impairmentRequest{Spec: args[1]}, &status)
+			}
+			if err != nil {
+				return err
+			}
+			printImpairment(cmd.OutOrStdout(), status)
+			return nil
+		},
+	}
+	impairCmd.Flags().StringVar(&flags.gatewayURL, "gateway", flags.gatewayURL, "URL of the running gateway, or unix:/path/to/socket (default: the first --listen address)")
+	impairCmd.Flags().StringVar(&flags.clientToken, "token", flags.clientToken, "authentication token of the running gateway")
+	return impairCmd
+}
+
+func printImpairment(w io.Writer, status impairmentStatus) {
+	if status.Spec == "off" {
+		fmt.Fprintln(w, "No network impairment")
+		return
+	}
+	fmt.Fprintf(w, "Network impairment: %s (seed=%d)\n", status.Spec, status.Seed)
+	for _, dir := range []struct {
+		name   string
+		params impairmentParams
+		counts *impairedLinkCounts
+	}{
+		{"in (from the simulator)", status.In, status.Stats.In},
+		{"out (to the simulator)", status.Out, status.Stats.Out},
+	} {
+		if !dir.params.enabled() {
+			continue
+		}
+		p := dir.params
+		fmt.Fprintf(w, "  %s: delay=%s jitter=%s loss=%g%% duplicate=%g%% reorder=%g%% corrupt=%g%% rate=%dbit\n",
+			dir.name, p.Delay, p.Jitter, p.Loss, p.Duplicate, p.Reorder, p.Corrupt, p.Rate)
+		if c := dir.counts; c != nil {
+			fmt.Fprintf(w, "    dropped=%d duplicated=%d reordered=%d corrupted=%d overflows=%d\n",
+				c.Dropped, c.Duplicated, c.Reordered, c.Corrupted, c.Overflows)
+		}
+	}
+}
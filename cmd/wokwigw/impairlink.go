@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// impairedLinkQueueLimit is the number of frames a link holds, e.g. while rate limiting. Further
+// frames are dropped, like a router with a full buffer.
+const impairedLinkQueueLimit = 1000
+
+// errImpairedLinkReplaced is returned by a link that was replaced by a new one, so the frame
+// goes to the new link instead
+var errImpairedLinkReplaced = errors.New("impaired link replaced")
+
+// impairedLinkStats count what a link did to the frames
+type impairedLinkStats struct {
+	dropped    atomic.Uint64
+	duplicated atomic.Uint64
+	reordered  atomic.Uint64
+	corrupted  atomic.Uint64
+	overflows  atomic.Uint64
+}
+
+// impairedLinkCounts is the JSON view of impairedLinkStats
+type impairedLinkCounts struct {
+	Dropped    uint64 `json:"dropped"`
+	Duplicated uint64 `json:"duplicated"`
+	Reordered  uint64 `json:"reordered"`
+	Corrupted  uint64 `json:"corrupted"`
+	Overflows  uint64 `json:"overflows"`
+}
+
+func (st *impairedLinkStats) counts() impairedLinkCounts {
+	return impairedLinkCounts{
+		Dropped:    st.dropped.Load(),
+		Duplicated: st.duplicated.Load(),
+		Reordered:  st.reordered.Load(),
+		Corrupted:  st.corrupted.Load(),
+		Overflows:  st.overflows.Load(),
+	}
+}
+
+type scheduledFrame struct {
+	due   time.Time
+	seq   uint64
+	frame []byte
+}
+
+type frameQueue []scheduledFrame
+
+func (q frameQueue) Len() int { return len(q) }
+func (q frameQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q frameQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *frameQueue) Push(x any)   { *q = append(*q, x.(scheduledFrame)) }
+func (q *frameQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// impairedLink applies impairmentParams to the frames of one direction of a session. Frames are
+// delivered in the order of their due time by a goroutine, so a delay doesn't slow down the
+// frames that follow.
+type impairedLink struct {
+	params  impairmentParams
+	deliver func(frame []byte) error
+	rng     *rand.Rand
+	stats   impairedLinkStats
+
+	lock          sync.Mutex
+	queue         frameQueue
+	seq           uint64
+	nextDeparture time.Time
+	err           error
+	wake          chan struct{}
+	done          chan struct{}
+	stopped       chan struct{}
+}
+
+func newImpairedLink(params impairmentParams, seed uint64, stream uint64, deliver func(frame []byte) error) *impairedLink {
+	l := &impairedLink{
+		params:  params,
+		deliver: deliver,
+		rng:     rand.New(rand.NewPCG(seed, stream)),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *impairedLink) chance(percent float64) bool {
+	return percent > 0 && l.rng.Float64()*100 < percent
+}
+
+// send schedules a frame. It returns the error of a previous delivery, e.g. when the
+// connection is closed, so the caller stops sending.
+func (l *impairedLink) send(frame []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+
+	// The random decisions are made in the same order for every frame, so a seed gives the same
+	// results for the same traffic
+	lost := l.chance(l.params.Loss)
+	duplicated := l.chance(l.params.Duplicate)
+	corrupted := l.chance(l.params.Corrupt)
+	reordered := l.chance(l.params.Reorder)
+	jitter := time.Duration(0)
+	if l.params.Jitter > 0 {
+		jitter = time.Duration(l.rng.Int64N(int64(2*l.params.Jitter+1))) - l.params.Jitter
+	}
+	corruptAt := l.rng.IntN(max(len(frame)-ethHeaderLen, 1))
+	corruptBit := byte(1) << l.rng.IntN(8)
+
+	if lost {
+		l.stats.dropped.Add(1)
+		return nil
+	}
+
+	data := append([]byte(nil), frame...)
+	if corrupted && len(data) > ethHeaderLen {
+		// Keep the Ethernet header, so the frame reaches the stack and fails its checksums
+		data[ethHeaderLen+corruptAt] ^= corruptBit
+		l.stats.corrupted.Add(1)
+	}
+
+	now := time.Now()
+	due := now
+	if l.params.Rate > 0 {
+		start := now
+		if l.nextDeparture.After(now) {
+			start = l.nextDeparture
+		}
+		l.nextDeparture = start.Add(time.Duration(int64(len(data)) * 8 * int64(time.Second) / l.params.Rate))
+		due = l.nextDeparture
+	}
+	if reordered && l.params.Delay > 0 {
+		l.stats.reordered.Add(1)
+	} else if delay := l.params.Delay + jitter; delay > 0 {
+		due = due.Add(delay)
+	}
+
+	copies := 1
+	if duplicated {
+		copies = 2
+		l.stats.duplicated.Add(1)
+	}
+	for i := range copies {
+		if len(l.queue) >= impairedLinkQueueLimit {
+			l.stats.overflows.Add(1)
+			return nil
+		}
+		if i > 0 {
+			// Every copy is delivered on its own, and its receiver may change it
+			data = append([]byte(nil), data...)
+		}
+		l.seq++
+		heap.Push(&l.queue, scheduledFrame{due: due, seq: l.seq, frame: data})
+	}
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (l *impairedLink) run() {
+	defer close(l.stopped)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		l.lock.Lock()
+		var wait time.Duration = -1
+		var next *scheduledFrame
+		if len(l.queue) > 0 {
+			if wait = time.Until(l.queue[0].due); wait <= 0 {
+				item := heap.Pop(&l.queue).(scheduledFrame)
+				next = &item
+			}
+		}
+		l.lock.Unlock()
+
+		if next != nil {
+			if err := l.deliver(next.frame); err != nil {
+				l.fail(err)
+				return
+			}
+			continue
+		}
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-l.done:
+			return
+		case <-l.wake:
+		case <-timeout:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+func (l *impairedLink) fail(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.err = err
+	l.queue = nil
+}
+
+// close stops the link. With flush, the frames still queued are delivered right away, in order,
+// and the following frames go to the link that replaces this one; otherwise the queued frames
+// are dropped (e.g. when the session ends).
+func (l *impairedLink) close(flush bool) {
+	l.lock.Lock()
+	if l.err == nil {
+		l.err = net.ErrClosed
+		if flush {
+			l.err = errImpairedLinkReplaced
+		}
+	}
+	l.lock.Unlock()
+	close(l.done)
+	<-l.stopped
+
+	if flush {
+		for len(l.queue) > 0 {
+			item := heap.Pop(&l.queue).(scheduledFrame)
+			if l.deliver(item.frame) != nil {
+				break
+			}
+		}
+	}
+	l.queue = nil
+}
@@ -0,0 +1,312 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// impairmentParams emulate a bad network in one direction, like Linux netem. Percentages are
+// 0-100, and a zero value disables the corresponding impairment.
+type impairmentParams struct {
+	Delay     time.Duration `json:"delay,omitempty"`
+	Jitter    time.Duration `json:"jitter,omitempty"`
+	Loss      float64       `json:"loss,omitempty"`
+	Duplicate float64       `json:"duplicate,omitempty"`
+	Reorder   float64       `json:"reorder,omitempty"` // sent right away, ahead of the delayed frames
+	Corrupt   float64       `json:"corrupt,omitempty"`
+	Rate      int64         `json:"rate,omitempty"` // bits per second
+}
+
+func (p impairmentParams) enabled() bool {
+	return p != impairmentParams{}
+}
+
+// impairment is the configuration of a session: In applies to the frames sent by the simulator,
+// Out to the frames sent to it. The same seed gives the same losses, duplicates, reorders and
+// corruptions for the same traffic.
+type impairment struct {
+	Spec string           `json:"spec"`
+	In   impairmentParams `json:"in"`
+	Out  impairmentParams `json:"out"`
+	Seed uint64           `json:"seed"`
+}
+
+// impairmentProfiles are the named profiles, in the --impair syntax
+var impairmentProfiles = map[string]string{
+	"2g":         "delay=300ms,jitter=100ms,loss=1%,in.rate=32kbit,out.rate=128kbit",
+	"3g":         "delay=100ms,jitter=30ms,loss=0.5%,in.rate=768kbit,out.rate=2mbit",
+	"satellite":  "delay=300ms,jitter=20ms,loss=1%,in.rate=1mbit,out.rate=10mbit",
+	"flaky-wifi": "delay=5ms,jitter=40ms,loss=5%,duplicate=1%,reorder=2%,corrupt=0.5%,rate=10mbit",
+}
+
+func impairmentProfileNames() []string {
+	names := make([]string, 0, len(impairmentProfiles))
+	for name := range impairmentProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseImpairment parses a comma separated list of profile names and key=value settings, e.g.
+// "3g,out.loss=10%,seed=42". Keys without an in. or out. prefix apply to both directions.
+// "off" (or an empty spec) returns nil.
+func parseImpairment(spec string) (*impairment, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "off" || spec == "none" {
+		return nil, nil
+	}
+	imp := &impairment{Spec: spec}
+	seeded := false
+	if err := imp.apply(spec, &seeded, 0); err != nil {
+		return nil, fmt.Errorf("invalid impairment specified (%s): %w", spec, err)
+	}
+	if !seeded {
+		imp.Seed = rand.Uint64()
+	}
+	if !imp.In.enabled() && !imp.Out.enabled() {
+		return nil, nil
+	}
+	return imp, nil
+}
+
+func (imp *impairment) apply(spec string, seeded *bool, depth int) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, found := strings.Cut(item, "=")
+		if !found {
+			profile, ok := impairmentProfiles[item]
+			if !ok || depth > 0 {
+				return fmt.Errorf("unknown profile %q, use one of %s", item, strings.Join(impairmentProfileNames(), ", "))
+			}
+			if err := imp.apply(profile, seeded, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if key == "seed" {
+			seed, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid seed %q", value)
+			}
+			imp.Seed, *seeded = seed, true
+			continue
+		}
+		directions := []*impairmentParams{&imp.In, &imp.Out}
+		if name, found := strings.CutPrefix(key, "in."); found {
+			key, directions = name, directions[:1]
+		} else if name, found := strings.CutPrefix(key, "out."); found {
+			key, directions = name, directions[1:]
+		}
+		for _, params := range directions {
+			if err := params.set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *impairmentParams) set(key string, value string) error {
+	var err error
+	switch key {
+	case "delay":
+		p.Delay, err = parseImpairmentDuration(value)
+	case "jitter":
+		p.Jitter, err = parseImpairmentDuration(value)
+	case "loss":
+		p.Loss, err = parsePercentage(value)
+	case "duplicate":
+		p.Duplicate, err = parsePercentage(value)
+	case "reorder":
+		p.Reorder, err = parsePercentage(value)
+	case "corrupt":
+		p.Corrupt, err = parsePercentage(value)
+	case "rate":
+		p.Rate, err = parseRate(value)
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func parseImpairmentDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%q is not a duration", value)
+	}
+	return d, nil
+}
+
+func parsePercentage(value string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("%q is not a percentage", value)
+	}
+	return v, nil
+}
+
+// parseRate parses a rate in bits per second, e.g. 512kbit or 10mbit
+func parseRate(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		bits   int64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}}
+	number, multiplier := strings.ToLower(value), int64(1)
+	for _, unit := range units {
+		if n, found := strings.CutSuffix(number, unit.suffix); found {
+			number, multiplier = n, unit.bits
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%q is not a rate, e.g. 512kbit or 10mbit", value)
+	}
+	return int64(v * float64(multiplier)), nil
+}
+
+// setImpairment impairs the network of the session, or removes the impairment when imp is nil.
+// The frames queued by the previous impairment are delivered right away.
+func (s *session) setImpairment(imp *impairment) {
+	s.impairLock.Lock()
+	defer s.impairLock.Unlock()
+	if s.impairEnded {
+		return
+	}
+
+	var in, out *impairedLink
+	if imp != nil && imp.In.enabled() {
+		in = newImpairedLink(imp.In, imp.Seed, 1, func(frame []byte) error {
+			return s.queueIncoming(incomingMessage{payload: frame, op: ws.OpBinary})
+		})
+	}
+	if imp != nil && imp.Out.enabled() {
+		out = newImpairedLink(imp.Out, imp.Seed, 2, func(frame []byte) error {
+			return s.sendMessage(ws.OpBinary, frame)
+		})
+	}
+	s.impairment = imp
+	if old := s.inLink.Swap(in); old != nil {
+		old.close(true)
+	}
+	if old := s.outLink.Swap(out); old != nil {
+		old.close(true)
+	}
+}
+
+// currentImpairment returns the impairment of the session, nil when there's none
+func (s *session) currentImpairment() *impairment {
+	s.impairLock.Lock()
+	defer s.impairLock.Unlock()
+	return s.impairment
+}
+
+// stopImpairment drops the frames still queued when the session ends
+func (s *session) stopImpairment() {
+	s.impairLock.Lock()
+	defer s.impairLock.Unlock()
+	if s.impairEnded {
+		return
+	}
+	s.impairEnded = true
+	if queue := s.incomingQueue.Load(); queue != nil {
+		close(queue.ended)
+	}
+	if old := s.inLink.Swap(nil); old != nil {
+		old.close(false)
+	}
+	if old := s.outLink.Swap(nil); old != nil {
+		old.close(false)
+	}
+}
+
+// impairmentStatus is the impairment of a session, as returned by the API
+type impairmentStatus struct {
+	impairment
+	Stats struct {
+		In  *impairedLinkCounts `json:"in,omitempty"`
+		Out *impairedLinkCounts `json:"out,omitempty"`
+	} `json:"stats"`
+}
+
+func (s *session) impairmentStatus() impairmentStatus {
+	s.impairLock.Lock()
+	defer s.impairLock.Unlock()
+	status := impairmentStatus{impairment: impairment{Spec: "off"}}
+	if s.impairment != nil {
+		status.impairment = *s.impairment
+	}
+	if link := s.inLink.Load(); link != nil {
+		counts := link.stats.counts()
+		status.Stats.In = &counts
+	}
+	if link := s.outLink.Load(); link != nil {
+		counts := link.stats.counts()
+		status.Stats.Out = &counts
+	}
+	return status
+}
+
+type impairmentRequest struct {
+	Spec string `json:"spec"`
+}
+
+// registerImpairmentAPI adds the endpoints that change the impairment of a session
+func registerImpairmentAPI(mux *http.ServeMux, sessions *sessionRegistry, apiOnly func(h http.HandlerFunc) http.HandlerFunc) {
+	sessionHandler := func(h func(w http.ResponseWriter, r *http.Request, s *session)) http.HandlerFunc {
+		return apiOnly(func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			s := sessions.get(id)
+			if s == nil {
+				writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w (%s)", errUnknownSession, id))
+				return
+			}
+			h(w, r, s)
+		})
+	}
+
+	mux.HandleFunc("GET /api/sessions/{id}/impairment", sessionHandler(func(w http.ResponseWriter, r *http.Request, s *session) {
+		writeJSON(w, http.StatusOK, s.impairmentStatus())
+	}))
+
+	mux.HandleFunc("PUT /api/sessions/{id}/impairment", sessionHandler(func(w http.ResponseWriter, r *http.Request, s *session) {
+		var req impairmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		imp, err := parseImpairment(req.Spec)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.setImpairment(imp)
+		s.log().WithField("impairment", req.Spec).Info("network impairment changed")
+		writeJSON(w, http.StatusOK, s.impairmentStatus())
+	}))
+
+	mux.HandleFunc("DELETE /api/sessions/{id}/impairment", sessionHandler(func(w http.ResponseWriter, r *http.Request, s *session) {
+		s.setImpairment(nil)
+		s.log().Info("network impairment removed")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
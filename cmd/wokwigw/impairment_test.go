@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoBackend sends every frame back to the simulator
+type echoBackend struct{}
+
+func (echoBackend) Setup(ctx context.Context) error { return nil }
+func (echoBackend) Cleanup() error                  { return nil }
+
+func (echoBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	defer conn.Close()
+	for {
+		msg, op, err := s.readMessage()
+		if err != nil {
+			return nil
+		}
+		if op == ws.OpBinary {
+			if err := s.writeMessage(ws.OpBinary, msg); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func TestParseImpairment(t *testing.T) {
+	imp, err := parseImpairment("3g,out.loss=10%,seed=42")
+	require.NoError(t, err)
+	assert.Equal(t, "3g,out.loss=10%,seed=42", imp.Spec)
+	assert.Equal(t, uint64(42), imp.Seed)
+	assert.Equal(t, impairmentParams{Delay: 100 * time.Millisecond, Jitter: 30 * time.Millisecond, Loss: 0.5, Rate: 768_000}, imp.In)
+	assert.Equal(t, impairmentParams{Delay: 100 * time.Millisecond, Jitter: 30 * time.Millisecond, Loss: 10, Rate: 2_000_000}, imp.Out)
+
+	imp, err = parseImpairment("in.delay=1s, duplicate=2, reorder=50%, corrupt=0.1%, rate=1.5mbit")
+	require.NoError(t, err)
+	assert.Equal(t, impairmentParams{Delay: time.Second, Duplicate: 2, Reorder: 50, Corrupt: 0.1, Rate: 1_500_000}, imp.In)
+	assert.Equal(t, impairmentParams{Duplicate: 2, Reorder: 50, Corrupt: 0.1, Rate: 1_500_000}, imp.Out)
+
+	for _, name := range impairmentProfileNames() {
+		imp, err := parseImpairment(name)
+		require.NoError(t, err, name)
+		assert.True(t, imp.In.enabled() && imp.Out.enabled(), name)
+	}
+
+	for _, spec := range []string{"", "off", "none", "loss=0"} {
+		imp, err := parseImpairment(spec)
+		assert.NoError(t, err, spec)
+		assert.Nil(t, imp, spec)
+	}
+
+	tcs := map[string]string{
+		"5g":               "unknown profile \"5g\"",
+		"latency=10ms":     "unknown setting \"latency\"",
+		"delay=10":         "invalid delay",
+		"delay=-1s":        "invalid delay",
+		"loss=101%":        "invalid loss",
+		"in.rate=fast":     "invalid rate",
+		"seed=abc":         "invalid seed",
+		"up.delay=10ms":    "unknown setting \"up.delay\"",
+		"satellite,loss=x": "invalid loss",
+	}
+	for spec, want := range tcs {
+		_, err := parseImpairment(spec)
+		if assert.Error(t, err, spec) {
+			assert.Contains(t, err.Error(), "invalid impairment specified", spec)
+			assert.Contains(t, err.Error(), want, spec)
+		}
+	}
+}
+
+// linkRecorder collects the frames delivered by a link
+type linkRecorder struct {
+	lock   sync.Mutex
+	frames [][]byte
+	times  []time.Time
+}
+
+func (r *linkRecorder) deliver(frame []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.frames = append(r.frames, frame)
+	r.times = append(r.times, time.Now())
+	return nil
+}
+
+func (r *linkRecorder) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.frames)
+}
+
+func testFrame(i int) []byte {
+	frame := make([]byte, 100)
+	frame[ethHeaderLen] = byte(i)
+	frame[ethHeaderLen+1] = byte(i >> 8)
+	return frame
+}
+
+func TestImpairedLinkDelay(t *testing.T) {
+	var rec linkRecorder
+	link := newImpairedLink(impairmentParams{Delay: 50 * time.Millisecond}, 1, 1, rec.deliver)
+	defer link.close(false)
+
+	start := time.Now()
+	for i := range 10 {
+		require.NoError(t, link.send(testFrame(i)))
+	}
+	// The frames are delayed, not spaced out
+	require.Eventually(t, func() bool { return rec.count() == 10 }, time.Second, time.Millisecond)
+	for i, frame := range rec.frames {
+		assert.Equal(t, testFrame(i), frame)
+		assert.GreaterOrEqual(t, rec.times[i].Sub(start), 50*time.Millisecond)
+	}
+	assert.Less(t, rec.times[9].Sub(start), 150*time.Millisecond)
+}
+
+func TestImpairedLinkRate(t *testing.T) {
+	var rec linkRecorder
+	// 10 frames of 100 bytes at 80kbit/s take 100ms
+	link := newImpairedLink(impairmentParams{Rate: 80_000}, 1, 1, rec.deliver)
+	defer link.close(false)
+
+	start := time.Now()
+	for i := range 10 {
+		require.NoError(t, link.send(testFrame(i)))
+	}
+	require.Eventually(t, func() bool { return rec.count() == 10 }, time.Second, time.Millisecond)
+	assert.GreaterOrEqual(t, rec.times[0].Sub(start), 10*time.Millisecond)
+	assert.GreaterOrEqual(t, rec.times[9].Sub(start), 100*time.Millisecond)
+}
+
+func TestImpairedLinkDeterministic(t *testing.T) {
+	run := func(seed uint64) [][]byte {
+		var rec linkRecorder
+		link := newImpairedLink(impairmentParams{Loss: 30, Duplicate: 10, Corrupt: 10}, seed, 1, rec.deliver)
+		for i := range 1000 {
+			require.NoError(t, link.send(testFrame(i)))
+		}
+		// Nothing is delayed, so flushing delivers the same frames in the same order
+		link.close(true)
+		return rec.frames
+	}
+
+	first := run(42)
+	assert.Equal(t, first, run(42))
+	assert.NotEqual(t, first, run(43))
+	// Roughly 70% delivered, plus 10% of them twice
+	assert.InDelta(t, 770, len(first), 80)
+}
+
+func TestImpairedLinkActions(t *testing.T) {
+	var rec linkRecorder
+	link := newImpairedLink(impairmentParams{Duplicate: 100, Corrupt: 100}, 1, 1, rec.deliver)
+	frame := testFrame(1)
+	require.NoError(t, link.send(frame))
+	require.Eventually(t, func() bool { return rec.count() == 2 }, time.Second, time.Millisecond)
+	link.close(false)
+	assert.Equal(t, rec.frames[0], rec.frames[1])
+	assert.NotSame(t, &rec.frames[0][0], &rec.frames[1][0], "every duplicate has its own copy")
+	assert.Equal(t, frame[:ethHeaderLen], rec.frames[0][:ethHeaderLen], "the Ethernet header is kept")
+	assert.NotEqual(t, frame, rec.frames[0])
+	assert.Equal(t, testFrame(1), frame, "the frame of the caller is left alone")
+	assert.Equal(t, impairedLinkCounts{Duplicated: 1, Corrupted: 1}, link.stats.counts())
+
+	// Reordered frames skip the delay
+	rec = linkRecorder{}
+	link = newImpairedLink(impairmentParams{Delay: time.Hour, Reorder: 100}, 1, 1, rec.deliver)
+	require.NoError(t, link.send(frame))
+	require.Eventually(t, func() bool { return rec.count() == 1 }, time.Second, time.Millisecond)
+	link.close(false)
+	assert.ErrorIs(t, link.send(frame), net.ErrClosed)
+}
+
+func TestImpairedLinkClose(t *testing.T) {
+	var rec linkRecorder
+	link := newImpairedLink(impairmentParams{Delay: time.Hour}, 1, 1, rec.deliver)
+	require.NoError(t, link.send(testFrame(1)))
+	require.NoError(t, link.send(testFrame(2)))
+	link.close(true)
+	assert.Equal(t, [][]byte{testFrame(1), testFrame(2)}, rec.frames, "flushed in order")
+	assert.ErrorIs(t, link.send(testFrame(3)), errImpairedLinkReplaced)
+
+	rec = linkRecorder{}
+	link = newImpairedLink(impairmentParams{Delay: time.Hour}, 1, 1, rec.deliver)
+	require.NoError(t, link.send(testFrame(1)))
+	link.close(false)
+	assert.Empty(t, rec.frames)
+}
+
+func TestImpairmentAPI(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, impair: "in.delay=100ms,seed=7"})
+	server := newTestGateway(t, echoBackend{})
+	client := newAPIClient(&flagCfg{gatewayURL: server.URL})
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	conn, id := sim.conn, sim.session.ID
+
+	roundTrip := func() time.Duration {
+		start := time.Now()
+		frame := testFrame(int(start.UnixNano()))
+		require.NoError(t, wsutil.WriteClientBinary(conn, frame))
+		echo, _, err := wsutil.ReadServerData(conn)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(frame, echo))
+		return time.Since(start)
+	}
+
+	// --impair applies to new sessions
+	assert.GreaterOrEqual(t, roundTrip(), 100*time.Millisecond)
+	var status impairmentStatus
+	require.NoError(t, client.do(http.MethodGet, "/api/sessions/"+id+"/impairment", nil, &status))
+	assert.Equal(t, uint64(7), status.Seed)
+	assert.Equal(t, 100*time.Millisecond, status.In.Delay)
+	assert.NotNil(t, status.Stats.In)
+	assert.Nil(t, status.Stats.Out)
+
+	var changed impairmentStatus
+	require.NoError(t, client.do(http.MethodPut, "/api/sessions/"+id+"/impairment", impairmentRequest{Spec: "out.delay=200ms"}, &changed))
+	assert.False(t, changed.In.enabled())
+	elapsed := roundTrip()
+	assert.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+	assert.Less(t, elapsed, 300*time.Millisecond)
+
+	require.NoError(t, client.do(http.MethodDelete, "/api/sessions/"+id+"/impairment", nil, nil))
+	assert.Less(t, roundTrip(), 100*time.Millisecond)
+	var removed impairmentStatus
+	require.NoError(t, client.do(http.MethodGet, "/api/sessions/"+id+"/impairment", nil, &removed))
+	assert.Equal(t, "off", removed.Spec)
+
+	err := client.do(http.MethodPut, "/api/sessions/"+id+"/impairment", impairmentRequest{Spec: "5g"}, nil)
+	assert.ErrorContains(t, err, "unknown profile")
+	err = client.do(http.MethodGet, "/api/sessions/nope/impairment", nil, nil)
+	assert.ErrorContains(t, err, "unknown session")
+}
+
+func TestImpairmentSessionEnd(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, impair: "delay=1h"})
+	server := newTestGateway(t, echoBackend{})
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	conn, id := sim.conn, sim.session.ID
+	require.NoError(t, wsutil.WriteClientBinary(conn, testFrame(1)))
+	require.NoError(t, conn.Close())
+
+	// The frames stuck in the links don't keep the session alive
+	require.Eventually(t, func() bool { return sessions.get(id) == nil }, time.Second, 10*time.Millisecond)
+}
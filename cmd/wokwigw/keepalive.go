@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// writeTimeout is the longest a write to a simulator may take: a simulator that doesn't read its
+// messages for that long is gone
+const writeTimeout = 10 * time.Second
+
+// The reasons a session ends, in the "session ended" log and the wokwigw_sessions_ended_total metric
+const (
+	endReasonClientClosed   = "client-closed"   // the simulator sent a close frame
+	endReasonConnectionLost = "connection-lost" // the connection failed or closed without a close frame
+	endReasonTimeout        = "timeout"         // nothing received for --idleTimeout, or a write timed out
+	endReasonProtocolError  = "protocol-error"  // the simulator broke the WebSocket protocol
+	endReasonFrameTooLarge  = "frame-too-large" // see frames.go
+	endReasonBackendError   = "backend-error"   // the virtual network or the TAP interface failed
+	endReasonScenario       = "scenario"        // a disconnect step of the fault scenario
+	endReasonShutdown       = "shutdown"        // the gateway is shutting down
+	endReasonUnknown        = "unknown"
+)
+
+// sessionEnd is why a session ended: the first failure, since it causes the others
+type sessionEnd struct {
+	reason string
+	err    error
+}
+
+// end records why the session ends, unless the reason is already known
+func (s *session) end(reason string, err error) {
+	s.ended.CompareAndSwap(nil, &sessionEnd{reason: reason, err: err})
+}
+
+// endReason returns why the session ended, and the error that ended it (if any)
+func (s *session) endReason() (string, error) {
+	if end := s.ended.Load(); end != nil {
+		return end.reason, end.err
+	}
+	return endReasonUnknown, nil
+}
+
+// readEndReason returns why a read from the simulator failed
+func readEndReason(err error) string {
+	var closed wsutil.ClosedError
+	var netErr net.Error
+	var protocolErr ws.ProtocolError
+	var corrupt flate.CorruptInputError
+	switch {
+	case errors.As(err, &closed):
+		return endReasonClientClosed
+	case errors.Is(err, errFrameTooLarge):
+		return endReasonFrameTooLarge
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return endReasonTimeout
+	case errors.As(err, &protocolErr), errors.As(err, &corrupt), errors.Is(err, wsutil.ErrInvalidUTF8):
+		return endReasonProtocolError
+	}
+	return endReasonConnectionLost
+}
+
+// writeEndReason returns why a write to the simulator failed
+func writeEndReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return endReasonTimeout
+	}
+	return endReasonConnectionLost
+}
+
+// validateKeepalive checks the --pingInterval and --idleTimeout flags
+func validateKeepalive(flags *flagCfg) error {
+	if flags.pingInterval < 0 {
+		return fmt.Errorf("invalid ping interval specified (%s)", flags.pingInterval)
+	}
+	if flags.idleTimeout < 0 {
+		return fmt.Errorf("invalid idle timeout specified (%s)", flags.idleTimeout)
+	}
+	if flags.idleTimeout > 0 && flags.pingInterval > 0 && flags.idleTimeout <= flags.pingInterval {
+		// The pongs keep a quiet simulator from timing out
+		return fmt.Errorf("invalid idle timeout specified (%s), must be longer than the ping interval (%s)", flags.idleTimeout, flags.pingInterval)
+	}
+	return nil
+}
+
+// startKeepalive pings the simulator every interval, so a simulator that's gone (e.g. a sleeping
+// browser tab, or a laptop that changed networks) stops answering and times out (see
+// activityReader). It returns a function that stops the pings.
+func (s *session) startKeepalive(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.sendMessage(ws.OpPing, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// activityReader reads the WebSocket, and ends the session when nothing is received for
+// idleTimeout. Instead of moving the read deadline on every read, it lets the deadline expire,
+// then moves it to idleTimeout after the last read when something was received in the meantime.
+type activityReader struct {
+	r           io.Reader
+	conn        net.Conn
+	idleTimeout time.Duration
+	lastRead    time.Time
+}
+
+func newActivityReader(r io.Reader, conn net.Conn, idleTimeout time.Duration) io.Reader {
+	if idleTimeout <= 0 {
+		return r
+	}
+	now := time.Now()
+	_ = conn.SetReadDeadline(now.Add(idleTimeout))
+	return &activityReader{r: r, conn: conn, idleTimeout: idleTimeout, lastRead: now}
+}
+
+func (ar *activityReader) Read(p []byte) (int, error) {
+	for {
+		n, err := ar.r.Read(p)
+		if n > 0 {
+			ar.lastRead = time.Now()
+		}
+		var netErr net.Error
+		if n > 0 || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return n, err
+		}
+		deadline := ar.lastRead.Add(ar.idleTimeout)
+		if !time.Now().Before(deadline) {
+			return 0, fmt.Errorf("nothing received for %s: %w", ar.idleTimeout, err)
+		}
+		if err := ar.conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// controlWriter writes the replies to the control frames of the simulator (the pongs and the
+// close frame), with the lock of the other writes so they don't interleave
+type controlWriter struct {
+	s *session
+}
+
+func (w controlWriter) Write(p []byte) (int, error) {
+	w.s.writeLock.Lock()
+	defer w.s.writeLock.Unlock()
+	if err := w.s.flushLocked(); err != nil {
+		return 0, err
+	}
+	return w.s.writeConn(p)
+}
+
+// writeConn writes to the WebSocket connection with a deadline. The caller holds writeLock.
+// The messages sent while the simulator is gone are dropped (see suspend).
+func (s *session) writeConn(p []byte) (int, error) {
+	if s.detached {
+		return len(p), nil
+	}
+	// Moving the deadline shows in the frame rate: it moves once a second at most
+	if now := time.Now(); s.writeDeadline.Sub(now) < writeTimeout-time.Second {
+		s.writeDeadline = now.Add(writeTimeout)
+		_ = s.conn.SetWriteDeadline(s.writeDeadline)
+	}
+	n, err := s.conn.Write(p)
+	if err != nil {
+		s.end(writeEndReason(err), err)
+		if s.resumable() {
+			// Like a network outage, the message is lost: the read fails as well, and the session
+			// waits for the simulator to reconnect
+			_ = s.conn.Close()
+			return len(p), nil
+		}
+	}
+	return n, err
+}
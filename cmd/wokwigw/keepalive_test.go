@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateKeepalive(t *testing.T) {
+	assert.NoError(t, validateKeepalive(&flagCfg{pingInterval: defaultPingInterval, idleTimeout: defaultIdleTimeout}))
+	assert.NoError(t, validateKeepalive(&flagCfg{pingInterval: time.Minute}), "without idle timeout")
+	assert.NoError(t, validateKeepalive(&flagCfg{idleTimeout: time.Second}), "without pings")
+	assert.ErrorContains(t, validateKeepalive(&flagCfg{pingInterval: -time.Second}), "invalid ping interval specified")
+	assert.ErrorContains(t, validateKeepalive(&flagCfg{idleTimeout: -time.Second}), "invalid idle timeout specified")
+	assert.ErrorContains(t, validateKeepalive(&flagCfg{pingInterval: time.Minute, idleTimeout: time.Minute}), "must be longer than the ping interval")
+}
+
+func TestReadEndReason(t *testing.T) {
+	tcs := map[error]string{
+		wsutil.ClosedError{Code: ws.StatusGoingAway}:                        endReasonClientClosed,
+		fmt.Errorf("%w: 2000 bytes", errFrameTooLarge):                      endReasonFrameTooLarge,
+		fmt.Errorf("nothing received for 1m0s: %w", os.ErrDeadlineExceeded): endReasonTimeout,
+		ws.ErrProtocolNonZeroRsv:                                            endReasonProtocolError,
+		wsutil.ErrInvalidUTF8:                                               endReasonProtocolError,
+		io.EOF:                                                              endReasonConnectionLost,
+		io.ErrUnexpectedEOF:                                                 endReasonConnectionLost,
+	}
+	for err, want := range tcs {
+		assert.Equal(t, want, readEndReason(err), err.Error())
+	}
+}
+
+// sessionsEnded returns the number of sessions of the echo backend that ended for a reason
+func sessionsEnded(reason string) float64 {
+	return testutil.ToFloat64(metrics.sessionsEnded.WithLabelValues(backendName(echoBackend{}), reason))
+}
+
+// waitClosed waits until the gateway closes the connection
+func waitClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(timeout)))
+	for {
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			var netErr net.Error
+			require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the connection is still open")
+			return
+		}
+		if frame.Header.OpCode == ws.OpClose {
+			return
+		}
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, idleTimeout: 200 * time.Millisecond})
+	server := newTestGateway(t, echoBackend{})
+	timeouts := sessionsEnded(endReasonTimeout)
+
+	// The frames of the simulator keep the session alive past the timeout
+	conn := dialTestSession(t, server.URL, testSessionOptions{}).conn
+	for i := range 8 {
+		assert.True(t, echoFrame(t, conn, testFrame(i), time.Second))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Then the session ends once nothing is received for the timeout, with a close frame
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	start := time.Now()
+	frame, err := ws.ReadFrame(conn)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	require.Equal(t, ws.OpClose, frame.Header.OpCode)
+	code, reason := ws.ParseCloseFrameData(frame.Payload)
+	assert.Equal(t, ws.StatusGoingAway, code)
+	assert.Equal(t, "idle timeout", reason)
+	require.Eventually(t, func() bool { return sessionsEnded(endReasonTimeout) == timeouts+1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, pingInterval: 50 * time.Millisecond, idleTimeout: 200 * time.Millisecond})
+	server := newTestGateway(t, echoBackend{})
+	timeouts := sessionsEnded(endReasonTimeout)
+
+	// A quiet simulator that answers the pings stays connected
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	conn, id := sim.conn, sim.session.ID
+	pings := 0
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+	for {
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			var netErr net.Error
+			require.ErrorAs(t, err, &netErr)
+			require.True(t, netErr.Timeout())
+			break
+		}
+		require.Equal(t, ws.OpPing, frame.Header.OpCode)
+		pings++
+		require.NoError(t, ws.WriteFrame(conn, ws.MaskFrame(ws.NewPongFrame(frame.Payload))))
+	}
+	assert.GreaterOrEqual(t, pings, 5)
+	assert.NotNil(t, sessions.get(id))
+
+	// One that stops answering times out
+	waitClosed(t, conn, time.Second)
+	require.Eventually(t, func() bool { return sessionsEnded(endReasonTimeout) == timeouts+1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionClientClosed(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, echoBackend{})
+	closed := sessionsEnded(endReasonClientClosed)
+
+	conn := dialTestSession(t, server.URL, testSessionOptions{}).conn
+	require.NoError(t, ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye")))))
+
+	// The gateway answers with a close frame
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	frame, err := ws.ReadFrame(conn)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpClose, frame.Header.OpCode)
+	require.Eventually(t, func() bool { return sessionsEnded(endReasonClientClosed) == closed+1 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Simulated devices of the same kind usually share a MAC address, e.g. every ESP32 simulation uses
+// 24:0a:c4:00:01:10. In LAN mode, the gateway gives every session a unique virtual MAC address and
+// rewrites the frames between the simulator and the virtual network, so each session gets its own
+// DHCP lease and the sessions can reach each other.
+
+const (
+	ethHeaderLen  = 14
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+
+	arpSenderHWOffset = ethHeaderLen + 8
+	arpTargetHWOffset = ethHeaderLen + 18
+	arpPacketLen      = 28
+
+	dhcpServerPort    = 67
+	dhcpClientPort    = 68
+	dhcpChaddrOffset  = 28
+	dhcpMinPacketLen  = 236
+	ipProtocolUDP     = 17
+	udpHeaderLen      = 8
+	udpChecksumOffset = 6
+)
+
+// lanAllocator hands out the virtual MAC addresses of the sessions connected to the shared LAN.
+type lanAllocator struct {
+	lock  sync.Mutex
+	inUse map[string]string // virtual MAC -> session ID
+}
+
+func newLANAllocator() *lanAllocator {
+	return &lanAllocator{
+		inUse: make(map[string]string),
+	}
+}
+
+// attach returns the MAC rewriter of a new session. The virtual MAC is allocated when the
+// simulator sends its first frame, as this is where we learn the MAC address of the simulator.
+func (a *lanAllocator) attach(s *session) *macRewriter {
+	return &macRewriter{allocator: a, session: s}
+}
+
+func (a *lanAllocator) detach(r *macRewriter) {
+	_, virt := r.addresses()
+	if virt == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.inUse[virt.String()] == r.session.ID {
+		delete(a.inUse, virt.String())
+	}
+}
+
+// allocate picks the virtual MAC for a session. The choice is deterministic, so a device that
+// reconnects gets the same MAC address back, and with it the same DHCP lease:
+//   - sessions that name their device (?device=name) get a MAC derived from that name,
+//   - the first session with a given simulator MAC keeps it,
+//   - further sessions with the same simulator MAC get the next free locally administered variant.
+func (a *lanAllocator) allocate(s *session, sim net.HardwareAddr) net.HardwareAddr {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var candidate net.HardwareAddr
+	if s.Device != "" {
+		candidate = deviceMAC(s.Device)
+		if _, taken := a.inUse[candidate.String()]; taken {
+			s.log().Warn("device name is already in use by another session")
+			candidate = nil
+		}
+	}
+	if candidate == nil {
+		if _, taken := a.inUse[sim.String()]; !taken {
+			candidate = sim
+		}
+	}
+	for slot := 1; candidate == nil && slot < 256; slot++ {
+		mac := slotMAC(sim, slot)
+		if _, taken := a.inUse[mac.String()]; !taken {
+			candidate = mac
+		}
+	}
+	if candidate == nil {
+		// 255 sessions sharing one MAC address, no point in rewriting
+		candidate = sim
+	}
+
+	a.inUse[candidate.String()] = s.ID
+	return candidate
+}
+
+func deviceMAC(device string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(device))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01 // locally administered, unicast
+	return mac
+}
+
+func slotMAC(sim net.HardwareAddr, slot int) net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, sim)
+	mac[0] = (mac[0] | 0x02) &^ 0x01 // locally administered, unicast
+	mac[5] += byte(slot)
+	return mac
+}
+
+// macRewriter translates between the MAC address of the simulator and the virtual MAC address of
+// the session: in the Ethernet header, in ARP packets and in the client hardware address of DHCP.
+type macRewriter struct {
+	allocator *lanAllocator
+	session   *session
+
+	lock sync.Mutex
+	sim  net.HardwareAddr
+	virt net.HardwareAddr
+}
+
+func (r *macRewriter) addresses() (sim net.HardwareAddr, virt net.HardwareAddr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sim, r.virt
+}
+
+// fromSimulator rewrites a frame sent by the simulator, in place.
+func (r *macRewriter) fromSimulator(frame []byte) {
+	if len(frame) < ethHeaderLen {
+		return
+	}
+
+	r.lock.Lock()
+	if r.sim == nil {
+		r.sim = append(net.HardwareAddr{}, frame[6:12]...)
+		r.virt = r.allocator.allocate(r.session, r.sim)
+		r.session.log().WithFields(logrus.Fields{"simulatorMAC": r.sim.String(), "lanMAC": r.virt.String()}).Info("LAN MAC assigned")
+	}
+	sim, virt := r.sim, r.virt
+	r.lock.Unlock()
+
+	if bytes.Equal(sim, virt) {
+		return
+	}
+
+	replaceMAC(frame[6:12], sim, virt)
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		if len(frame) >= ethHeaderLen+arpPacketLen {
+			replaceMAC(frame[arpSenderHWOffset:arpSenderHWOffset+6], sim, virt)
+		}
+	case etherTypeIPv4:
+		rewriteDHCP(frame, dhcpServerPort, sim, virt)
+	}
+}
+
+// toSimulator rewrites a frame sent to the simulator, in place.
+func (r *macRewriter) toSimulator(frame []byte) {
+	sim, virt := r.addresses()
+	if len(frame) < ethHeaderLen || sim == nil || bytes.Equal(sim, virt) {
+		return
+	}
+
+	replaceMAC(frame[0:6], virt, sim)
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		if len(frame) >= ethHeaderLen+arpPacketLen {
+			replaceMAC(frame[arpTargetHWOffset:arpTargetHWOffset+6], virt, sim)
+		}
+	case etherTypeIPv4:
+		rewriteDHCP(frame, dhcpClientPort, virt, sim)
+	}
+}
+
+func replaceMAC(field []byte, from net.HardwareAddr, to net.HardwareAddr) {
+	if bytes.Equal(field, from) {
+		copy(field, to)
+	}
+}
+
+// rewriteDHCP replaces the client hardware address of a DHCP message sent to dstPort.
+// The UDP checksum is cleared rather than recomputed, which is allowed for UDP over IPv4.
+func rewriteDHCP(frame []byte, dstPort uint16, from net.HardwareAddr, to net.HardwareAddr) {
+	ip := frame[ethHeaderLen:]
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != ipProtocolUDP {
+		return
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	if ihl < 20 || len(ip) < ihl+udpHeaderLen+dhcpMinPacketLen {
+		return
+	}
+	udp := ip[ihl:]
+	if binary.BigEndian.Uint16(udp[2:4]) != dstPort {
+		return
+	}
+	dhcp := udp[udpHeaderLen:]
+	if dhcp[1] != 1 || dhcp[2] != 6 { // htype: Ethernet, hlen: 6
+		return
+	}
+	chaddr := dhcp[dhcpChaddrOffset : dhcpChaddrOffset+6]
+	if bytes.Equal(chaddr, from) {
+		copy(chaddr, to)
+		udp[udpChecksumOffset] = 0
+		udp[udpChecksumOffset+1] = 0
+	}
+}
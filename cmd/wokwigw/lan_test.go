@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSimMAC     = net.HardwareAddr{0x24, 0x0a, 0xc4, 0x00, 0x01, 0x10}
+	testGatewayMAC = net.HardwareAddr{0x42, 0x13, 0x37, 0x55, 0xaa, 0x01}
+)
+
+func serializeFrame(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	for _, layer := range l {
+		if udp, ok := layer.(*layers.UDP); ok {
+			for _, other := range l {
+				if ip, ok := other.(*layers.IPv4); ok {
+					require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+				}
+			}
+		}
+	}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, l...))
+	return buf.Bytes()
+}
+
+func arpFrame(t *testing.T, op uint16, src net.HardwareAddr, dst net.HardwareAddr) []byte {
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         op,
+			SourceHwAddress:   src,
+			SourceProtAddress: net.IP{10, 13, 37, 2}.To4(),
+			DstHwAddress:      dst,
+			DstProtAddress:    net.IP{10, 13, 37, 1}.To4(),
+		})
+}
+
+func dhcpFrame(t *testing.T, src net.HardwareAddr, dst net.HardwareAddr, srcPort layers.UDPPort, dstPort layers.UDPPort, chaddr net.HardwareAddr) []byte {
+	op := layers.DHCPOpRequest
+	if srcPort == dhcpServerPort {
+		op = layers.DHCPOpReply
+	}
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4zero.To4(), DstIP: net.IPv4bcast.To4()},
+		&layers.UDP{SrcPort: srcPort, DstPort: dstPort},
+		&layers.DHCPv4{Operation: op, HardwareType: layers.LinkTypeEthernet, HardwareLen: 6, Xid: 42, ClientHWAddr: chaddr},
+	)
+}
+
+func TestLANAllocator(t *testing.T) {
+	allocator := newLANAllocator()
+	first := allocator.attach(&session{ID: "first"})
+	second := allocator.attach(&session{ID: "second"})
+	named := allocator.attach(&session{ID: "named", Device: "hub"})
+
+	first.fromSimulator(arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+	second.fromSimulator(arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+	named.fromSimulator(arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+
+	_, firstMAC := first.addresses()
+	_, secondMAC := second.addresses()
+	_, namedMAC := named.addresses()
+	assert.Equal(t, testSimMAC, firstMAC)
+	assert.Equal(t, net.HardwareAddr{0x26, 0x0a, 0xc4, 0x00, 0x01, 0x11}, secondMAC)
+	assert.Equal(t, deviceMAC("hub"), namedMAC)
+	assert.Equal(t, byte(0x02), namedMAC[0]&0x03)
+
+	// a reconnecting session gets its previous MAC address back
+	allocator.detach(second)
+	again := allocator.attach(&session{ID: "again"})
+	again.fromSimulator(arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+	_, againMAC := again.addresses()
+	assert.Equal(t, secondMAC, againMAC)
+}
+
+func TestMACRewriter(t *testing.T) {
+	allocator := newLANAllocator()
+	allocator.attach(&session{ID: "first"}).fromSimulator(arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+	rewriter := allocator.attach(&session{ID: "second"})
+	virt := slotMAC(testSimMAC, 1)
+
+	t.Run("ARP request from the simulator", func(t *testing.T) {
+		frame := arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast)
+		rewriter.fromSimulator(frame)
+
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		assert.Equal(t, virt, packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).SrcMAC)
+		assert.Equal(t, []byte(virt), packet.Layer(layers.LayerTypeARP).(*layers.ARP).SourceHwAddress)
+	})
+
+	t.Run("ARP reply to the simulator", func(t *testing.T) {
+		frame := arpFrame(t, layers.ARPReply, testGatewayMAC, virt)
+		rewriter.toSimulator(frame)
+
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		assert.Equal(t, testSimMAC, packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC)
+		assert.Equal(t, []byte(testSimMAC), packet.Layer(layers.LayerTypeARP).(*layers.ARP).DstHwAddress)
+		assert.Equal(t, []byte(testGatewayMAC), packet.Layer(layers.LayerTypeARP).(*layers.ARP).SourceHwAddress)
+	})
+
+	t.Run("DHCP request from the simulator", func(t *testing.T) {
+		frame := dhcpFrame(t, testSimMAC, layers.EthernetBroadcast, dhcpClientPort, dhcpServerPort, testSimMAC)
+		rewriter.fromSimulator(frame)
+
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		require.Nil(t, packet.ErrorLayer())
+		assert.Equal(t, virt, packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4).ClientHWAddr)
+		assert.Equal(t, uint16(0), packet.Layer(layers.LayerTypeUDP).(*layers.UDP).Checksum)
+	})
+
+	t.Run("DHCP reply to the simulator", func(t *testing.T) {
+		frame := dhcpFrame(t, testGatewayMAC, layers.EthernetBroadcast, dhcpServerPort, dhcpClientPort, virt)
+		rewriter.toSimulator(frame)
+
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		require.Nil(t, packet.ErrorLayer())
+		assert.Equal(t, testSimMAC, packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4).ClientHWAddr)
+		assert.Equal(t, layers.EthernetBroadcast, packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC)
+	})
+
+	t.Run("DHCP reply for another session", func(t *testing.T) {
+		other := slotMAC(testSimMAC, 2)
+		frame := dhcpFrame(t, testGatewayMAC, layers.EthernetBroadcast, dhcpServerPort, dhcpClientPort, other)
+		rewriter.toSimulator(frame)
+
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		assert.Equal(t, other, packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4).ClientHWAddr)
+	})
+
+	t.Run("truncated frames", func(t *testing.T) {
+		for _, frame := range [][]byte{{}, {1, 2, 3}, arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast)[:20]} {
+			rewriter.fromSimulator(frame)
+			rewriter.toSimulator(frame)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const unixPrefix = "unix:"
+
+// listenEndpoint is an address the gateway listens on: host:port, [ipv6]:port, a bare port
+// (on localhost) or unix:/path/to/socket.
+type listenEndpoint struct {
+	network string // "tcp" or "unix"
+	address string
+}
+
+func parseListenEndpoint(text string) (listenEndpoint, error) {
+	if path, found := strings.CutPrefix(text, unixPrefix); found {
+		if path == "" {
+			return listenEndpoint{}, fmt.Errorf("invalid listen address specified (%s): missing socket path", text)
+		}
+		return listenEndpoint{network: "unix", address: path}, nil
+	}
+
+	host, port := defaultListenAddr, text
+	if strings.Contains(text, ":") {
+		var err error
+		if host, port, err = net.SplitHostPort(text); err != nil {
+			return listenEndpoint{}, fmt.Errorf("invalid listen address specified (%s): %w", text, err)
+		}
+	}
+	if v, err := strconv.Atoi(port); err != nil || v < 0 || v > 65535 {
+		return listenEndpoint{}, fmt.Errorf("invalid listen port specified (%s)", text)
+	}
+	return listenEndpoint{network: "tcp", address: net.JoinHostPort(host, port)}, nil
+}
+
+func (e listenEndpoint) String() string {
+	if e.network == "unix" {
+		return unixPrefix + e.address
+	}
+	return e.address
+}
+
+// wildcard returns whether the endpoint accepts connections on all the network interfaces
+func (e listenEndpoint) wildcard() bool {
+	if e.network != "tcp" {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(e.address)
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// exposed returns whether the endpoint accepts connections from other machines: every TCP
+// endpoint that isn't on a loopback address
+func (e listenEndpoint) exposed() bool {
+	if e.network != "tcp" {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(e.address)
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// clientAddress returns the address clients on this machine use to reach the endpoint
+func (e listenEndpoint) clientAddress() string {
+	if !e.wildcard() {
+		return e.address
+	}
+	_, port, _ := net.SplitHostPort(e.address)
+	return net.JoinHostPort(defaultListenAddr, port)
+}
+
+func (e listenEndpoint) listen() (net.Listener, error) {
+	if e.network == "unix" {
+		if err := removeStaleSocket(e.address); err != nil {
+			return nil, err
+		}
+		listener, err := net.Listen("unix", e.address)
+		if err != nil {
+			return nil, err
+		}
+		// Only the user running the gateway may connect
+		if err := os.Chmod(e.address, 0o600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen(e.network, e.address)
+}
+
+// removeStaleSocket removes the socket file left behind by a gateway that didn't exit cleanly
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("cannot listen on %s: socket is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// parseListenEndpoints returns the endpoints given with --listen, or localhost:listenPort
+func parseListenEndpoints(flags *flagCfg) ([]listenEndpoint, error) {
+	if len(flags.listen) == 0 {
+		if flags.listenPort < 0 || flags.listenPort > 65535 {
+			return nil, fmt.Errorf("invalid listen port specified (%d)", flags.listenPort)
+		}
+		return []listenEndpoint{{network: "tcp", address: net.JoinHostPort(defaultListenAddr, strconv.Itoa(flags.listenPort))}}, nil
+	}
+
+	var endpoints []listenEndpoint
+	for _, text := range flags.listen {
+		endpoint, err := parseListenEndpoint(text)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.exposed() && !flags.auth.enabled() {
+			return nil, fmt.Errorf("listening on a non-loopback address (%s) requires authentication, add --authToken or --authTokenFile", text)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// dialEndpoint connects to the gateway, for clients of the API
+func dialEndpoint(ctx context.Context, endpoint listenEndpoint) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, endpoint.network, endpoint.clientAddress())
+}
+
+// remoteAddr returns the address of the client of a request, which is empty for Unix sockets
+func remoteAddr(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "unix"
+	}
+	return r.RemoteAddr
+}
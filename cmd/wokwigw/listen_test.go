@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenEndpoint(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected listenEndpoint
+		wildcard bool
+		exposed  bool
+	}{
+		{"9011", listenEndpoint{"tcp", "127.0.0.1:9011"}, false, false},
+		{"192.168.1.10:9011", listenEndpoint{"tcp", "192.168.1.10:9011"}, false, true},
+		{"[::1]:9011", listenEndpoint{"tcp", "[::1]:9011"}, false, false},
+		{"localhost:9011", listenEndpoint{"tcp", "localhost:9011"}, false, false},
+		{"gateway.lan:9011", listenEndpoint{"tcp", "gateway.lan:9011"}, false, true},
+		{"0.0.0.0:9011", listenEndpoint{"tcp", "0.0.0.0:9011"}, true, true},
+		{"[::]:9011", listenEndpoint{"tcp", "[::]:9011"}, true, true},
+		{":9011", listenEndpoint{"tcp", ":9011"}, true, true},
+		{"unix:/run/wokwigw.sock", listenEndpoint{"unix", "/run/wokwigw.sock"}, false, false},
+	}
+	for _, testCase := range tests {
+		endpoint, err := parseListenEndpoint(testCase.in)
+		if assert.NoError(t, err, testCase.in) {
+			assert.Equal(t, testCase.expected, endpoint, testCase.in)
+			assert.Equal(t, testCase.wildcard, endpoint.wildcard(), testCase.in)
+			assert.Equal(t, testCase.exposed, endpoint.exposed(), testCase.in)
+		}
+	}
+
+	for _, in := range []string{"unix:", "host:99999", "host:abc", "::1:9011", "abc"} {
+		_, err := parseListenEndpoint(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestListenRequiresAuth(t *testing.T) {
+	cfg := defaultConfig()
+	f := flagCfg{listen: []string{"127.0.0.1:9011", "0.0.0.0:9011"}}
+	err := validateAndMapFlags(&f, &cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires authentication")
+	}
+
+	// A specific LAN address is as exposed as all the interfaces
+	f = flagCfg{listen: []string{"192.168.1.10:9011"}}
+	err = validateAndMapFlags(&f, &cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires authentication")
+	}
+
+	f = flagCfg{listen: []string{"127.0.0.1:9011", "[::1]:9011", "localhost:9011", "unix:/run/wokwigw.sock"}}
+	require.NoError(t, validateAndMapFlags(&f, &cfg))
+
+	f = flagCfg{listen: []string{"127.0.0.1:9011", "0.0.0.0:9011"}, authTokens: []string{"secret"}}
+	require.NoError(t, validateAndMapFlags(&f, &cfg))
+	assert.Len(t, f.listeners, 2)
+	assert.Equal(t, "127.0.0.1:9011", f.listeners[1].clientAddress())
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wokwigw.sock")
+	endpoint := listenEndpoint{network: "unix", address: path}
+
+	// A socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := endpoint.listen()
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// ...but not a socket in use
+	_, err = endpoint.listen()
+	assert.ErrorContains(t, err, "in use")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []session{{RemoteAddr: remoteAddr(r)}})
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	var result []session
+	client := newAPIClient(&flagCfg{gatewayURL: "unix:" + path})
+	require.NoError(t, client.do(http.MethodGet, "/api/sessions", nil, &result))
+	assert.Equal(t, []session{{RemoteAddr: "unix"}}, result)
+
+	// The API client uses the socket when it's the first endpoint of the gateway
+	client = newAPIClient(&flagCfg{listeners: []listenEndpoint{endpoint}})
+	require.NoError(t, client.do(http.MethodGet, "/api/sessions", nil, &result))
+}
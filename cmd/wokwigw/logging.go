@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLogLevel = "info"
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+)
+
+// validateLogFlags checks --log-level and --log-format. Empty values stand for the defaults.
+func validateLogFlags(flags *flagCfg) error {
+	if flags.logLevel == "" {
+		flags.logLevel = defaultLogLevel
+	}
+	if flags.logFormat == "" {
+		flags.logFormat = logFormatText
+	}
+	if _, err := logrus.ParseLevel(flags.logLevel); err != nil {
+		return fmt.Errorf("invalid log level specified (%s), must be one of trace, debug, info, warn, error", flags.logLevel)
+	}
+	if flags.logFormat != logFormatText && flags.logFormat != logFormatJSON {
+		return fmt.Errorf("invalid log format specified (%s), must be text or json", flags.logFormat)
+	}
+	return nil
+}
+
+// setupLogging configures the logger shared by the gateway and gvisor-tap-vsock. The debug option
+// of the virtual network (debug: true in the config file) implies the debug level.
+func setupLogging(flags *flagCfg, cfg *types.Configuration) {
+	level, _ := logrus.ParseLevel(flags.logLevel)
+	if cfg.Debug && level < logrus.DebugLevel {
+		level = logrus.DebugLevel
+	}
+	logrus.SetLevel(level)
+	logrus.SetOutput(os.Stdout)
+
+	if flags.logFormat == logFormatJSON {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
+}
+
+// backendName identifies the backend in the session logs
+func backendName(backend Backend) string {
+	switch b := backend.(type) {
+	case *WaterBackend:
+		return "bridge"
+	case *VsockBackend:
+		return b.mode.String()
+	}
+	return fmt.Sprintf("%T", backend)
+}
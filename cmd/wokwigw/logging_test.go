@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestLogger captures the log output for the duration of the test
+func useTestLogger(t *testing.T, f *flagCfg, debug bool) *bytes.Buffer {
+	logger := logrus.StandardLogger()
+	out, formatter, level := logger.Out, logger.Formatter, logger.GetLevel()
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(level)
+	})
+
+	cfg := defaultConfig()
+	cfg.Debug = debug
+	require.NoError(t, validateLogFlags(f))
+	setupLogging(f, &cfg)
+
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	return &buf
+}
+
+func TestValidateLogFlags(t *testing.T) {
+	f := flagCfg{}
+	require.NoError(t, validateLogFlags(&f))
+	assert.Equal(t, "info", f.logLevel)
+	assert.Equal(t, "text", f.logFormat)
+
+	assert.ErrorContains(t, validateLogFlags(&flagCfg{logLevel: "loud"}), "invalid log level specified")
+	assert.ErrorContains(t, validateLogFlags(&flagCfg{logFormat: "xml"}), "invalid log format specified")
+}
+
+func TestSessionLogFields(t *testing.T) {
+	buf := useTestLogger(t, &flagCfg{logLevel: "info", logFormat: "json"}, false)
+
+	s := &session{ID: "abcd1234", RemoteAddr: "127.0.0.1:5000", Origin: "https://wokwi.com", Identity: "ci", Backend: "vsock"}
+	s.stats.framesIn.Add(2)
+	s.stats.bytesIn.Add(600)
+	s.log().WithFields(s.stats.fields()).Info("session ended")
+	s.log().Debug("hidden")
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "session ended", entry["msg"])
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "abcd1234", entry["session"])
+	assert.Equal(t, "127.0.0.1:5000", entry["remoteAddr"])
+	assert.Equal(t, "https://wokwi.com", entry["origin"])
+	assert.Equal(t, "vsock", entry["backend"])
+	assert.Equal(t, "ci", entry["identity"])
+	assert.NotContains(t, entry, "device")
+	assert.Equal(t, float64(2), entry["framesIn"])
+	assert.Equal(t, float64(600), entry["bytesIn"])
+	assert.Equal(t, float64(0), entry["framesOut"])
+}
+
+func TestDebugConfigSetsLogLevel(t *testing.T) {
+	useTestLogger(t, &flagCfg{logLevel: "warn"}, true)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	useTestLogger(t, &flagCfg{logLevel: "trace"}, true)
+	assert.Equal(t, logrus.TraceLevel, logrus.GetLevel())
+}
+
+func TestBackendName(t *testing.T) {
+	cfg := defaultConfig()
+	assert.Equal(t, "vsock", backendName(NewVsockBackend(&cfg, vsockShared)))
+	assert.Equal(t, "vsock-isolated", backendName(NewVsockBackend(&cfg, vsockIsolated)))
+	assert.Equal(t, "vsock-lan", backendName(NewVsockBackend(&cfg, vsockLAN)))
+	assert.Equal(t, "bridge", backendName(NewWaterBackend(&cfg)))
+}
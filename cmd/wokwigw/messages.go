@@ -8,6 +8,9 @@ type alohaMessage struct {
 	Protocol       string `json:"protocol"`
 	Version        int32  `json:"version"`
 	GatewayVersion string `json:"gatewayVersion"`
+	// ResumeToken lets the simulator reconnect to the same session (see resume.go)
+	ResumeToken string `json:"resumeToken,omitempty"`
+	Resumed     bool   `json:"resumed,omitempty"`
 }
 
 func makeAlohaMessage(version string) alohaMessage {
@@ -18,3 +21,29 @@ func makeAlohaMessage(version string) alohaMessage {
 		GatewayVersion: version,
 	}
 }
+
+type errorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func makeErrorMessage(code string, message string) errorMessage {
+	return errorMessage{
+		Type:    "error",
+		Code:    code,
+		Message: message,
+	}
+}
+
+type goodbyeMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func makeGoodbyeMessage(reason string) goodbyeMessage {
+	return goodbyeMessage{
+		Type:   "goodbye",
+		Reason: reason,
+	}
+}
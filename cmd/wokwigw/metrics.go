@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	directionIn  = "in"  // from the simulator
+	directionOut = "out" // to the simulator
+)
+
+// The stages of the wokwigw_compression_bytes_total metric
+const (
+	compressionStageUncompressed = "uncompressed"
+	compressionStageCompressed   = "compressed"
+)
+
+// gatewayMetrics are the Prometheus metrics served on /metrics
+type gatewayMetrics struct {
+	registry *prometheus.Registry
+
+	activeSessions     *prometheus.GaugeVec
+	sessions           *prometheus.CounterVec
+	sessionsEnded      *prometheus.CounterVec
+	sessionsResumed    *prometheus.CounterVec
+	frames             *prometheus.CounterVec
+	bytes              *prometheus.CounterVec
+	frameSize          *prometheus.HistogramVec
+	invalidFrames      *prometheus.CounterVec
+	compressionBytes   *prometheus.CounterVec
+	rejectedOrigins    prometheus.Counter
+	authFailures       prometheus.Counter
+	upgradeErrors      prometheus.Counter
+	forwardConnections *prometheus.CounterVec
+}
+
+var metrics = newGatewayMetrics()
+
+func newGatewayMetrics() *gatewayMetrics {
+	m := &gatewayMetrics{
+		registry: prometheus.NewRegistry(),
+		activeSessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "wokwigw_active_sessions",
+			Help: "Number of connected simulators.",
+		}, []string{"backend"}),
+		sessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_sessions_total",
+			Help: "Number of sessions started since the gateway started.",
+		}, []string{"backend"}),
+		sessionsEnded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_sessions_ended_total",
+			Help: "Sessions ended since the gateway started, by the reason they ended (e.g. client-closed, timeout, backend-error).",
+		}, []string{"backend", "reason"}),
+		sessionsResumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_sessions_resumed_total",
+			Help: "Times a simulator reconnected to its session within the resume window.",
+		}, []string{"backend"}),
+		frames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_frames_total",
+			Help: "Ethernet frames exchanged with the simulators. Direction in is from the simulator.",
+		}, []string{"backend", "direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_bytes_total",
+			Help: "Bytes of Ethernet frames exchanged with the simulators. Direction in is from the simulator.",
+		}, []string{"backend", "direction"}),
+		frameSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "wokwigw_frame_size_bytes",
+			Help:    "Size of the Ethernet frames exchanged with the simulators.",
+			Buckets: []float64{64, 128, 256, 512, 1024, 1514, 4096, 16384, 65535},
+		}, []string{"backend", "direction"}),
+		invalidFrames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_invalid_frames_total",
+			Help: "Frames dropped because they are shorter than the Ethernet header or larger than the maximum frame size. Direction in is from the simulator.",
+		}, []string{"backend", "direction", "reason"}),
+		compressionBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_compression_bytes_total",
+			Help: "Bytes of the messages exchanged with the simulators that negotiated compression, before (stage uncompressed) and after (stage compressed) compression. Direction in is from the simulator.",
+		}, []string{"backend", "direction", "stage"}),
+		rejectedOrigins: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wokwigw_rejected_origins_total",
+			Help: "Connections rejected because of their origin.",
+		}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wokwigw_auth_failures_total",
+			Help: "Connections rejected because of a missing or invalid token.",
+		}),
+		upgradeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wokwigw_upgrade_errors_total",
+			Help: "Connections that failed the WebSocket upgrade.",
+		}),
+		forwardConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wokwigw_forward_connections_total",
+			Help: "TCP connections opened to the simulators through the port forwards of the vsock backends, by forward (its local address).",
+		}, []string{"backend", "forward"}),
+	}
+	m.registry.MustRegister(
+		m.activeSessions,
+		m.sessions,
+		m.sessionsEnded,
+		m.sessionsResumed,
+		m.frames,
+		m.bytes,
+		m.frameSize,
+		m.invalidFrames,
+		m.compressionBytes,
+		m.rejectedOrigins,
+		m.authFailures,
+		m.upgradeErrors,
+		m.forwardConnections,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// sessionCounters are the counters of a session, with its labels, so the frames don't look them
+// up again (see sessionStarted)
+type sessionCounters struct {
+	in, out directionCounters
+}
+
+type directionCounters struct {
+	frames    prometheus.Counter
+	bytes     prometheus.Counter
+	frameSize prometheus.Observer
+}
+
+func (m *gatewayMetrics) directionCounters(backend string, direction string) directionCounters {
+	return directionCounters{
+		frames:    m.frames.WithLabelValues(backend, direction),
+		bytes:     m.bytes.WithLabelValues(backend, direction),
+		frameSize: m.frameSize.WithLabelValues(backend, direction),
+	}
+}
+
+func (m *gatewayMetrics) sessionStarted(s *session) {
+	m.sessions.WithLabelValues(s.Backend).Inc()
+	m.activeSessions.WithLabelValues(s.Backend).Inc()
+	s.counters = &sessionCounters{
+		in:  m.directionCounters(s.Backend, directionIn),
+		out: m.directionCounters(s.Backend, directionOut),
+	}
+}
+
+func (m *gatewayMetrics) sessionEnded(s *session) {
+	m.activeSessions.WithLabelValues(s.Backend).Dec()
+	reason, _ := s.endReason()
+	m.sessionsEnded.WithLabelValues(s.Backend, reason).Inc()
+}
+
+func (m *gatewayMetrics) sessionResumed(s *session) {
+	m.sessionsResumed.WithLabelValues(s.Backend).Inc()
+}
+
+// frame counts a frame of a session, once the session has started
+func (m *gatewayMetrics) frame(s *session, direction string, frame []byte) {
+	if s.counters == nil {
+		return
+	}
+	counters := &s.counters.in
+	if direction == directionOut {
+		counters = &s.counters.out
+	}
+	counters.frames.Inc()
+	counters.bytes.Add(float64(len(frame)))
+	counters.frameSize.Observe(float64(len(frame)))
+}
+
+// forwardConnection counts a TCP connection opened to a simulator through a port forward
+func (m *gatewayMetrics) forwardConnection(s *session, local string) {
+	m.forwardConnections.WithLabelValues(s.Backend, local).Inc()
+}
+
+// compression counts a message of a session with compression: its size, and its size on the wire
+func (m *gatewayMetrics) compression(s *session, direction string, size int, compressedSize int) {
+	m.compressionBytes.WithLabelValues(s.Backend, direction, compressionStageUncompressed).Add(float64(size))
+	m.compressionBytes.WithLabelValues(s.Backend, direction, compressionStageCompressed).Add(float64(compressedSize))
+}
+
+// registerMetrics serves the metrics on /metrics, with the same access rules as the API
+func registerMetrics(mux *http.ServeMux, auth *authenticator) {
+	handler := promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+	mux.HandleFunc("GET /metrics", apiOnly(auth, handler.ServeHTTP))
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestMetrics starts the test with fresh metrics
+func useTestMetrics(t *testing.T) {
+	saved := metrics
+	t.Cleanup(func() { metrics = saved })
+	metrics = newGatewayMetrics()
+}
+
+// tcpFrame is a TCP segment from the gateway (10.13.37.1:40000) to the simulator
+func tcpFrame(t *testing.T, syn bool, ack bool, dstPort layers.TCPPort) []byte {
+	return tcpSegmentFrame(t, false, net.IP{10, 13, 37, 1}, layers.TCP{SrcPort: 40000, DstPort: dstPort, SYN: syn, ACK: ack, Window: 1024})
+}
+
+// tcpSegmentFrame is a TCP segment between a remote address and the simulator (10.13.37.2). The
+// ports of tcp are the ones of the segment to the simulator, swapped when fromSim.
+func tcpSegmentFrame(t *testing.T, fromSim bool, remote net.IP, tcp layers.TCP) []byte {
+	eth := &layers.Ethernet{SrcMAC: testGatewayMAC, DstMAC: testSimMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: remote.To4(), DstIP: net.IP{10, 13, 37, 2}.To4()}
+	if fromSim {
+		eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	return serializeFrame(t, eth, ip, &tcp)
+}
+
+func TestMetrics(t *testing.T) {
+	useTestMetrics(t)
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+
+	backend := &drainBackend{}
+	mux := http.NewServeMux()
+	registerMetrics(mux, nil)
+	mux.HandleFunc("/", newWebSocketHandler(context.Background(), backend))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	name := backendName(backend)
+
+	// Rejected origin
+	_, _, _, err := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://evil.example"}})}.Dial(context.Background(), wsURL)
+	assert.Error(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.rejectedOrigins))
+
+	// A session sending a frame
+	conn := dialTestWebSocket(t, ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://wokwi.com"}})}, wsURL)
+	_, _, err = wsutil.ReadServerData(conn)
+	require.NoError(t, err)
+	frame := tcpFrame(t, true, false, 80)
+	require.NoError(t, wsutil.WriteClientBinary(conn, frame))
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.frames.WithLabelValues(name, directionIn)) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(len(frame)), testutil.ToFloat64(metrics.bytes.WithLabelValues(name, directionIn)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.activeSessions.WithLabelValues(name)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.sessions.WithLabelValues(name)))
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `wokwigw_frame_size_bytes_bucket{backend="`+name+`",direction="in",le="64"} 1`)
+	assert.Contains(t, string(body), "go_goroutines")
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.activeSessions.WithLabelValues(name)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMetricsForwardConnections(t *testing.T) {
+	useTestMetrics(t)
+	s := &session{Backend: "vsock"}
+	counter := &forwardCounter{gateway: netip.MustParseAddr(defaultGatewayAddr)}
+	counter.update([]forward{
+		{Protocol: "tcp", Local: ":9080", Remote: "10.13.37.2:80"},
+		{Protocol: "udp", Local: ":9053", Remote: "10.13.37.2:53"},
+	})
+
+	// Only the SYN of the forwarder, to the remote address of a TCP forward, opens a connection
+	counter.count(s, tcpFrame(t, true, false, 80))
+	counter.count(s, tcpFrame(t, false, true, 80))
+	counter.count(s, tcpFrame(t, true, true, 80))
+	counter.count(s, tcpFrame(t, true, false, 53))
+	counter.count(s, tcpFrame(t, true, false, 8080))
+	counter.count(s, arpFrame(t, layers.ARPRequest, testSimMAC, layers.EthernetBroadcast))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.forwardConnections.WithLabelValues("vsock", ":9080")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.forwardConnections))
+
+	// Another simulator on the network isn't the forwarder
+	counter.gateway = netip.MustParseAddr("10.13.37.3")
+	counter.count(s, tcpFrame(t, true, false, 80))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.forwardConnections.WithLabelValues("vsock", ":9080")))
+}
@@ -4,24 +4,155 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
-func checkOrigin(origin string) bool {
-	originURL, err := url.Parse(origin)
-	if err != nil {
+// defaultOriginsKeyword expands to defaultAllowedOrigins in the list of allowed origins
+const defaultOriginsKeyword = "default"
+
+var defaultAllowedOrigins = []string{
+	"https://wokwi.com",
+	"https://*.preview.wokwi.com",
+	"http://localhost",
+	"http://127.0.0.1",
+}
+
+// originRule matches the Origin header of a connection. The syntax is scheme://host[:port], where:
+//   - scheme is http, https or * (either),
+//   - host is an exact host name, *.suffix (any subdomain of suffix), or * (any host),
+//   - port is a port number or * (any). Without a port, any port is allowed.
+type originRule struct {
+	text   string
+	scheme string
+	host   string
+	suffix bool
+	port   string
+}
+
+type originPolicy struct {
+	rules []originRule
+}
+
+func parseOriginRule(text string) (originRule, error) {
+	rule := originRule{text: text}
+
+	scheme, rest, found := strings.Cut(strings.ToLower(strings.TrimSpace(text)), "://")
+	if !found {
+		return rule, fmt.Errorf("invalid origin specified (%s): missing scheme, e.g. https://%s", text, text)
+	}
+	if scheme != "http" && scheme != "https" && scheme != "*" {
+		return rule, fmt.Errorf("invalid origin specified (%s): scheme must be http, https or *", text)
+	}
+	rule.scheme = scheme
+	rest = strings.TrimSuffix(rest, "/")
+
+	host, port := rest, ""
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.HasSuffix(rest, "]") {
+		host, port = rest[:i], rest[i+1:]
+		if port != "*" {
+			if v, err := strconv.Atoi(port); err != nil || v <= 0 || v > 65535 {
+				return rule, fmt.Errorf("invalid origin specified (%s): invalid port", text)
+			}
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == "*" {
+		port = ""
+	}
+	rule.port = port
+
+	if strings.HasPrefix(host, "*.") {
+		rule.suffix = true
+		host = host[1:]
+	}
+	if host == "" || (host != "*" && strings.ContainsAny(host, "/*?#@")) {
+		return rule, fmt.Errorf("invalid origin specified (%s): invalid host", text)
+	}
+	rule.host = host
+
+	return rule, nil
+}
+
+// newOriginPolicy creates a policy from a list of rules. The "default" keyword stands for
+// the built-in list of origins (wokwi.com and localhost).
+func newOriginPolicy(rules []string) (*originPolicy, error) {
+	policy := &originPolicy{}
+	for _, text := range rules {
+		if text == defaultOriginsKeyword {
+			for _, def := range defaultAllowedOrigins {
+				rule, _ := parseOriginRule(def)
+				policy.rules = append(policy.rules, rule)
+			}
+			continue
+		}
+
+		rule, err := parseOriginRule(text)
+		if err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+func (r *originRule) matches(scheme string, host string, port string) bool {
+	if scheme != "http" && scheme != "https" {
+		return false
+	}
+	if r.scheme != "*" && r.scheme != scheme {
 		return false
 	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	switch {
+	case r.host == "*":
+		return true
+	case r.suffix:
+		return strings.HasSuffix(host, r.host)
+	default:
+		return host == r.host
+	}
+}
 
+// check returns whether the origin is allowed, and the rule that allowed it.
+func (p *originPolicy) check(origin string) (bool, string) {
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Host == "" {
+		return false, ""
+	}
+
+	scheme := strings.ToLower(originURL.Scheme)
 	host := strings.ToLower(originURL.Hostname())
-	if originURL.Scheme == "https" {
-		return host == "wokwi.com" || strings.HasSuffix(host, ".preview.wokwi.com")
+	port := originURL.Port()
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
 	}
 
-	if originURL.Scheme == "http" {
-		return host == "localhost" || host == "127.0.0.1"
+	for _, rule := range p.rules {
+		if rule.matches(scheme, host, port) {
+			return true, rule.text
+		}
 	}
+	return false, ""
+}
 
-	return false
+func checkOrigin(policy *originPolicy, origin string) bool {
+	allowed, rule := policy.check(origin)
+	if allowed {
+		logrus.WithFields(logrus.Fields{"origin": origin, "rule": rule}).Debug("origin allowed")
+	} else {
+		logrus.WithField("origin", origin).Debug("origin rejected: no matching rule")
+	}
+	return allowed
 }
@@ -8,6 +8,11 @@ import (
 )
 
 func TestCheckOrigin(t *testing.T) {
+	policy, err := newOriginPolicy([]string{defaultOriginsKeyword})
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
 		in       string
 		expected bool
@@ -22,12 +27,82 @@ func TestCheckOrigin(t *testing.T) {
 		{"http://notwokwi.com/", false},
 		{"https://notwokwi.com/", false},
 		{"invalid url", false},
+		{"", false},
 	}
 
 	for _, testCase := range tests {
-		actual := checkOrigin(testCase.in)
+		actual := checkOrigin(policy, testCase.in)
 		if actual != testCase.expected {
 			t.Errorf("should return %v instead of %v given %s", testCase.expected, actual, testCase.in)
 		}
 	}
 }
+
+func TestCheckOriginRules(t *testing.T) {
+	tests := []struct {
+		rules    []string
+		in       string
+		expected bool
+	}{
+		// exact hosts
+		{[]string{"https://tool.corp.example"}, "https://tool.corp.example", true},
+		{[]string{"https://tool.corp.example"}, "https://TOOL.corp.example:8443", true},
+		{[]string{"https://tool.corp.example"}, "http://tool.corp.example", false},
+		{[]string{"https://tool.corp.example"}, "https://other.corp.example", false},
+		{[]string{"https://tool.corp.example"}, "https://wokwi.com", false},
+
+		// wildcard suffixes
+		{[]string{"https://*.corp.example"}, "https://tool.corp.example", true},
+		{[]string{"https://*.corp.example"}, "https://a.b.corp.example", true},
+		{[]string{"https://*.corp.example"}, "https://corp.example", false},
+		{[]string{"https://*.corp.example"}, "https://notcorp.example", false},
+		{[]string{"https://*"}, "https://anything.example", true},
+		{[]string{"https://*"}, "http://anything.example", false},
+
+		// schemes
+		{[]string{"*://tool.corp.example"}, "http://tool.corp.example", true},
+		{[]string{"*://tool.corp.example"}, "https://tool.corp.example", true},
+		{[]string{"*://tool.corp.example"}, "file://tool.corp.example", false},
+
+		// ports
+		{[]string{"http://dev.local:8080"}, "http://dev.local:8080", true},
+		{[]string{"http://dev.local:8080"}, "http://dev.local:8081", false},
+		{[]string{"http://dev.local:8080"}, "http://dev.local", false},
+		{[]string{"https://dev.local:443"}, "https://dev.local", true},
+		{[]string{"http://dev.local:*"}, "http://dev.local:1234", true},
+		{[]string{"http://[::1]:8080"}, "http://[::1]:8080", true},
+		{[]string{"http://[::1]"}, "http://[::1]:3000", true},
+
+		// combined with the default list
+		{[]string{"default", "https://tool.corp.example"}, "https://wokwi.com", true},
+		{[]string{"default", "https://tool.corp.example"}, "https://tool.corp.example", true},
+		{[]string{"https://tool.corp.example"}, "http://localhost:3000", false},
+	}
+
+	for _, testCase := range tests {
+		policy, err := newOriginPolicy(testCase.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := checkOrigin(policy, testCase.in)
+		if actual != testCase.expected {
+			t.Errorf("should return %v instead of %v given %s and rules %v", testCase.expected, actual, testCase.in, testCase.rules)
+		}
+	}
+}
+
+func TestParseOriginRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"wokwi.com",
+		"ftp://wokwi.com",
+		"https://",
+		"https://wokwi.com:99999",
+		"https://wokwi.com:abc",
+		"https://wok*wi.com",
+		"https://wokwi.com/path",
+	} {
+		if _, err := parseOriginRule(rule); err == nil {
+			t.Errorf("should fail to parse %s", rule)
+		}
+	}
+}
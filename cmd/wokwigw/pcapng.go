@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	pcapngSectionHeaderBlock      = 0x0a0d0d0a
+	pcapngInterfaceBlock          = 0x00000001
+	pcapngInterfaceStatisticBlock = 0x00000005
+	pcapngEnhancedPacketBlock     = 0x00000006
+	pcapngByteOrderMagic          = 0x1a2b3c4d
+
+	pcapngOptEnd          = 0
+	pcapngOptComment      = 1
+	pcapngOptUserAppl     = 4 // section header
+	pcapngOptIfName       = 2 // interface
+	pcapngOptIfDesc       = 3 // interface
+	pcapngOptIfTsResol    = 9 // interface
+	pcapngOptEpbFlags     = 2 // enhanced packet
+	pcapngOptIsbEndTime   = 3 // interface statistics
+	pcapngOptIsbIfRecv    = 4 // interface statistics
+	pcapngLinkTypeEther   = 1
+	pcapngTsResolNanosecs = 9
+
+	// epb_flags direction, from the gateway's point of view: inbound frames come from the simulator
+	pcapngFlagInbound  = 0x1
+	pcapngFlagOutbound = 0x2
+)
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+func pcapngString(code uint16, s string) pcapngOption {
+	return pcapngOption{code: code, value: []byte(s)}
+}
+
+func pcapngUint32(code uint16, v uint32) pcapngOption {
+	return pcapngOption{code: code, value: binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func pcapngTimestamp(t time.Time) (high, low uint32) {
+	ns := uint64(t.UnixNano())
+	return uint32(ns >> 32), uint32(ns)
+}
+
+func pcapngTime(code uint16, t time.Time) pcapngOption {
+	high, low := pcapngTimestamp(t)
+	value := binary.LittleEndian.AppendUint32(nil, high)
+	return pcapngOption{code: code, value: binary.LittleEndian.AppendUint32(value, low)}
+}
+
+// pcapngWriter writes a pcapng capture with one interface per session, so Wireshark can tell the
+// simulators apart. Every block is written with a single Write, so the file stays readable while
+// the gateway is running.
+type pcapngWriter struct {
+	lock       sync.Mutex
+	w          io.Writer
+	interfaces map[string]uint32 // session ID -> interface ID
+	next       uint32
+}
+
+func newPCAPNGWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w, interfaces: make(map[string]uint32)}
+	var body bytes.Buffer
+	_ = binary.Write(&body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	_ = binary.Write(&body, binary.LittleEndian, uint16(1)) // major version
+	_ = binary.Write(&body, binary.LittleEndian, uint16(0)) // minor version
+	_ = binary.Write(&body, binary.LittleEndian, int64(-1)) // section length: unknown
+	writePCAPNGOptions(&body, pcapngString(pcapngOptUserAppl, "wokwigw "+version))
+	if err := p.writeBlock(pcapngSectionHeaderBlock, body.Bytes()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func writePCAPNGOptions(body *bytes.Buffer, options ...pcapngOption) {
+	for _, option := range options {
+		_ = binary.Write(body, binary.LittleEndian, option.code)
+		_ = binary.Write(body, binary.LittleEndian, uint16(len(option.value)))
+		body.Write(option.value)
+		body.Write(make([]byte, pcapngPadding(len(option.value))))
+	}
+	_ = binary.Write(body, binary.LittleEndian, uint32(pcapngOptEnd))
+}
+
+func pcapngPadding(n int) int {
+	return (4 - n%4) % 4
+}
+
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := p.w.Write(block)
+	return err
+}
+
+// sessionStarted adds the interface of the session, with a comment for the connection
+func (p *pcapngWriter) sessionStarted(s *session) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.interfaces[s.ID]; ok {
+		return nil
+	}
+
+	var body bytes.Buffer
+	_ = binary.Write(&body, binary.LittleEndian, uint16(pcapngLinkTypeEther))
+	_ = binary.Write(&body, binary.LittleEndian, uint16(0)) // reserved
+	_ = binary.Write(&body, binary.LittleEndian, uint32(captureSnapLen))
+	description := fmt.Sprintf("simulator at %s", s.RemoteAddr)
+	if s.Origin != "" {
+		description += fmt.Sprintf(" (%s)", s.Origin)
+	}
+	writePCAPNGOptions(&body,
+		pcapngString(pcapngOptIfName, "session "+s.ID),
+		pcapngString(pcapngOptIfDesc, description),
+		pcapngOption{code: pcapngOptIfTsResol, value: []byte{pcapngTsResolNanosecs}},
+		pcapngString(pcapngOptComment, fmt.Sprintf("session %s connected from %s at %s", s.ID, s.RemoteAddr, s.Started.Format(time.RFC3339))),
+	)
+	if err := p.writeBlock(pcapngInterfaceBlock, body.Bytes()); err != nil {
+		return err
+	}
+	p.interfaces[s.ID] = p.next
+	p.next++
+	return nil
+}
+
+// writeFrame adds a frame of the session. Direction in is from the simulator.
+func (p *pcapngWriter) writeFrame(s *session, direction string, timestamp time.Time, frame []byte) error {
+	if err := p.sessionStarted(s); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	flags := uint32(pcapngFlagOutbound)
+	if direction == directionIn {
+		flags = pcapngFlagInbound
+	}
+	high, low := pcapngTimestamp(timestamp)
+	var body bytes.Buffer
+	_ = binary.Write(&body, binary.LittleEndian, p.interfaces[s.ID])
+	_ = binary.Write(&body, binary.LittleEndian, high)
+	_ = binary.Write(&body, binary.LittleEndian, low)
+	_ = binary.Write(&body, binary.LittleEndian, uint32(len(frame))) // captured length
+	_ = binary.Write(&body, binary.LittleEndian, uint32(len(frame))) // original length
+	body.Write(frame)
+	body.Write(make([]byte, pcapngPadding(len(frame))))
+	writePCAPNGOptions(&body, pcapngUint32(pcapngOptEpbFlags, flags))
+	return p.writeBlock(pcapngEnhancedPacketBlock, body.Bytes())
+}
+
+// writeEvent adds an empty packet with a comment to the session, e.g. for a scenario step. Wireshark
+// lists it with the frames, and frame.comment selects it.
+func (p *pcapngWriter) writeEvent(s *session, timestamp time.Time, comment string) error {
+	if err := p.sessionStarted(s); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	high, low := pcapngTimestamp(timestamp)
+	var body bytes.Buffer
+	_ = binary.Write(&body, binary.LittleEndian, p.interfaces[s.ID])
+	_ = binary.Write(&body, binary.LittleEndian, high)
+	_ = binary.Write(&body, binary.LittleEndian, low)
+	_ = binary.Write(&body, binary.LittleEndian, uint32(0)) // captured length
+	_ = binary.Write(&body, binary.LittleEndian, uint32(0)) // original length
+	writePCAPNGOptions(&body, pcapngString(pcapngOptComment, comment))
+	return p.writeBlock(pcapngEnhancedPacketBlock, body.Bytes())
+}
+
+// sessionEnded adds the statistics of the session, with a comment for the disconnection
+func (p *pcapngWriter) sessionEnded(s *session) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id, ok := p.interfaces[s.ID]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	reason, _ := s.endReason()
+	high, low := pcapngTimestamp(now)
+	var body bytes.Buffer
+	_ = binary.Write(&body, binary.LittleEndian, id)
+	_ = binary.Write(&body, binary.LittleEndian, high)
+	_ = binary.Write(&body, binary.LittleEndian, low)
+	received := binary.LittleEndian.AppendUint64(nil, s.stats.framesIn.Load())
+	writePCAPNGOptions(&body,
+		pcapngString(pcapngOptComment, fmt.Sprintf("session %s disconnected after %s (%s)", s.ID, now.Sub(s.Started).Round(time.Millisecond), reason)),
+		pcapngTime(pcapngOptIsbEndTime, now),
+		pcapngOption{code: pcapngOptIsbIfRecv, value: received},
+	)
+	return p.writeBlock(pcapngInterfaceStatisticBlock, body.Bytes())
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// readPCAPNGBlocks splits a little-endian pcapng capture into its blocks
+func readPCAPNGBlocks(t *testing.T, data []byte) []pcapngBlock {
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+		length := binary.LittleEndian.Uint32(data[4:8])
+		require.LessOrEqual(t, int(length), len(data))
+		require.Equal(t, length, binary.LittleEndian.Uint32(data[length-4:length]))
+		blocks = append(blocks, pcapngBlock{blockType: binary.LittleEndian.Uint32(data[:4]), body: data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+// pcapngOptions returns the options of a block, which start at the given offset of the body
+func pcapngOptions(body []byte, offset int) map[uint16][]byte {
+	options := make(map[uint16][]byte)
+	for offset+4 <= len(body) {
+		code := binary.LittleEndian.Uint16(body[offset:])
+		length := int(binary.LittleEndian.Uint16(body[offset+2:]))
+		if code == pcapngOptEnd {
+			break
+		}
+		options[code] = body[offset+4 : offset+4+length]
+		offset += 4 + length + pcapngPadding(length)
+	}
+	return options
+}
+
+func TestPCAPNGWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := newPCAPNGWriter(&buf)
+	require.NoError(t, err)
+
+	first := &session{ID: "aaaa", RemoteAddr: "127.0.0.1:5000", Origin: "https://wokwi.com", Started: time.Now()}
+	second := &session{ID: "bbbb", RemoteAddr: "127.0.0.1:5001", Started: time.Now()}
+	require.NoError(t, writer.sessionStarted(first))
+	require.NoError(t, writer.sessionStarted(second))
+	require.NoError(t, writer.writeFrame(first, directionIn, time.Now(), []byte("from the first simulator")))
+	require.NoError(t, writer.writeFrame(second, directionOut, time.Now(), []byte("to the second")))
+	first.stats.framesIn.Add(1)
+	require.NoError(t, writer.sessionEnded(first))
+
+	// Wireshark's view
+	reader, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	data, ci, err := reader.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("from the first simulator"), data)
+	assert.Equal(t, 0, ci.InterfaceIndex)
+	data, ci, err = reader.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("to the second"), data)
+	assert.Equal(t, 1, ci.InterfaceIndex)
+	assert.Equal(t, 2, reader.NInterfaces())
+	intf, err := reader.Interface(0)
+	require.NoError(t, err)
+	assert.Equal(t, "session aaaa", intf.Name)
+	assert.Equal(t, "simulator at 127.0.0.1:5000 (https://wokwi.com)", intf.Description)
+	assert.Equal(t, layers.LinkTypeEthernet, intf.LinkType)
+
+	// What gopacket doesn't parse: the direction flags and the comments
+	blocks := readPCAPNGBlocks(t, buf.Bytes())
+	require.Len(t, blocks, 6)
+	assert.Equal(t, uint32(pcapngSectionHeaderBlock), blocks[0].blockType)
+
+	assert.Equal(t, uint32(pcapngInterfaceBlock), blocks[1].blockType)
+	assert.Contains(t, string(pcapngOptions(blocks[1].body, 8)[pcapngOptComment]), "session aaaa connected from 127.0.0.1:5000")
+
+	epbFlags := func(block pcapngBlock) uint32 {
+		require.Equal(t, uint32(pcapngEnhancedPacketBlock), block.blockType)
+		length := int(binary.LittleEndian.Uint32(block.body[12:16]))
+		flags := pcapngOptions(block.body, 20+length+pcapngPadding(length))[pcapngOptEpbFlags]
+		require.Len(t, flags, 4)
+		return binary.LittleEndian.Uint32(flags)
+	}
+	assert.Equal(t, uint32(pcapngFlagInbound), epbFlags(blocks[3]))
+	assert.Equal(t, uint32(pcapngFlagOutbound), epbFlags(blocks[4]))
+
+	assert.Equal(t, uint32(pcapngInterfaceStatisticBlock), blocks[5].blockType)
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(blocks[5].body[:4]))
+	options := pcapngOptions(blocks[5].body, 12)
+	assert.Contains(t, string(options[pcapngOptComment]), "session aaaa disconnected")
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(options[pcapngOptIsbIfRecv]))
+}
+
+func TestCaptureFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	hub := newCaptureHub()
+	require.NoError(t, hub.openFile(path, captureFileOptions{}))
+
+	s := &session{ID: "cccc", RemoteAddr: "127.0.0.1:5002", Started: time.Now()}
+	hub.sessionStarted(s)
+	hub.capture(s, directionIn, []byte{1, 2, 3})
+	hub.capture(s, directionOut, []byte{4, 5, 6, 7, 8})
+	hub.sessionEnded(s)
+	hub.stop()
+	hub.capture(s, directionIn, []byte{9})
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	blocks := readPCAPNGBlocks(t, data)
+	types := make([]uint32, len(blocks))
+	for i, block := range blocks {
+		types[i] = block.blockType
+	}
+	assert.Equal(t, []uint32{
+		pcapngSectionHeaderBlock,
+		pcapngInterfaceBlock,
+		pcapngEnhancedPacketBlock,
+		pcapngEnhancedPacketBlock,
+		pcapngInterfaceStatisticBlock,
+	}, types)
+}
@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/sirupsen/logrus"
+)
+
+// A page reload or a network blip drops the WebSocket of the simulator. Rather than ending the
+// session, the gateway keeps it for --resumeWindow: the aloha message carries a resume token, and
+// the simulator that reconnects with it (?resume=<token>) gets the same session back. The backend
+// doesn't see the outage, so the simulated device keeps its attachment to the virtual network (the
+// switch port, the LAN MAC address, the isolated network and its forwards) and its DHCP lease, and
+// the TCP connections through the forwards survive, like they would survive a lost Wi-Fi signal.
+
+// resumeTokenSize is the size of the resume tokens, in bytes. Like the auth tokens, they can't be
+// guessed: anyone who has the token of a session can take it over.
+const resumeTokenSize = 16
+
+func newResumeToken() string {
+	buf := make([]byte, resumeTokenSize)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// resumedConn is the connection of a simulator that reconnected to its session
+type resumedConn struct {
+	conn       net.Conn
+	reader     io.Reader // conn, through the read buffer of the WebSocket upgrade
+	remoteAddr string
+}
+
+// enableResume gives the session a resume token, so the simulator can reconnect for window
+// after its connection fails
+func (s *session) enableResume(window time.Duration) {
+	if window <= 0 {
+		return
+	}
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	s.resumeToken = newResumeToken()
+	s.resumeWindow = window
+	s.resumeConn = s.conn
+	s.resumeConns = make(chan resumedConn, 1)
+	s.resumeStop = make(chan struct{})
+}
+
+// aloha returns the aloha message of the session, with its resume token
+func (s *session) aloha(resumed bool) alohaMessage {
+	msg := makeAlohaMessage(version)
+	msg.ResumeToken = s.resumeToken
+	msg.Resumed = resumed
+	return msg
+}
+
+// resumable reports whether the simulator can still reconnect to the session
+func (s *session) resumable() bool {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	return s.resumeStop != nil && !s.resumeStopped
+}
+
+// resumableEnd reports whether a session that ended for reason may wait for the simulator: it's
+// gone without saying goodbye, or it's leaving the page (1001), which is what a reload does
+func resumableEnd(reason string, err error) bool {
+	switch reason {
+	case endReasonConnectionLost, endReasonTimeout:
+		return true
+	case endReasonClientClosed:
+		var closed wsutil.ClosedError
+		return errors.As(err, &closed) && closed.Code == ws.StatusGoingAway
+	}
+	return false
+}
+
+// suspend is called when the connection of the session fails. It drops the messages sent to the
+// simulator until it reconnects, and waits up to the resume window for that. It returns true once
+// the new connection is attached, and false when the session ends.
+func (s *session) suspend() bool {
+	reason, err := s.endReason()
+	if !s.resumable() || !resumableEnd(reason, err) {
+		s.stopResume()
+		return false
+	}
+
+	s.writeLock.Lock()
+	s.detached = true
+	if s.pending != nil {
+		s.pending.Reset()
+		writeBuffers.Put(s.pending)
+		s.pending = nil
+	}
+	_ = s.conn.Close()
+	s.writeLock.Unlock()
+
+	log := s.log().WithFields(logrus.Fields{"reason": reason, "resumeWindow": s.resumeWindow.String()})
+	if err != nil {
+		log = log.WithError(err)
+	}
+	log.Info("simulator disconnected, waiting for it to reconnect")
+	captures.event(s, "simulator disconnected")
+
+	timer := time.NewTimer(s.resumeWindow)
+	defer timer.Stop()
+	select {
+	case next := <-s.resumeConns:
+		s.attach(next)
+		return true
+	case <-timer.C:
+	case <-s.resumeStop:
+	}
+
+	s.stopResume()
+	// The backend's writes fail from now on, so it ends the session
+	s.writeLock.Lock()
+	s.detached = false
+	s.writeLock.Unlock()
+	return false
+}
+
+// attach switches the session to the connection of the simulator that reconnected. The aloha
+// message is the first message on the new connection.
+func (s *session) attach(next resumedConn) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.conn = next.conn
+	s.reader = next.reader
+	s.frames = nil
+	s.writeDeadline = time.Time{}
+	s.detached = false
+	s.ended.Store(nil)
+	s.resumeLock.Lock()
+	s.resumeConn = next.conn
+	s.resumeLock.Unlock()
+
+	metrics.sessionResumed(s)
+	captures.event(s, "simulator reconnected")
+	s.log().WithField("newRemoteAddr", next.remoteAddr).Info("session resumed")
+
+	data, err := json.Marshal(s.aloha(true))
+	if err != nil {
+		return
+	}
+	if frame, err := ws.CompileFrame(ws.NewTextFrame(data)); err == nil {
+		_, _ = s.writeConn(frame)
+	}
+}
+
+// resume hands the connection of a simulator that reconnected to the session, and reports whether
+// the session takes it. The previous connection may not have failed yet (e.g. after a network
+// blip, it only fails on the idle timeout): closing it makes the session wait for the new one.
+func (s *session) resume(next resumedConn) bool {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	if s.resumeStop == nil || s.resumeStopped {
+		return false
+	}
+	select {
+	case previous := <-s.resumeConns:
+		// The simulator reconnected again before the session took the previous connection
+		_ = previous.conn.Close()
+	default:
+	}
+	s.resumeConns <- next
+	_ = s.resumeConn.Close()
+	return true
+}
+
+// stopResume ends the resume window: a simulator that reconnects from now on gets a new session
+func (s *session) stopResume() {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	if s.resumeStop == nil || s.resumeStopped {
+		return
+	}
+	s.resumeStopped = true
+	close(s.resumeStop)
+	select {
+	case next := <-s.resumeConns:
+		rejectConnection(next.conn, ws.StatusGoingAway, "session-ended", "the session has ended")
+	default:
+	}
+}
+
+// disconnect closes the connection of the session, which isn't the connection given to the backend
+// after a resumption, and ends the resume window. The backends call it when the session ends on
+// their side (e.g. the TAP interface failed).
+func (s *session) disconnect() {
+	s.stopResume()
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_ = s.conn.Close()
+}
+
+// byResumeToken returns the session with the given resume token, or nil
+func (r *sessionRegistry) byResumeToken(token string) *session {
+	if token == "" {
+		return nil
+	}
+	for _, s := range r.list() {
+		s.resumeLock.Lock()
+		match := s.resumeToken != "" && subtle.ConstantTimeCompare([]byte(s.resumeToken), []byte(token)) == 1
+		s.resumeLock.Unlock()
+		if match {
+			return s
+		}
+	}
+	return nil
+}
+
+// resumeSession hands a new connection to the session it resumes, and reports whether the
+// session took it. Otherwise, the simulator gets a new session.
+func resumeSession(log *logrus.Entry, s *session, identity string, compressed bool, next resumedConn) bool {
+	switch {
+	case s == nil:
+		log.Warn("unknown or expired resume token, starting a new session")
+	case s.Identity != identity:
+		log.WithField("session", s.ID).Warn("the resume token belongs to another identity, starting a new session")
+	case s.Compression != compressed:
+		// The frame readers and writers of the session keep the compression of the first connection
+		log.WithField("session", s.ID).Warn("the compression of the session can't change on reconnect, starting a new session")
+	case !s.resume(next):
+		log.WithField("session", s.ID).Warn("the session has ended, starting a new session")
+	default:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wokwi/wokwigw/pkg/loopback"
+)
+
+// useResumeWindow sets the test flags with a resume window, and ends the sessions still waiting
+// for their simulator when the test is over
+func useResumeWindow(t *testing.T, window time.Duration) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, resumeWindow: window})
+	t.Cleanup(func() {
+		for _, s := range sessions.list() {
+			s.stopResume()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.True(t, sessions.wait(ctx), "the sessions didn't end")
+	})
+}
+
+func sessionsResumed() float64 {
+	return testutil.ToFloat64(metrics.sessionsResumed.WithLabelValues(backendName(echoBackend{})))
+}
+
+func TestSessionResume(t *testing.T) {
+	useResumeWindow(t, 5*time.Second)
+	server := newTestGateway(t, echoBackend{})
+	resumed := sessionsResumed()
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	token, s := sim.aloha.ResumeToken, sim.session
+	require.Len(t, token, 2*resumeTokenSize)
+	assert.False(t, sim.aloha.Resumed)
+	assert.Same(t, s, sessions.byResumeToken(token))
+	assert.True(t, echoFrame(t, sim.conn, testFrame(1), time.Second))
+
+	// The connection drops without a close frame, and the session waits for the simulator
+	require.NoError(t, sim.conn.Close())
+	time.Sleep(100 * time.Millisecond)
+	assert.Same(t, s, sessions.get(s.ID))
+
+	sim = dialTestSession(t, server.URL, testSessionOptions{resume: token})
+	assert.True(t, sim.aloha.Resumed)
+	assert.Equal(t, token, sim.aloha.ResumeToken)
+	assert.True(t, echoFrame(t, sim.conn, testFrame(2), time.Second))
+	assert.Same(t, s, sessions.get(s.ID))
+	assert.Equal(t, uint64(2), s.stats.framesIn.Load())
+	assert.Equal(t, resumed+1, sessionsResumed())
+
+	// A page reload closes the WebSocket with 1001 first
+	require.NoError(t, ws.WriteFrame(sim.conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "")))))
+	waitClosed(t, sim.conn, time.Second)
+	sim = dialTestSession(t, server.URL, testSessionOptions{resume: token})
+	assert.True(t, sim.aloha.Resumed)
+	assert.True(t, echoFrame(t, sim.conn, testFrame(3), time.Second))
+	assert.Equal(t, resumed+2, sessionsResumed())
+}
+
+func TestSessionResumeTakeover(t *testing.T) {
+	useResumeWindow(t, 5*time.Second)
+	server := newTestGateway(t, echoBackend{})
+
+	// After a network blip, the simulator reconnects before the gateway notices that the first
+	// connection is gone: the new connection replaces it
+	first := dialTestSession(t, server.URL, testSessionOptions{})
+	sim := dialTestSession(t, server.URL, testSessionOptions{resume: first.aloha.ResumeToken})
+	assert.True(t, sim.aloha.Resumed)
+	waitClosed(t, first.conn, time.Second)
+	assert.True(t, echoFrame(t, sim.conn, testFrame(1), time.Second))
+}
+
+func TestSessionResumeExpired(t *testing.T) {
+	useResumeWindow(t, 100*time.Millisecond)
+	server := newTestGateway(t, echoBackend{})
+	lost := sessionsEnded(endReasonConnectionLost)
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	require.NoError(t, sim.conn.Close())
+
+	// The session ends at the end of the window, for the reason the connection failed
+	require.Eventually(t, func() bool { return sessionsEnded(endReasonConnectionLost) == lost+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, sessions.get(sim.session.ID))
+
+	// And the token starts a new session
+	again := dialTestSession(t, server.URL, testSessionOptions{resume: sim.aloha.ResumeToken})
+	assert.False(t, again.aloha.Resumed)
+	assert.NotEqual(t, sim.aloha.ResumeToken, again.aloha.ResumeToken)
+}
+
+func TestSessionNotResumable(t *testing.T) {
+	useResumeWindow(t, 5*time.Second)
+	server := newTestGateway(t, echoBackend{})
+	closed := sessionsEnded(endReasonClientClosed)
+
+	// A simulator that closes the session normally is done with it
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	require.NoError(t, ws.WriteFrame(sim.conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye")))))
+	require.Eventually(t, func() bool { return sessionsEnded(endReasonClientClosed) == closed+1 }, time.Second, 10*time.Millisecond)
+	again := dialTestSession(t, server.URL, testSessionOptions{resume: sim.aloha.ResumeToken})
+	assert.False(t, again.aloha.Resumed)
+
+	// Without a resume window, there's no token
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	sim = dialTestSession(t, server.URL, testSessionOptions{})
+	assert.Empty(t, sim.aloha.ResumeToken)
+}
+
+// pipeBackend runs the forwarding loop of a backend between the session and a pipe, and hands
+// the network end of the pipe to the test
+type pipeBackend struct {
+	forward  func(ctx context.Context, s *session, network net.Conn) error
+	networks chan net.Conn
+}
+
+func (b pipeBackend) Setup(ctx context.Context) error { return nil }
+func (b pipeBackend) Cleanup() error                  { return nil }
+
+func (b pipeBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	network, gateway := loopback.Pipe(loopback.DefaultPipeBuffer)
+	b.networks <- network
+	return b.forward(ctx, s, gateway)
+}
+
+func TestSessionResumeBackendFailure(t *testing.T) {
+	for name, forward := range forwardingBackends {
+		t.Run(name, func(t *testing.T) {
+			useResumeWindow(t, 5*time.Second)
+			backend := pipeBackend{forward: forward, networks: make(chan net.Conn, 1)}
+			server := newTestGateway(t, backend)
+
+			first := dialTestSession(t, server.URL, testSessionOptions{})
+			network := <-backend.networks
+			require.NoError(t, first.conn.Close())
+			sim := dialTestSession(t, server.URL, testSessionOptions{resume: first.aloha.ResumeToken})
+			require.True(t, sim.aloha.Resumed)
+
+			// The network end fails after the resumption: the backend closes the new connection,
+			// not the one it started with
+			require.NoError(t, network.Close())
+			waitClosed(t, sim.conn, time.Second)
+			require.Eventually(t, func() bool { return sessions.get(sim.session.ID) == nil }, time.Second, 10*time.Millisecond)
+		})
+	}
+}
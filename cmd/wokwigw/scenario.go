@@ -0,0 +1,394 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/sirupsen/logrus"
+)
+
+// When the timeline of a scenario starts
+const (
+	scenarioStartSession = "session" // when every session connects, for that session
+	scenarioStartGateway = "gateway" // when the gateway starts, for all the sessions
+)
+
+var (
+	errNoScenario          = errors.New("no scenario loaded, start the gateway with --scenario")
+	errUnknownScenarioStep = errors.New("unknown scenario step")
+)
+
+// scenario is a timeline of faults (see faults.go), loaded from the --scenario file
+type scenario struct {
+	Name  string          `yaml:"name" toml:"name" json:"name,omitempty"`
+	Start string          `yaml:"start" toml:"start" json:"start"`
+	Steps []*scenarioStep `yaml:"steps" toml:"steps" json:"steps"`
+}
+
+// scenarioStep is a fault at some time of the timeline, or triggered with the API
+type scenarioStep struct {
+	Name      string `yaml:"name" toml:"name" json:"name,omitempty"`
+	At        string `yaml:"at" toml:"at" json:"at,omitempty"`
+	Action    string `yaml:"action" toml:"action" json:"action"`
+	Duration  string `yaml:"duration" toml:"duration" json:"duration,omitempty"`
+	Direction string `yaml:"direction" toml:"direction" json:"direction,omitempty"` // drop
+	Filter    string `yaml:"filter" toml:"filter" json:"filter,omitempty"`          // drop
+	Domain    string `yaml:"domain" toml:"domain" json:"domain,omitempty"`          // dns-servfail
+	Port      int    `yaml:"port" toml:"port" json:"port,omitempty"`                // tcp-reset
+	Impair    string `yaml:"impair" toml:"impair" json:"impair,omitempty"`          // impair
+	Number    int    `yaml:"-" toml:"-" json:"number,omitempty"`                    // in the scenario file, 0 when triggered with the API
+
+	at         time.Duration
+	duration   time.Duration
+	filter     *captureFilter
+	impairment *impairment
+}
+
+// loadScenario reads a YAML or TOML scenario file
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scenario file: %w", err)
+	}
+
+	sc := &scenario{}
+	if err := decodeConfigFile(path, data, sc); err != nil {
+		return nil, fmt.Errorf("error parsing scenario file %s: %w", path, err)
+	}
+	if err := sc.validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario file %s: %w", path, err)
+	}
+	return sc, nil
+}
+
+func (sc *scenario) validate() error {
+	switch sc.Start {
+	case "":
+		sc.Start = scenarioStartSession
+	case scenarioStartSession, scenarioStartGateway:
+	default:
+		return fmt.Errorf("invalid start specified (%s), use %s or %s", sc.Start, scenarioStartSession, scenarioStartGateway)
+	}
+	if len(sc.Steps) == 0 {
+		return errors.New("no steps specified")
+	}
+
+	names := make(map[string]bool)
+	for i, step := range sc.Steps {
+		if step == nil {
+			return fmt.Errorf("step %d is empty", i+1)
+		}
+		step.Number = i + 1
+		if err := step.parse(true); err != nil {
+			return err
+		}
+		if step.Name != "" {
+			if names[step.Name] {
+				return fmt.Errorf("duplicate step name %q", step.Name)
+			}
+			names[step.Name] = true
+		}
+	}
+	return nil
+}
+
+// parse checks the settings of a step. Only the steps of a scenario file have a time.
+func (st *scenarioStep) parse(timeline bool) error {
+	var err error
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("invalid scenario step %s: %s", st.label(), fmt.Sprintf(format, args...))
+	}
+
+	if st.At != "" {
+		if !timeline {
+			return invalid("at is only supported in scenario files")
+		}
+		if st.at, err = time.ParseDuration(st.At); err != nil || st.at < 0 {
+			return invalid("invalid time specified (%s)", st.At)
+		}
+	}
+
+	lasting := false
+	switch st.Action {
+	case faultDrop, faultDNSServfail, faultImpair:
+		lasting = true
+	case faultTCPReset, faultDisconnect:
+	case "":
+		return invalid("no action specified")
+	default:
+		return invalid("unknown action %q, use %s, %s, %s, %s or %s", st.Action, faultDrop, faultDNSServfail, faultTCPReset, faultImpair, faultDisconnect)
+	}
+
+	if lasting {
+		if st.duration, err = time.ParseDuration(st.Duration); err != nil || st.duration <= 0 {
+			return invalid("invalid duration specified (%s)", st.Duration)
+		}
+	} else if st.Duration != "" {
+		return invalid("%s has no duration", st.Action)
+	}
+
+	if st.Direction != "" || st.Filter != "" {
+		if st.Action != faultDrop {
+			return invalid("direction and filter are only supported by %s", faultDrop)
+		}
+		switch st.Direction {
+		case "", faultDirectionBoth, directionIn, directionOut:
+		default:
+			return invalid("invalid direction specified (%s), use %s, %s or %s", st.Direction, directionIn, directionOut, faultDirectionBoth)
+		}
+		if st.filter, err = parseCaptureFilter(st.Filter); err != nil {
+			return invalid("%s", err)
+		}
+	}
+
+	if st.Domain != "" && st.Action != faultDNSServfail {
+		return invalid("domain is only supported by %s", faultDNSServfail)
+	}
+
+	if st.Port != 0 && st.Action != faultTCPReset {
+		return invalid("port is only supported by %s", faultTCPReset)
+	}
+	if st.Port < 0 || st.Port > 65535 {
+		return invalid("invalid port specified (%d)", st.Port)
+	}
+
+	if st.Action == faultImpair {
+		if st.Impair == "" {
+			return invalid("%s requires the impairment, e.g. impair: 3g", faultImpair)
+		}
+		if st.impairment, err = parseImpairment(st.Impair); err != nil {
+			return invalid("%s", err)
+		}
+	} else if st.Impair != "" {
+		return invalid("impair is only supported by %s", faultImpair)
+	}
+	return nil
+}
+
+// label names the step in the logs and the capture comments
+func (st *scenarioStep) label() string {
+	switch {
+	case st.Name != "":
+		return st.Name
+	case st.Number > 0:
+		return "#" + strconv.Itoa(st.Number)
+	}
+	return "(on demand)"
+}
+
+func (st *scenarioStep) fields() logrus.Fields {
+	return logrus.Fields{"step": st.label(), "action": st.Action, "description": st.describe()}
+}
+
+// step finds a step by name, or by number (starting at 1)
+func (sc *scenario) step(ref string) *scenarioStep {
+	for _, step := range sc.Steps {
+		if step.Name == ref {
+			return step
+		}
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 1 && n <= len(sc.Steps) {
+		return sc.Steps[n-1]
+	}
+	return nil
+}
+
+// timeline returns the steps in the order they are due
+func (sc *scenario) timeline() []*scenarioStep {
+	steps := slices.Clone(sc.Steps)
+	slices.SortStableFunc(steps, func(a, b *scenarioStep) int {
+		return cmp.Compare(a.at, b.at)
+	})
+	return steps
+}
+
+// play runs the steps at their time, on s or on all the sessions when s is nil, until ctx is done
+func (sc *scenario) play(ctx context.Context, s *session) {
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for _, step := range sc.timeline() {
+		timer.Reset(time.Until(start.Add(step.at)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		runStep(step, s)
+	}
+}
+
+// sessionStarted starts the timeline of a new session, when the scenario has one per session.
+// The returned function stops it.
+func (sc *scenario) sessionStarted(ctx context.Context, s *session) (stop func()) {
+	if sc == nil || sc.Start != scenarioStartSession {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc.play(ctx, s)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// stepResult tells what a step was applied to
+type stepResult struct {
+	Step     *scenarioStep `json:"step"`
+	Sessions []string      `json:"sessions"`
+	Reset    int           `json:"reset,omitempty"` // TCP connections
+}
+
+// runStep applies a step to s, or to all the sessions when s is nil. The drop and dns-servfail
+// steps of all the sessions also apply to the sessions that connect while they last.
+func runStep(step *scenarioStep, s *session) stepResult {
+	targets := []*session{s}
+	if s == nil {
+		targets = sessions.list()
+	}
+	result := stepResult{Step: step, Sessions: make([]string, 0, len(targets))}
+	for _, target := range targets {
+		result.Sessions = append(result.Sessions, target.ID)
+	}
+
+	switch step.Action {
+	case faultDrop, faultDNSServfail:
+		if s == nil {
+			gatewayFaults.start(step, nil)
+		} else {
+			s.faults.start(step, s)
+		}
+	case faultImpair:
+		for _, target := range targets {
+			target.faults.start(step, target)
+		}
+	case faultTCPReset:
+		for _, target := range targets {
+			result.Reset += target.resetTCP(step.Port)
+		}
+	}
+
+	log := logrus.WithFields(step.fields())
+	if s != nil {
+		log = s.log().WithFields(step.fields())
+	}
+	if step.Action == faultTCPReset {
+		log = log.WithField("reset", result.Reset)
+	}
+	log.Info("scenario step started")
+	comment := fmt.Sprintf("scenario step %s: %s", step.label(), step.describe())
+	for _, target := range targets {
+		captures.event(target, comment)
+	}
+
+	if step.Action == faultDisconnect {
+		for _, target := range targets {
+			target.end(endReasonScenario, nil)
+			target.close(ws.StatusGoingAway, "scenario step "+step.label())
+		}
+	}
+	return result
+}
+
+// stepEnded logs the end of a drop, dns-servfail or impair step, of s or of all the sessions when
+// s is nil
+func stepEnded(step *scenarioStep, s *session) {
+	targets := []*session{s}
+	log := logrus.WithFields(step.fields())
+	if s == nil {
+		targets = sessions.list()
+	} else {
+		log = s.log().WithFields(step.fields())
+	}
+	log.Info("scenario step ended")
+	for _, target := range targets {
+		captures.event(target, fmt.Sprintf("scenario step %s ended", step.label()))
+	}
+}
+
+// scenarioStatus is the scenario and the faults in progress, as returned by the API
+type scenarioStatus struct {
+	Scenario *scenario      `json:"scenario,omitempty"`
+	Active   []*activeFault `json:"active"`
+}
+
+func currentScenarioStatus(sc *scenario, sessions *sessionRegistry) scenarioStatus {
+	status := scenarioStatus{Scenario: sc, Active: gatewayFaults.list()}
+	for _, s := range sessions.list() {
+		status.Active = append(status.Active, s.faults.list()...)
+	}
+	if status.Active == nil {
+		status.Active = []*activeFault{}
+	}
+	return status
+}
+
+// registerScenarioAPI adds the endpoints that show the scenario and trigger steps on demand
+func registerScenarioAPI(mux *http.ServeMux, sessions *sessionRegistry, apiOnly func(h http.HandlerFunc) http.HandlerFunc) {
+	// The steps triggered on demand may reset the connections opened from now on
+	scenarioAPI := func(h http.HandlerFunc) http.HandlerFunc {
+		return apiOnly(func(w http.ResponseWriter, r *http.Request) {
+			tcpTracking.Store(true)
+			h(w, r)
+		})
+	}
+
+	// run applies a step to the session given with ?session=, or to all the sessions
+	run := func(w http.ResponseWriter, r *http.Request, step *scenarioStep) {
+		var target *session
+		if id := r.URL.Query().Get("session"); id != "" {
+			if target = sessions.get(id); target == nil {
+				writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w (%s)", errUnknownSession, id))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, runStep(step, target))
+	}
+
+	mux.HandleFunc("GET /api/scenario", scenarioAPI(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, currentScenarioStatus(flags.scenario, sessions))
+	}))
+
+	mux.HandleFunc("POST /api/scenario/steps", scenarioAPI(func(w http.ResponseWriter, r *http.Request) {
+		step := &scenarioStep{}
+		if err := json.NewDecoder(r.Body).Decode(step); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		step.Number = 0
+		if err := step.parse(false); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		run(w, r, step)
+	}))
+
+	mux.HandleFunc("POST /api/scenario/steps/{step}", scenarioAPI(func(w http.ResponseWriter, r *http.Request) {
+		if flags.scenario == nil {
+			writeAPIError(w, http.StatusNotFound, errNoScenario)
+			return
+		}
+		step := flags.scenario.step(r.PathValue("step"))
+		if step == nil {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w (%s)", errUnknownScenarioStep, r.PathValue("step")))
+			return
+		}
+		run(w, r, step)
+	}))
+}
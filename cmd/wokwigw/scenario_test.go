@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testYAMLScenario = `
+name: broker outage
+steps:
+  - at: 60s
+    action: tcp-reset
+    port: 8883
+  - name: outage
+    at: 10s
+    action: drop
+    duration: 5s
+  - at: 30s
+    action: dns-servfail
+    domain: example.com
+    duration: 20s
+  - at: 90s
+    action: impair
+    impair: satellite
+    duration: 1m
+`
+
+const testTOMLScenario = `
+start = "gateway"
+
+[[steps]]
+at = "1s"
+action = "drop"
+direction = "out"
+filter = "tcp port 8883"
+duration = "500ms"
+
+[[steps]]
+at = "2s"
+action = "disconnect"
+`
+
+func TestLoadScenario(t *testing.T) {
+	sc, err := loadScenario(writeConfigFile(t, "scenario.yaml", testYAMLScenario))
+	require.NoError(t, err)
+	assert.Equal(t, "broker outage", sc.Name)
+	assert.Equal(t, scenarioStartSession, sc.Start)
+
+	var order []string
+	for _, step := range sc.timeline() {
+		order = append(order, step.label())
+	}
+	assert.Equal(t, []string{"outage", "#3", "#1", "#4"}, order)
+	assert.Equal(t, sc.Steps[1], sc.step("outage"))
+	assert.Equal(t, sc.Steps[2], sc.step("3"))
+	assert.Nil(t, sc.step("5"))
+	assert.Equal(t, "drop all frames for 5s", sc.Steps[1].describe())
+	assert.Equal(t, "fail the DNS queries for example.com for 20s", sc.Steps[2].describe())
+	assert.Equal(t, "reset the TCP connections of port 8883", sc.Steps[0].describe())
+	assert.Equal(t, time.Minute, sc.Steps[3].duration)
+	assert.NotNil(t, sc.Steps[3].impairment)
+
+	sc, err = loadScenario(writeConfigFile(t, "scenario.toml", testTOMLScenario))
+	require.NoError(t, err)
+	assert.Equal(t, scenarioStartGateway, sc.Start)
+	assert.Equal(t, `drop the frames to the simulator matching "tcp port 8883" for 500ms`, sc.Steps[0].describe())
+	assert.Equal(t, "disconnect the simulator", sc.Steps[1].describe())
+}
+
+func TestLoadScenarioErrors(t *testing.T) {
+	tcs := map[string]struct {
+		name    string
+		content string
+		err     string
+	}{
+		"unknown key":        {"s.yaml", "steps: [{at: 1s, action: drop, duration: 1s, length: 2}]\n", "field length not found"},
+		"no steps":           {"s.yaml", "name: empty\n", "no steps specified"},
+		"invalid start":      {"s.toml", "start = \"boot\"\n", "invalid start specified (boot)"},
+		"unknown action":     {"s.yaml", "steps: [{at: 1s, action: explode}]\n", "invalid scenario step #1: unknown action \"explode\""},
+		"invalid time":       {"s.yaml", "steps: [{at: soon, action: disconnect}]\n", "invalid time specified (soon)"},
+		"missing duration":   {"s.yaml", "steps: [{name: outage, action: drop}]\n", "invalid scenario step outage: invalid duration specified"},
+		"extra duration":     {"s.yaml", "steps: [{action: tcp-reset, duration: 1s}]\n", "tcp-reset has no duration"},
+		"invalid direction":  {"s.yaml", "steps: [{action: drop, duration: 1s, direction: up}]\n", "invalid direction specified (up)"},
+		"invalid filter":     {"s.yaml", "steps: [{action: drop, duration: 1s, filter: tcp port}]\n", "invalid capture filter specified"},
+		"misplaced filter":   {"s.yaml", "steps: [{action: disconnect, filter: tcp}]\n", "only supported by drop"},
+		"misplaced port":     {"s.yaml", "steps: [{action: drop, duration: 1s, port: 80}]\n", "port is only supported by tcp-reset"},
+		"invalid port":       {"s.yaml", "steps: [{action: tcp-reset, port: 70000}]\n", "invalid port specified (70000)"},
+		"missing impairment": {"s.yaml", "steps: [{action: impair, duration: 1s}]\n", "impair requires the impairment"},
+		"invalid impairment": {"s.yaml", "steps: [{action: impair, duration: 1s, impair: 5g}]\n", "invalid impairment specified (5g)"},
+		"duplicate name":     {"s.yaml", "steps: [{name: a, action: disconnect}, {name: a, action: disconnect}]\n", "duplicate step name \"a\""},
+		"unsupported format": {"s.json", "{}", "unsupported config file format"},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadScenario(writeConfigFile(t, tc.name, tc.content))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+// echoFrame sends a frame and returns true when the echo comes back in time
+func echoFrame(t *testing.T, conn net.Conn, frame []byte, timeout time.Duration) bool {
+	require.NoError(t, wsutil.WriteClientBinary(conn, frame))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(timeout)))
+	defer conn.SetReadDeadline(time.Time{})
+	echo, _, err := wsutil.ReadServerData(conn)
+	if err != nil {
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		require.True(t, netErr.Timeout())
+		return false
+	}
+	assert.Equal(t, frame, echo)
+	return true
+}
+
+func TestScenarioTimeline(t *testing.T) {
+	path := writeConfigFile(t, "scenario.yaml", `
+steps:
+  - name: outage
+    at: 200ms
+    action: drop
+    duration: 500ms
+  - at: 1s
+    action: disconnect
+`)
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, scenarioFile: path})
+	captures.startRing(1 << 20)
+	t.Cleanup(captures.stop)
+	server := newTestGateway(t, echoBackend{})
+
+	start := time.Now()
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	conn, id := sim.conn, sim.session.ID
+	assert.True(t, echoFrame(t, conn, testFrame(1), time.Second))
+
+	time.Sleep(time.Until(start.Add(350 * time.Millisecond)))
+	assert.False(t, echoFrame(t, conn, testFrame(2), 200*time.Millisecond), "dropped during the outage")
+
+	time.Sleep(time.Until(start.Add(800 * time.Millisecond)))
+	assert.True(t, echoFrame(t, conn, testFrame(3), time.Second))
+
+	// The disconnect step closes the connection
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err := wsutil.ReadServerData(conn)
+	assert.Error(t, err)
+	require.Eventually(t, func() bool { return sessions.get(id) == nil }, time.Second, 10*time.Millisecond)
+
+	// The steps are stamped into the capture
+	var buf bytes.Buffer
+	require.NoError(t, captures.ring.Load().dump(&buf))
+	var comments []string
+	for _, block := range readPCAPNGBlocks(t, buf.Bytes()) {
+		if block.blockType == pcapngEnhancedPacketBlock && bytes.Equal(block.body[12:20], make([]byte, 8)) {
+			comments = append(comments, string(pcapngOptions(block.body, 20)[pcapngOptComment]))
+		}
+	}
+	assert.Equal(t, []string{
+		"scenario step outage: drop all frames for 500ms",
+		"scenario step outage ended",
+		"scenario step #2: disconnect the simulator",
+	}, comments)
+}
+
+func TestScenarioAPI(t *testing.T) {
+	path := writeConfigFile(t, "scenario.yaml", "steps: [{name: outage, at: 1h, action: drop, duration: 300ms}]\n")
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}, scenarioFile: path})
+	server := newTestGateway(t, echoBackend{})
+	client := newAPIClient(&flagCfg{gatewayURL: server.URL})
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	conn, id := sim.conn, sim.session.ID
+	other := dialTestSession(t, server.URL, testSessionOptions{}).conn
+
+	var result stepResult
+	require.NoError(t, client.do(http.MethodPost, "/api/scenario/steps/outage?session="+id, nil, &result))
+	assert.Equal(t, []string{id}, result.Sessions)
+	assert.False(t, echoFrame(t, conn, testFrame(1), 100*time.Millisecond))
+	assert.True(t, echoFrame(t, other, testFrame(1), time.Second), "other sessions are not affected")
+
+	var status scenarioStatus
+	require.NoError(t, client.do(http.MethodGet, "/api/scenario", nil, &status))
+	require.NotNil(t, status.Scenario)
+	assert.Len(t, status.Scenario.Steps, 1)
+	if assert.Len(t, status.Active, 1) {
+		assert.Equal(t, id, status.Active[0].Session)
+		assert.Equal(t, "outage", status.Active[0].Step.Name)
+	}
+
+	// An ad-hoc step of all the sessions
+	step := scenarioStep{Action: faultDrop, Duration: "300ms", Direction: directionOut}
+	require.NoError(t, client.do(http.MethodPost, "/api/scenario/steps", step, &result))
+	assert.Len(t, result.Sessions, 2)
+	assert.False(t, echoFrame(t, other, testFrame(2), 100*time.Millisecond))
+	require.Eventually(t, func() bool {
+		var status scenarioStatus
+		require.NoError(t, client.do(http.MethodGet, "/api/scenario", nil, &status))
+		return len(status.Active) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.True(t, echoFrame(t, other, testFrame(3), time.Second))
+
+	err := client.do(http.MethodPost, "/api/scenario/steps/nope", nil, nil)
+	assert.ErrorContains(t, err, "unknown scenario step")
+	err = client.do(http.MethodPost, "/api/scenario/steps/outage?session=nope", nil, nil)
+	assert.ErrorContains(t, err, "unknown session")
+	err = client.do(http.MethodPost, "/api/scenario/steps", scenarioStep{Action: faultDrop}, nil)
+	assert.ErrorContains(t, err, "invalid duration specified")
+	err = client.do(http.MethodPost, "/api/scenario/steps", scenarioStep{Action: faultDisconnect, At: "1s"}, nil)
+	assert.ErrorContains(t, err, "only supported in scenario files")
+}
+
+func TestScenarioAPIWithoutScenario(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	server := newTestGateway(t, echoBackend{})
+	client := newAPIClient(&flagCfg{gatewayURL: server.URL})
+	useTCPTracking(t)
+	tcpTracking.Store(false)
+
+	var status scenarioStatus
+	require.NoError(t, client.do(http.MethodGet, "/api/scenario", nil, &status))
+	assert.Nil(t, status.Scenario)
+	assert.Empty(t, status.Active)
+	assert.True(t, tcpTracking.Load(), "the steps triggered from now on may reset connections")
+	err := client.do(http.MethodPost, "/api/scenario/steps/1", nil, nil)
+	assert.ErrorContains(t, err, "no scenario loaded")
+}
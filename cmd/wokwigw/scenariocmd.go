@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newScenarioCmd(flags *flagCfg) *cobra.Command {
+	scenarioCmd := &cobra.Command{
+		Use:   "scenario",
+		Short: "Show the scenario and the faults in progress of a running gateway",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var status scenarioStatus
+			if err := newAPIClient(flags).do(http.MethodGet, "/api/scenario", nil, &status); err != nil {
+				return err
+			}
+			printScenarioStatus(cmd.OutOrStdout(), status)
+			return nil
+		},
+	}
+	scenarioCmd.PersistentFlags().StringVar(&flags.gatewayURL, "gateway", flags.gatewayURL, "URL of the running gateway, or unix:/path/to/socket (default: the first --listen address)")
+	scenarioCmd.PersistentFlags().StringVar(&flags.clientToken, "token", flags.clientToken, "authentication token of the running gateway")
+
+	var sessionID string
+	var step scenarioStep
+	triggerCmd := &cobra.Command{
+		Use:   "trigger [step]",
+		Short: "Run a step of the scenario now, or the step given with --action",
+		Long: `Run a step of the scenario now, by name or number, or the step given with --action.
+
+The step applies to all the sessions, or to the one given with --session.`,
+		Example: `  wokwigw scenario trigger outage
+  wokwigw scenario trigger --action drop --duration 5s --direction in
+  wokwigw scenario trigger --action tcp-reset --port 8883 --session 1a2b3c4d`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var body any
+			path := "/api/scenario/steps"
+			switch {
+			case len(args) == 1 && step.Action != "":
+				return fmt.Errorf("give either a step of the scenario or --action")
+			case len(args) == 1:
+				path += "/" + url.PathEscape(args[0])
+			case step.Action != "":
+				body = step
+			default:
+				return fmt.Errorf("give a step of the scenario or --action")
+			}
+			if sessionID != "" {
+				path += "?session=" + url.QueryEscape(sessionID)
+			}
+
+			var result stepResult
+			if err := newAPIClient(flags).do(http.MethodPost, path, body, &result); err != nil {
+				return err
+			}
+			printStepResult(cmd.OutOrStdout(), result)
+			return nil
+		},
+	}
+	triggerCmd.Flags().StringVar(&sessionID, "session", "", "apply the step to a single session")
+	triggerCmd.Flags().StringVar(&step.Action, "action", "", "action of the step: drop, dns-servfail, tcp-reset, impair or disconnect")
+	triggerCmd.Flags().StringVar(&step.Duration, "duration", "", "how long the drop, dns-servfail and impair steps last, e.g. 5s")
+	triggerCmd.Flags().StringVar(&step.Direction, "direction", "", "frames dropped: in (from the simulator), out (to the simulator) or both")
+	triggerCmd.Flags().StringVar(&step.Filter, "filter", "", "drop only the frames matching a capture filter, e.g. \"tcp port 8883\"")
+	triggerCmd.Flags().StringVar(&step.Domain, "domain", "", "fail only the DNS queries for a domain and its subdomains")
+	triggerCmd.Flags().IntVar(&step.Port, "port", 0, "reset only the TCP connections of a port")
+	triggerCmd.Flags().StringVar(&step.Impair, "impair", "", "network impairment of the impair step, e.g. 3g")
+	scenarioCmd.AddCommand(triggerCmd)
+
+	return scenarioCmd
+}
+
+func printScenarioStatus(w io.Writer, status scenarioStatus) {
+	if sc := status.Scenario; sc != nil {
+		name := sc.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		fmt.Fprintf(w, "Scenario: %s, timeline per %s\n", name, sc.Start)
+		for _, step := range sc.Steps {
+			at := step.At
+			if at == "" {
+				at = "0s"
+			}
+			fmt.Fprintf(w, "  %-4s at %-6s %s\n", step.label(), at, step.describe())
+		}
+	} else {
+		fmt.Fprintln(w, "No scenario loaded")
+	}
+
+	if len(status.Active) == 0 {
+		fmt.Fprintln(w, "No faults in progress")
+		return
+	}
+	fmt.Fprintln(w, "Faults in progress:")
+	for _, fault := range status.Active {
+		step := fault.Step
+		target := "all sessions"
+		if fault.Session != "" {
+			target = "session " + fault.Session
+		}
+		fmt.Fprintf(w, "  %s: %s (%s, %s left)\n", step.label(), step.describe(), target, time.Until(fault.Until).Round(time.Second))
+	}
+}
+
+func printStepResult(w io.Writer, result stepResult) {
+	step := result.Step
+	fmt.Fprintf(w, "Started: %s (%d sessions)\n", step.describe(), len(result.Sessions))
+	if step.Action == faultTCPReset {
+		fmt.Fprintf(w, "%d TCP connections reset\n", result.Reset)
+	}
+}
@@ -0,0 +1,475 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/sirupsen/logrus"
+)
+
+// session is a single simulator connected through a WebSocket.
+type session struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Origin     string    `json:"origin"`
+	Device     string    `json:"device,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	Backend    string    `json:"backend"`
+	Started    time.Time `json:"started"`
+	// Compression tells whether the simulator negotiated permessage-deflate (see compression.go)
+	Compression bool `json:"compression,omitempty"`
+
+	conn         net.Conn
+	reader       io.Reader // conn, through the read buffer of the WebSocket upgrade (conn when nil)
+	frames       *frameReader
+	maxFrameSize int                        // see frames.go
+	coalesce     bool                       // see writeFrame
+	idleTimeout  time.Duration              // see keepalive.go
+	ended        atomic.Pointer[sessionEnd] // why the session ended (see end)
+	// The backend and the gateway (e.g. for control messages) write to conn concurrently
+	writeLock     sync.Mutex
+	pending       *bytes.Buffer // the messages coalesced for the next write
+	writeDeadline time.Time     // see writeConn
+	detached      bool          // the simulator is gone, and the messages sent to it are dropped (see suspend)
+	stats         sessionStats
+	lent          *[frameBufferSize]byte // the pooled buffer of the last message read (see readMessage)
+	counters      *sessionCounters       // see metrics.sessionStarted
+
+	// Resumption (see resume.go). The channels are nil when resumption is disabled.
+	resumeLock    sync.Mutex
+	resumeToken   string
+	resumeWindow  time.Duration
+	resumeConn    net.Conn         // the current connection, closed when a new one takes over
+	resumeConns   chan resumedConn // the connection of the simulator that reconnected
+	resumeStop    chan struct{}    // closed once the session can't be resumed anymore
+	resumeStopped bool
+
+	// Network impairment (see impairment.go). The links are nil when a direction isn't impaired.
+	impairLock    sync.Mutex
+	impairment    *impairment
+	impairEnded   bool
+	inLink        atomic.Pointer[impairedLink]
+	outLink       atomic.Pointer[impairedLink]
+	incomingQueue atomic.Pointer[incomingQueue]
+
+	// Scenario faults (see faults.go)
+	faults        faultSet
+	tcpConns      tcpTracker
+	networkWriter atomic.Pointer[func(frame []byte) error]
+}
+
+// incomingQueue holds the messages read from the simulator once the inbound direction is
+// impaired: a goroutine reads the WebSocket, and the frames reach readMessage() when they are due.
+type incomingQueue struct {
+	messages chan incomingMessage
+	ended    chan struct{}
+}
+
+type incomingMessage struct {
+	payload []byte
+	buffer  *[frameBufferSize]byte // the pooled buffer of the payload, nil when it isn't pooled
+	op      ws.OpCode
+	err     error
+}
+
+// sessionStats counts the Ethernet frames exchanged with the simulator
+type sessionStats struct {
+	framesIn  atomic.Uint64
+	bytesIn   atomic.Uint64
+	framesOut atomic.Uint64
+	bytesOut  atomic.Uint64
+
+	// Frames dropped because they are invalid (see frames.go)
+	invalidIn  atomic.Uint64
+	invalidOut atomic.Uint64
+}
+
+func (st *sessionStats) fields() logrus.Fields {
+	return logrus.Fields{
+		"framesIn":  st.framesIn.Load(),
+		"bytesIn":   st.bytesIn.Load(),
+		"framesOut": st.framesOut.Load(),
+		"bytesOut":  st.bytesOut.Load(),
+
+		"invalidFramesIn":  st.invalidIn.Load(),
+		"invalidFramesOut": st.invalidOut.Load(),
+	}
+}
+
+// log returns a logger with the fields that identify the session
+func (s *session) log() *logrus.Entry {
+	fields := logrus.Fields{
+		"session":    s.ID,
+		"remoteAddr": s.RemoteAddr,
+		"origin":     s.Origin,
+		"backend":    s.Backend,
+	}
+	if s.Identity != "" {
+		fields["identity"] = s.Identity
+	}
+	if s.Device != "" {
+		fields["device"] = s.Device
+	}
+	return logrus.WithFields(fields)
+}
+
+// readMessage reads the next data message from the simulator. It must be called from a single
+// goroutine, and the message is only valid until the next call: its buffer goes back to the pool.
+func (s *session) readMessage() ([]byte, ws.OpCode, error) {
+	recycleFrame(s.lent)
+	s.lent = nil
+	queue := s.incomingQueue.Load()
+	if queue == nil && s.inLink.Load() != nil {
+		queue = s.startIncomingQueue()
+	}
+	var msg incomingMessage
+	if queue != nil {
+		var ok bool
+		if msg, ok = <-queue.messages; !ok {
+			return nil, 0, net.ErrClosed
+		}
+	} else {
+		msg = s.receiveMessage()
+	}
+	s.lent = msg.buffer
+	if msg.err == nil && msg.op == ws.OpBinary {
+		// Like the frames to the simulator, after the faults and the impairment: the capture
+		// doesn't show the frames they drop
+		captures.capture(s, directionIn, msg.payload)
+	}
+	return msg.payload, msg.op, msg.err
+}
+
+// receiveMessage reads the next data message from the WebSocket. The invalid frames and the
+// frames dropped by the scenario faults are skipped; a message larger than the maximum frame size
+// closes the session. When the connection fails, it waits for the simulator to reconnect (see
+// suspend).
+func (s *session) receiveMessage() incomingMessage {
+	for {
+		if s.frames == nil {
+			reader := s.reader
+			if reader == nil {
+				reader = s.conn
+			}
+			reader = newActivityReader(reader, s.conn, s.idleTimeout)
+			s.frames = newFrameReader(reader, controlWriter{s}, s.frameLimit(), s.Compression)
+		}
+		msg, op, err := s.frames.next()
+		if err != nil {
+			reason := readEndReason(err)
+			s.end(reason, err)
+			if reason == endReasonTimeout {
+				// The simulator may still be there, just quiet
+				s.close(ws.StatusGoingAway, "idle timeout")
+			}
+		}
+		if errors.Is(err, errFrameTooLarge) {
+			s.invalidFrame(directionIn, invalidFrameTooLarge)
+			s.log().WithError(err).Warn("closing the session: the simulator sent a frame larger than the maximum frame size")
+			s.close(ws.StatusMessageTooBig, err.Error())
+			return incomingMessage{err: err}
+		}
+		if err != nil && s.suspend() {
+			// The simulator reconnected, and the session reads the new connection
+			continue
+		}
+		if err != nil {
+			return incomingMessage{err: err}
+		}
+		buffer := s.frames.buffer
+		if s.Compression {
+			wireSize := s.frames.compressedSize
+			if wireSize == 0 {
+				wireSize = len(msg)
+			}
+			metrics.compression(s, directionIn, len(msg), wireSize)
+		}
+		if op == ws.OpBinary {
+			if reason := s.checkFrame(msg); reason != "" {
+				s.invalidFrame(directionIn, reason)
+				recycleFrame(buffer)
+				continue
+			}
+			s.stats.framesIn.Add(1)
+			s.stats.bytesIn.Add(uint64(len(msg)))
+			metrics.frame(s, directionIn, msg)
+			if logrus.IsLevelEnabled(logrus.TraceLevel) {
+				s.log().WithField("size", len(msg)).Trace("frame received")
+			}
+			if s.faultFromSimulator(msg) {
+				recycleFrame(buffer)
+				continue
+			}
+		}
+		return incomingMessage{payload: msg, buffer: buffer, op: op}
+	}
+}
+
+// startIncomingQueue starts reading the WebSocket in a goroutine, so the inbound impairment can
+// delay frames without delaying the following ones. Once started, it runs until the connection
+// is closed, even when the impairment is removed.
+func (s *session) startIncomingQueue() *incomingQueue {
+	queue := &incomingQueue{
+		messages: make(chan incomingMessage, 64),
+		ended:    make(chan struct{}),
+	}
+	s.impairLock.Lock()
+	if s.impairEnded {
+		close(queue.ended)
+	}
+	s.incomingQueue.Store(queue)
+	s.impairLock.Unlock()
+
+	go func() {
+		defer close(queue.messages)
+		for {
+			msg := s.receiveMessage()
+			if msg.err == nil && msg.op == ws.OpBinary && s.impairIncoming(msg.payload) {
+				recycleFrame(msg.buffer) // the link keeps a copy
+				continue
+			}
+			if s.queueIncoming(msg) != nil || msg.err != nil {
+				return
+			}
+		}
+	}()
+	return queue
+}
+
+// impairIncoming sends a frame from the simulator through the inbound link, and returns false
+// when the inbound direction isn't impaired
+func (s *session) impairIncoming(frame []byte) bool {
+	for {
+		link := s.inLink.Load()
+		if link == nil {
+			return false
+		}
+		if err := link.send(frame); err != errImpairedLinkReplaced {
+			return true
+		}
+	}
+}
+
+func (s *session) queueIncoming(msg incomingMessage) error {
+	queue := s.incomingQueue.Load()
+	select {
+	case queue.messages <- msg:
+		return nil
+	case <-queue.ended:
+		return net.ErrClosed
+	}
+}
+
+// writeMessage sends a single message to the simulator, through the outbound link when it's impaired
+func (s *session) writeMessage(op ws.OpCode, payload []byte) error {
+	if op == ws.OpBinary {
+		return s.writeFrame(payload, false)
+	}
+	return s.sendMessage(op, payload)
+}
+
+// writeFrame sends a frame to the simulator, like writeMessage. more tells that the backend has
+// another frame to send right away: with --coalesce, the frames of a burst leave in a single write.
+// The frame isn't used once writeFrame returns, so the backends can reuse their buffer.
+func (s *session) writeFrame(frame []byte, more bool) error {
+	if s.faultToSimulator(frame) {
+		return s.flushUnless(more)
+	}
+	for link := s.outLink.Load(); link != nil; link = s.outLink.Load() {
+		if err := link.send(frame); err != errImpairedLinkReplaced {
+			if err != nil {
+				return err
+			}
+			return s.flushUnless(more)
+		}
+	}
+	return s.send(ws.OpBinary, frame, more)
+}
+
+// sendMessage sends a single message on the WebSocket
+func (s *session) sendMessage(op ws.OpCode, payload []byte) error {
+	return s.send(op, payload, false)
+}
+
+// writeBuffers hold the messages written to the WebSockets, so the header and the payload of a
+// message, or the messages of a burst, leave in a single write
+var writeBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// coalesceLimit is the most bytes of messages held for the next write
+const coalesceLimit = 64 * 1024
+
+// send writes a message on the WebSocket. With more and --coalesce, it's held in s.pending until
+// the next message that isn't followed by more.
+func (s *session) send(op ws.OpCode, payload []byte, more bool) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	buf := s.pending
+	if buf == nil {
+		buf = writeBuffers.Get().(*bytes.Buffer)
+	}
+	if s.Compression && op.IsData() {
+		scratch := writeBuffers.Get().(*bytes.Buffer)
+		hdr, data := compressedMessage(scratch, op, payload)
+		_ = ws.WriteHeader(buf, hdr)
+		buf.Write(data)
+		metrics.compression(s, directionOut, len(payload), len(data))
+		scratch.Reset()
+		writeBuffers.Put(scratch)
+	} else {
+		_ = ws.WriteHeader(buf, ws.Header{Fin: true, OpCode: op, Length: int64(len(payload))})
+		buf.Write(payload)
+	}
+	s.pending = buf
+	if !more || !s.coalesce || buf.Len() >= coalesceLimit {
+		if err := s.flushLocked(); err != nil {
+			return err
+		}
+	}
+
+	if op == ws.OpBinary {
+		s.stats.framesOut.Add(1)
+		s.stats.bytesOut.Add(uint64(len(payload)))
+		metrics.frame(s, directionOut, payload)
+		captures.capture(s, directionOut, payload)
+		if logrus.IsLevelEnabled(logrus.TraceLevel) {
+			s.log().WithField("size", len(payload)).Trace("frame sent")
+		}
+	}
+	return nil
+}
+
+// flushUnless writes the messages held by send, unless more messages follow
+func (s *session) flushUnless(more bool) error {
+	if more {
+		return nil
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.flushLocked()
+}
+
+func (s *session) flushLocked() error {
+	buf := s.pending
+	if buf == nil {
+		return nil
+	}
+	s.pending = nil
+	_, err := s.writeConn(buf.Bytes())
+	if buf.Cap() <= 2*coalesceLimit {
+		buf.Reset()
+		writeBuffers.Put(buf)
+	}
+	return err
+}
+
+// writeJSON sends v as a JSON text message
+func (s *session) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writeMessage(ws.OpText, data)
+}
+
+// close closes the connection, telling the simulator why
+func (s *session) close(status ws.StatusCode, reason string) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_ = s.flushLocked()
+	if frame, err := ws.CompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(status, reason))); err == nil {
+		_, _ = s.writeConn(frame)
+	}
+	_ = s.conn.Close()
+}
+
+type sessionRegistry struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*session),
+	}
+}
+
+func newSessionID() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// add registers a new session, assigning its ID and start time.
+func (r *sessionRegistry) add(s *session) *session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	id := newSessionID()
+	for r.sessions[id] != nil {
+		id = newSessionID()
+	}
+
+	s.ID = id
+	s.Started = time.Now()
+	r.sessions[id] = s
+	return s
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sessions, s.ID)
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ret := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Started.Before(ret[j].Started)
+	})
+	return ret
+}
+
+// wait waits until all the sessions have ended, and returns false if ctx is done first
+func (r *sessionRegistry) wait(ctx context.Context) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if len(r.list()) == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newSessionsCmd(flags *flagCfg) *cobra.Command {
+	sessionsCmd := &cobra.Command{
+		Use:   "sessions",
+		Short: "List the sessions of a running gateway",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var list []*session
+			if err := newAPIClient(flags).do(http.MethodGet, "/api/sessions", nil, &list); err != nil {
+				return err
+			}
+			for _, s := range list {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\t%s\tup %s\n", s.ID, s.RemoteAddr, s.Origin, time.Since(s.Started).Round(time.Second))
+			}
+			return nil
+		},
+	}
+	sessionsCmd.Flags().StringVar(&flags.gatewayURL, "gateway", flags.gatewayURL, "URL of the running gateway, or unix:/path/to/socket (default: the first --listen address)")
+	sessionsCmd.Flags().StringVar(&flags.clientToken, "token", flags.clientToken, "authentication token of the running gateway")
+	return sessionsCmd
+}
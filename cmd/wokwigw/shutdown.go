@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionTeardownTimeout is how long the backend gets to tear down the sessions closed at the
+// end of the grace period (e.g. isolated networks), before it's cleaned up.
+const sessionTeardownTimeout = 2 * time.Second
+
+// shutdown stops accepting new connections, tells the connected simulators that the gateway is
+// going away, waits up to gracePeriod for them to disconnect, and then cleans up the backend.
+func shutdown(server *http.Server, backend Backend, gracePeriod time.Duration) {
+	logrus.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	// Shutdown() closes the listeners right away, then waits for the API requests in progress
+	serverDone := make(chan struct{})
+	go func() {
+		_ = server.Shutdown(ctx)
+		close(serverDone)
+	}()
+
+	active := sessions.list()
+	for _, s := range active {
+		// The simulators can't reconnect anymore
+		s.stopResume()
+		if err := s.writeJSON(makeGoodbyeMessage("gateway shutting down")); err != nil {
+			s.log().WithError(err).Warn("error sending goodbye message")
+		}
+	}
+	if len(active) > 0 {
+		logrus.WithFields(logrus.Fields{"gracePeriod": gracePeriod.String(), "sessions": len(active)}).Info("waiting for the simulators to disconnect")
+	}
+
+	if !sessions.wait(ctx) {
+		for _, s := range sessions.list() {
+			s.log().Info("closing session")
+			s.end(endReasonShutdown, nil)
+			s.close(ws.StatusGoingAway, "gateway shutting down")
+		}
+		teardownCtx, cancelTeardown := context.WithTimeout(context.Background(), sessionTeardownTimeout)
+		defer cancelTeardown()
+		sessions.wait(teardownCtx)
+	}
+	<-serverDone
+
+	if err := backend.Cleanup(); err != nil {
+		logrus.WithError(err).Error("error cleaning up backend")
+	}
+	logrus.Info("shutdown complete")
+}
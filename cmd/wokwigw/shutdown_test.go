@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drainBackend keeps every connection open until the simulator closes it
+type drainBackend struct {
+	cleanups atomic.Int32
+}
+
+func (b *drainBackend) Setup(ctx context.Context) error { return nil }
+
+func (b *drainBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	defer conn.Close()
+	for {
+		if _, _, err := s.readMessage(); err != nil {
+			return nil
+		}
+	}
+}
+
+func (b *drainBackend) Cleanup() error {
+	b.cleanups.Add(1)
+	return nil
+}
+
+// idleTAPBackend bridges the sessions to a TAP interface that never receives a frame, like the
+// bridge mode with a quiet network
+type idleTAPBackend struct {
+	*drainBackend
+	ifce net.Conn
+	peer net.Conn
+}
+
+func newIdleTAPBackend(drain *drainBackend) *idleTAPBackend {
+	ifce, peer := net.Pipe()
+	return &idleTAPBackend{drainBackend: drain, ifce: ifce, peer: peer}
+}
+
+func (b *idleTAPBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	return handleWebSocketWithTAP(ctx, b.ifce, s)
+}
+
+func (b *idleTAPBackend) Cleanup() error {
+	_ = b.peer.Close()
+	return b.drainBackend.Cleanup()
+}
+
+func TestShutdown(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+
+	tcs := map[string]struct {
+		tap        bool
+		disconnect bool
+		closeCode  ws.StatusCode
+	}{
+		"simulator disconnects":               {false, true, ws.StatusNormalClosure},
+		"closed after grace period":           {false, false, ws.StatusGoingAway},
+		"idle TAP, simulator disconnects":     {true, true, ws.StatusNormalClosure},
+		"idle TAP, closed after grace period": {true, false, ws.StatusGoingAway},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			drain := &drainBackend{}
+			var backend Backend = drain
+			if tc.tap {
+				backend = newIdleTAPBackend(drain)
+			}
+			server := httptest.NewServer(newWebSocketHandler(context.Background(), backend))
+			t.Cleanup(server.Close)
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+			dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {"https://wokwi.com"}})}
+
+			conn := dialTestWebSocket(t, dialer, wsURL)
+			_, _, err := wsutil.ReadServerData(conn)
+			require.NoError(t, err)
+			require.Eventually(t, func() bool { return len(sessions.list()) == 1 }, time.Second, 10*time.Millisecond)
+
+			started := time.Now()
+			done := make(chan struct{})
+			go func() {
+				shutdown(server.Config, backend, 300*time.Millisecond)
+				close(done)
+			}()
+
+			msg, op, err := wsutil.ReadServerData(conn)
+			require.NoError(t, err)
+			assert.Equal(t, ws.OpText, op)
+			var reply goodbyeMessage
+			require.NoError(t, json.Unmarshal(msg, &reply))
+			assert.Equal(t, "goodbye", reply.Type)
+
+			if tc.disconnect {
+				require.NoError(t, ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(tc.closeCode, "")))))
+			} else {
+				_, _, err = wsutil.ReadServerData(conn)
+				var closed wsutil.ClosedError
+				if assert.ErrorAs(t, err, &closed) {
+					assert.Equal(t, tc.closeCode, closed.Code)
+				}
+			}
+
+			<-done
+			if tc.disconnect {
+				assert.Less(t, time.Since(started), 300*time.Millisecond)
+			} else {
+				// The sessions end with their connections, without the teardown timeout
+				assert.Less(t, time.Since(started), 300*time.Millisecond+sessionTeardownTimeout/2)
+			}
+			assert.Empty(t, sessions.list())
+			assert.Equal(t, int32(1), drain.cleanups.Load())
+
+			// New connections are refused
+			_, _, _, err = dialer.Dial(context.Background(), wsURL)
+			assert.Error(t, err)
+		})
+	}
+}
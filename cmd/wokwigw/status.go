@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// gatewayStatus serves the health checks and the status of the gateway. The gateway is ready once
+// the backend is set up, until it starts shutting down.
+type gatewayStatus struct {
+	backend  Backend
+	sessions *sessionRegistry
+	started  time.Time
+	ready    atomic.Bool
+}
+
+type statusResponse struct {
+	Version         string          `json:"version"`
+	GitHash         string          `json:"gitHash,omitempty"`
+	BuildTime       string          `json:"buildTime,omitempty"`
+	Protocol        string          `json:"protocol"`
+	ProtocolVersion int32           `json:"protocolVersion"`
+	Mode            string          `json:"mode"`
+	Ready           bool            `json:"ready"`
+	Started         time.Time       `json:"started"`
+	Uptime          string          `json:"uptime"`
+	Listen          []string        `json:"listen"`
+	Forwards        []forward       `json:"forwards"`
+	Sessions        []sessionStatus `json:"sessions"`
+}
+
+type sessionStatus struct {
+	*session
+	Uptime    string    `json:"uptime"`
+	FramesIn  uint64    `json:"framesIn"`
+	BytesIn   uint64    `json:"bytesIn"`
+	FramesOut uint64    `json:"framesOut"`
+	BytesOut  uint64    `json:"bytesOut"`
+	Forwards  []forward `json:"forwards,omitempty"`
+
+	InvalidFramesIn  uint64 `json:"invalidFramesIn"`
+	InvalidFramesOut uint64 `json:"invalidFramesOut"`
+}
+
+func newGatewayStatus(backend Backend, sessions *sessionRegistry) *gatewayStatus {
+	return &gatewayStatus{
+		backend:  backend,
+		sessions: sessions,
+		started:  time.Now(),
+	}
+}
+
+// register adds /healthz, /readyz and /status to mux. The health checks are public, and the status
+// has the same access rules as the API.
+func (g *gatewayStatus) register(mux *http.ServeMux, auth *authenticator) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !g.ready.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+
+	mux.HandleFunc("GET /status", apiOnly(auth, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, g.status())
+	}))
+}
+
+// requireReady rejects the requests that need the backend until it's set up
+func (g *gatewayStatus) requireReady(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.ready.Load() {
+			http.Error(w, "gateway is not ready", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (g *gatewayStatus) status() statusResponse {
+	aloha := makeAlohaMessage(version)
+	status := statusResponse{
+		Version:         version,
+		GitHash:         gitHash,
+		BuildTime:       buildTime,
+		Protocol:        aloha.Protocol,
+		ProtocolVersion: aloha.Version,
+		Mode:            backendName(g.backend),
+		Ready:           g.ready.Load(),
+		Started:         g.started,
+		Uptime:          time.Since(g.started).Round(time.Second).String(),
+		Listen:          []string{},
+		Forwards:        []forward{},
+		Sessions:        []sessionStatus{},
+	}
+	for _, endpoint := range flags.listeners {
+		status.Listen = append(status.Listen, endpoint.String())
+	}
+
+	forwarder, _ := g.backend.(Forwarder)
+	if forwarder != nil && status.Ready {
+		if forwards, err := forwarder.Forwards(""); err == nil {
+			status.Forwards = forwards
+		}
+	}
+
+	for _, s := range g.sessions.list() {
+		st := sessionStatus{
+			session:   s,
+			Uptime:    time.Since(s.Started).Round(time.Second).String(),
+			FramesIn:  s.stats.framesIn.Load(),
+			BytesIn:   s.stats.bytesIn.Load(),
+			FramesOut: s.stats.framesOut.Load(),
+			BytesOut:  s.stats.bytesOut.Load(),
+
+			InvalidFramesIn:  s.stats.invalidIn.Load(),
+			InvalidFramesOut: s.stats.invalidOut.Load(),
+		}
+		if forwarder != nil && status.Ready {
+			// Only isolated networks have per-session forwards
+			if forwards, err := forwarder.Forwards(s.ID); err == nil {
+				st.Forwards = forwards
+			}
+		}
+		status.Sessions = append(status.Sessions, st)
+	}
+	return status
+}
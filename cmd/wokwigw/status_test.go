@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	status := newGatewayStatus(nullBackend{}, newSessionRegistry())
+	mux := http.NewServeMux()
+	status.register(mux, nil)
+	mux.Handle("/", status.requireReady(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	get := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/"))
+
+	status.ready.Store(true)
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+	assert.Equal(t, http.StatusTeapot, get("/"))
+}
+
+func TestStatus(t *testing.T) {
+	cfg := defaultConfig()
+	local := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cfg.Forwards = map[string]string{local: "10.13.37.2:80"}
+	backend := NewVsockBackend(&cfg, vsockShared)
+	require.NoError(t, backend.Setup(context.Background()))
+
+	registry := newSessionRegistry()
+	s := registry.add(&session{RemoteAddr: "127.0.0.1:5000", Origin: "https://wokwi.com", Backend: "vsock"})
+	s.stats.bytesIn.Add(1500)
+
+	auth, err := newAuthenticator([]string{"ci:s3cr3t"}, "")
+	require.NoError(t, err)
+	status := newGatewayStatus(backend, registry)
+	status.ready.Store(true)
+	mux := http.NewServeMux()
+	status.register(mux, auth)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	var result statusResponse
+	assert.ErrorContains(t, newAPIClient(&flagCfg{gatewayURL: server.URL}).do(http.MethodGet, "/status", nil, &result), "missing authentication token")
+
+	var raw map[string]any
+	require.NoError(t, newAPIClient(&flagCfg{gatewayURL: server.URL, clientToken: "s3cr3t"}).do(http.MethodGet, "/status", nil, &raw))
+	assert.Equal(t, version, raw["version"])
+	assert.Equal(t, "wokwigw", raw["protocol"])
+	assert.Equal(t, float64(1), raw["protocolVersion"])
+	assert.Equal(t, "vsock", raw["mode"])
+	assert.Equal(t, true, raw["ready"])
+	assert.Equal(t, []any{map[string]any{"protocol": "tcp", "local": local, "remote": "10.13.37.2:80"}}, raw["forwards"])
+
+	sessions, ok := raw["sessions"].([]any)
+	require.True(t, ok)
+	require.Len(t, sessions, 1)
+	session := sessions[0].(map[string]any)
+	assert.Equal(t, s.ID, session["id"])
+	assert.Equal(t, "127.0.0.1:5000", session["remoteAddr"])
+	assert.Equal(t, float64(1500), session["bytesIn"])
+	assert.Equal(t, float64(0), session["framesOut"])
+	assert.Contains(t, session, "uptime")
+	assert.NotContains(t, session, "forwards")
+}
@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpTrackerLimit is the number of connections tracked for a session. The following connections
+// are not tracked, so they can't be reset, until some of the tracked ones are closed.
+const tcpTrackerLimit = 4096
+
+// tcpTracking turns the tracking on: only the scenarios reset connections, so the sessions don't
+// parse their frames until a scenario is loaded or the scenario API is used. The connections
+// opened before aren't tracked.
+var tcpTracking atomic.Bool
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpConnKey identifies a TCP connection of the simulator, whichever end opened it
+type tcpConnKey struct {
+	simIP      netip.Addr
+	remoteIP   netip.Addr
+	simPort    uint16
+	remotePort uint16
+}
+
+// tcpConn is what it takes to reset a connection: the addresses, and the next sequence number
+// each end expects (the last acknowledgment number it sent)
+type tcpConn struct {
+	simMAC      net.HardwareAddr
+	remoteMAC   net.HardwareAddr
+	simAck      uint32
+	remoteAck   uint32
+	simAcked    bool
+	remoteAcked bool
+	simFin      bool
+	remoteFin   bool
+}
+
+// tcpReset holds the frames that reset a connection on both ends
+type tcpReset struct {
+	toSimulator []byte
+	toNetwork   []byte
+}
+
+// tcpTracker follows the TCP connections of a session, as seen by the simulator, so a scenario
+// step can reset them
+type tcpTracker struct {
+	lock  sync.Mutex
+	conns map[tcpConnKey]*tcpConn
+}
+
+// tcpSegment is the part of a frame the tracker looks at
+type tcpSegment struct {
+	srcMAC, dstMAC   net.HardwareAddr
+	srcIP, dstIP     netip.Addr
+	srcPort, dstPort uint16
+	ack              uint32
+	flags            byte
+}
+
+// parseTCPSegment reads the headers of a TCP segment over IPv4 or IPv6 (without extension
+// headers). It's much cheaper than gopacket, since it runs for every frame.
+func parseTCPSegment(frame []byte) (tcpSegment, bool) {
+	var seg tcpSegment
+	if len(frame) < ethHeaderLen {
+		return seg, false
+	}
+	var tcp []byte
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case uint16(layers.EthernetTypeIPv4):
+		ip := frame[ethHeaderLen:]
+		if len(ip) < 20 || ip[9] != byte(layers.IPProtocolTCP) || binary.BigEndian.Uint16(ip[6:8])&0x1fff != 0 {
+			return seg, false
+		}
+		headerLen := int(ip[0]&0x0f) * 4
+		if headerLen < 20 || len(ip) < headerLen {
+			return seg, false
+		}
+		seg.srcIP = netip.AddrFrom4([4]byte(ip[12:16]))
+		seg.dstIP = netip.AddrFrom4([4]byte(ip[16:20]))
+		tcp = ip[headerLen:]
+	case uint16(layers.EthernetTypeIPv6):
+		ip := frame[ethHeaderLen:]
+		if len(ip) < 40 || ip[6] != byte(layers.IPProtocolTCP) {
+			return seg, false
+		}
+		seg.srcIP = netip.AddrFrom16([16]byte(ip[8:24]))
+		seg.dstIP = netip.AddrFrom16([16]byte(ip[24:40]))
+		tcp = ip[40:]
+	default:
+		return seg, false
+	}
+	if len(tcp) < 20 {
+		return seg, false
+	}
+	seg.dstMAC = net.HardwareAddr(frame[0:6])
+	seg.srcMAC = net.HardwareAddr(frame[6:12])
+	seg.srcPort = binary.BigEndian.Uint16(tcp[0:2])
+	seg.dstPort = binary.BigEndian.Uint16(tcp[2:4])
+	seg.ack = binary.BigEndian.Uint32(tcp[8:12])
+	seg.flags = tcp[13]
+	return seg, true
+}
+
+// track updates the connections with a frame. Direction in is from the simulator.
+func (t *tcpTracker) track(direction string, frame []byte) {
+	if !tcpTracking.Load() {
+		return
+	}
+	seg, ok := parseTCPSegment(frame)
+	if !ok {
+		return
+	}
+	fromSim := direction == directionIn
+	key := tcpConnKey{simIP: seg.dstIP, remoteIP: seg.srcIP, simPort: seg.dstPort, remotePort: seg.srcPort}
+	if fromSim {
+		key = tcpConnKey{simIP: seg.srcIP, remoteIP: seg.dstIP, simPort: seg.srcPort, remotePort: seg.dstPort}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn := t.conns[key]
+	if seg.flags&tcpFlagRST != 0 {
+		delete(t.conns, key)
+		return
+	}
+	if conn == nil {
+		// Only new connections are tracked, from the first SYN
+		if seg.flags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN || len(t.conns) >= tcpTrackerLimit {
+			return
+		}
+		if t.conns == nil {
+			t.conns = make(map[tcpConnKey]*tcpConn)
+		}
+		conn = &tcpConn{}
+		t.conns[key] = conn
+	}
+
+	if fromSim {
+		conn.simMAC, conn.remoteMAC = append(conn.simMAC[:0], seg.srcMAC...), append(conn.remoteMAC[:0], seg.dstMAC...)
+		if seg.flags&tcpFlagACK != 0 {
+			conn.simAck, conn.simAcked = seg.ack, true
+		}
+		conn.simFin = conn.simFin || seg.flags&tcpFlagFIN != 0
+	} else {
+		conn.simMAC, conn.remoteMAC = append(conn.simMAC[:0], seg.dstMAC...), append(conn.remoteMAC[:0], seg.srcMAC...)
+		if seg.flags&tcpFlagACK != 0 {
+			conn.remoteAck, conn.remoteAcked = seg.ack, true
+		}
+		conn.remoteFin = conn.remoteFin || seg.flags&tcpFlagFIN != 0
+	}
+	if conn.simFin && conn.remoteFin {
+		delete(t.conns, key)
+	}
+}
+
+// reset stops tracking the established connections of the given port (any port when 0), and
+// returns the frames that reset them
+func (t *tcpTracker) reset(port int) []tcpReset {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var resets []tcpReset
+	for key, conn := range t.conns {
+		if port != 0 && int(key.simPort) != port && int(key.remotePort) != port {
+			continue
+		}
+		if !conn.simAcked || !conn.remoteAcked {
+			// Not established yet: there's no sequence number the simulator would accept
+			continue
+		}
+		toSim, err := tcpResetFrame(conn.remoteMAC, conn.simMAC, key.remoteIP, key.simIP, key.remotePort, key.simPort, conn.simAck, conn.remoteAck)
+		if err != nil {
+			continue
+		}
+		toNet, err := tcpResetFrame(conn.simMAC, conn.remoteMAC, key.simIP, key.remoteIP, key.simPort, key.remotePort, conn.remoteAck, conn.simAck)
+		if err != nil {
+			continue
+		}
+		resets = append(resets, tcpReset{toSimulator: toSim, toNetwork: toNet})
+		delete(t.conns, key)
+	}
+	return resets
+}
+
+// count returns the number of connections tracked
+func (t *tcpTracker) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.conns)
+}
+
+func tcpResetFrame(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP netip.Addr, srcPort, dstPort uint16, seq, ack uint32) ([]byte, error) {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), Seq: seq, Ack: ack, RST: true, ACK: true}
+	var ip gopacket.NetworkLayer
+	if srcIP.Is4() {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP.AsSlice(), DstIP: dstIP.AsSlice()}
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: srcIP.AsSlice(), DstIP: dstIP.AsSlice()}
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip.(gopacket.SerializableLayer), tcp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	selfSignedCertFile = "cert.pem"
+	selfSignedKeyFile  = "key.pem"
+	selfSignedValidity = 5 * 365 * 24 * time.Hour
+)
+
+func (f *flagCfg) tlsEnabled() bool {
+	return f.tlsCert != "" || f.tlsSelfSigned
+}
+
+// tlsDirectory is where the self-signed certificate is kept between runs
+func (f *flagCfg) tlsDirectory() (string, error) {
+	if f.tlsDir != "" {
+		return f.tlsDir, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find a directory for the self-signed certificate, use --tls-dir: %w", err)
+	}
+	return filepath.Join(configDir, "wokwigw", "tls"), nil
+}
+
+// tlsCertFile returns the certificate the gateway serves
+func (f *flagCfg) tlsCertFile() (string, error) {
+	if f.tlsCert != "" {
+		return f.tlsCert, nil
+	}
+	dir, err := f.tlsDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, selfSignedCertFile), nil
+}
+
+// loadTLSConfig loads the certificate given with --tls-cert/--tls-key, or the self-signed
+// certificate (generating it on first run).
+func loadTLSConfig(f *flagCfg) (*tls.Config, error) {
+	certFile, keyFile := f.tlsCert, f.tlsKey
+	if f.tlsSelfSigned {
+		dir, err := f.tlsDirectory()
+		if err != nil {
+			return nil, err
+		}
+		certFile, keyFile = filepath.Join(dir, selfSignedCertFile), filepath.Join(dir, selfSignedKeyFile)
+		if err := ensureSelfSignedCert(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("error creating self-signed certificate: %w", err)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("error parsing TLS certificate: %w", err)
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// certFingerprint returns the SHA-256 fingerprint of a certificate, in the format used by browsers
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// ensureSelfSignedCert creates a self-signed certificate and its key, unless a valid pair already
+// exists. A certificate without its key, or with another key, is replaced as well.
+func ensureSelfSignedCert(certFile string, keyFile string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil && pair.Leaf != nil && time.Now().Before(pair.Leaf.NotAfter) {
+		return nil
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Wokwi IoT Gateway"}, CommonName: "wokwigw"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+
+	logrus.WithField("file", certFile).Info("self-signed TLS certificate created")
+	return nil
+}
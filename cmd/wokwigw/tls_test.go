@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	f := &flagCfg{tlsSelfSigned: true, tlsDir: dir}
+
+	tlsConfig, err := loadTLSConfig(f)
+	require.NoError(t, err)
+	leaf := tlsConfig.Certificates[0].Leaf
+	assert.Contains(t, leaf.DNSNames, "localhost")
+	assert.NoError(t, leaf.VerifyHostname("127.0.0.1"))
+	assert.Regexp(t, regexp.MustCompile(`^([0-9A-F]{2}:){31}[0-9A-F]{2}$`), certFingerprint(leaf))
+
+	info, err := os.Stat(filepath.Join(dir, selfSignedKeyFile))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// The certificate is reused on the next run
+	again, err := loadTLSConfig(f)
+	require.NoError(t, err)
+	assert.Equal(t, certFingerprint(leaf), certFingerprint(again.Certificates[0].Leaf))
+
+	// A key that doesn't match the certificate replaces both
+	otherDir := t.TempDir()
+	_, err = loadTLSConfig(&flagCfg{tlsSelfSigned: true, tlsDir: otherDir})
+	require.NoError(t, err)
+	otherKey, err := os.ReadFile(filepath.Join(otherDir, selfSignedKeyFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, selfSignedKeyFile), otherKey, 0o600))
+	again, err = loadTLSConfig(f)
+	require.NoError(t, err)
+	assert.NotEqual(t, certFingerprint(leaf), certFingerprint(again.Certificates[0].Leaf))
+}
+
+func TestTLSClient(t *testing.T) {
+	f := &flagCfg{tlsSelfSigned: true, tlsDir: t.TempDir()}
+	tlsConfig, err := loadTLSConfig(f)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []session{})
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	// The API client trusts the self-signed certificate of the gateway
+	f.gatewayURL = server.URL
+	var result []session
+	require.NoError(t, newAPIClient(f).do(http.MethodGet, "/api/sessions", nil, &result))
+
+	// ...but not another one
+	f.tlsDir = t.TempDir()
+	_, err = loadTLSConfig(f)
+	require.NoError(t, err)
+	assert.Error(t, newAPIClient(f).do(http.MethodGet, "/api/sessions", nil, &result))
+}
@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// virtualNetwork is the virtual network of gvisor-tap-vsock (see virtualnetwork.New), built from
+// its parts so it can be closed: virtualnetwork.VirtualNetwork has no Close, and its stack, with
+// the worker goroutines of the TCP protocol and the goroutines of the DNS and DHCP servers blocked
+// on the stack's listeners, would stay alive after the last session. Every isolated network would
+// leak that much.
+type virtualNetwork struct {
+	stack         *stack.Stack
+	networkSwitch *tap.Switch
+	services      http.Handler
+
+	dnsUDP  net.PacketConn
+	dnsTCP  net.Listener
+	dhcp    *dhcp.Server
+	closed  atomic.Bool
+	serving sync.WaitGroup
+}
+
+func newVirtualNetwork(config *types.Configuration) (*virtualNetwork, error) {
+	_, subnet, err := net.ParseCIDR(config.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse subnet cidr: %w", err)
+	}
+
+	ipPool := tap.NewIPPool(subnet)
+	ipPool.Reserve(net.ParseIP(config.GatewayIP), config.GatewayMacAddress)
+	for ip, mac := range config.DHCPStaticLeases {
+		ipPool.Reserve(net.ParseIP(ip), mac)
+	}
+
+	endpoint, err := tap.NewLinkEndpoint(config.Debug, config.MTU, config.GatewayMacAddress, config.GatewayIP, config.GatewayVirtualIPs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tap endpoint: %w", err)
+	}
+	networkSwitch := tap.NewSwitch(config.Debug, config.MTU)
+	endpoint.Connect(networkSwitch)
+	networkSwitch.Connect(endpoint)
+
+	n := &virtualNetwork{networkSwitch: networkSwitch}
+	if n.stack, err = newNetworkStack(config, subnet, endpoint); err != nil {
+		return nil, fmt.Errorf("cannot create network stack: %w", err)
+	}
+	if err := n.addServices(config, ipPool); err != nil {
+		n.close()
+		return nil, fmt.Errorf("cannot add network services: %w", err)
+	}
+	return n, nil
+}
+
+func newNetworkStack(config *types.Configuration, subnet *net.IPNet, endpoint stack.LinkEndpoint) (*stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	if err := s.CreateNIC(1, endpoint); err != nil {
+		s.Destroy()
+		return nil, errors.New(err.String())
+	}
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4Slice(net.ParseIP(config.GatewayIP).To4()).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		s.Destroy()
+		return nil, errors.New(err.String())
+	}
+	s.SetSpoofing(1, true)
+	s.SetPromiscuousMode(1, true)
+
+	destination, err := tcpip.NewSubnet(tcpip.AddrFromSlice(subnet.IP), tcpip.MaskFromBytes(subnet.Mask))
+	if err != nil {
+		s.Destroy()
+		return nil, err
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: destination, NIC: 1}})
+	return s, nil
+}
+
+// addServices starts the NAT forwarders, the DNS and DHCP servers and the ports forwarder, and
+// serves their APIs under /services/, like virtualnetwork.VirtualNetwork.ServicesMux
+func (n *virtualNetwork) addServices(config *types.Configuration, ipPool *tap.IPPool) error {
+	var natLock sync.Mutex
+	nat := make(map[tcpip.Address]tcpip.Address)
+	for source, destination := range config.NAT {
+		nat[tcpip.AddrFrom4Slice(net.ParseIP(source).To4())] = tcpip.AddrFrom4Slice(net.ParseIP(destination).To4())
+	}
+	n.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.TCP(n.stack, nat, &natLock).HandlePacket)
+	n.stack.SetTransportProtocolHandler(udp.ProtocolNumber, forwarder.UDP(n.stack, nat, &natLock).HandlePacket)
+
+	gateway := tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4Slice(net.ParseIP(config.GatewayIP).To4()), Port: 53}
+	dnsUDP, err := gonet.DialUDP(n.stack, &gateway, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return err
+	}
+	n.dnsUDP = dnsUDP
+	if n.dnsTCP, err = gonet.ListenTCP(n.stack, gateway, ipv4.ProtocolNumber); err != nil {
+		return err
+	}
+	dnsServer, err := dns.New(n.dnsUDP, n.dnsTCP, config.DNS)
+	if err != nil {
+		return err
+	}
+	if n.dhcp, err = dhcp.New(config, n.stack, ipPool); err != nil {
+		return err
+	}
+	n.serve("DNS", dnsServer.Serve)
+	n.serve("DNS over TCP", dnsServer.ServeTCP)
+	n.serve("DHCP", n.dhcp.Serve)
+
+	ports := forwarder.NewPortsForwarder(n.stack)
+	type exposed struct {
+		protocol types.TransportProtocol
+		local    string
+	}
+	var forwards []exposed
+	for local, remote := range config.Forwards {
+		fwd := exposed{protocol: types.TCP, local: strings.TrimPrefix(local, "udp:")}
+		if strings.HasPrefix(local, "udp:") {
+			fwd.protocol = types.UDP
+		}
+		if err := ports.Expose(fwd.protocol, fwd.local, remote); err != nil {
+			// The forwards that are already exposed listen on host ports: release them before
+			// the stack under them is destroyed
+			for _, f := range forwards {
+				_ = ports.Unexpose(f.protocol, f.local)
+			}
+			return err
+		}
+		forwards = append(forwards, fwd)
+	}
+
+	services := http.NewServeMux()
+	services.Handle("/forwarder/", http.StripPrefix("/forwarder", ports.Mux()))
+	services.Handle("/dhcp/", http.StripPrefix("/dhcp", n.dhcp.Mux()))
+	services.Handle("/dns/", http.StripPrefix("/dns", dnsServer.Mux()))
+	mux := http.NewServeMux()
+	mux.Handle("/services/", http.StripPrefix("/services", services))
+	n.services = mux
+	return nil
+}
+
+// serve runs a server of the network until the network is closed
+func (n *virtualNetwork) serve(name string, serve func() error) {
+	n.serving.Add(1)
+	go func() {
+		defer n.serving.Done()
+		if err := serve(); err != nil && !n.closed.Load() {
+			logrus.WithError(err).Errorf("%s server of the virtual network failed", name)
+		}
+	}()
+}
+
+// acceptBess attaches a connection to the switch with the BESS protocol, until it's closed
+func (n *virtualNetwork) acceptBess(ctx context.Context, conn net.Conn) error {
+	return n.networkSwitch.Accept(ctx, conn, types.BessProtocol)
+}
+
+// close stops the servers and the stack of the network. The connections attached to the switch
+// and the host ports of the forwards are closed by their owners.
+func (n *virtualNetwork) close() {
+	if !n.closed.CompareAndSwap(false, true) {
+		return
+	}
+	if n.dhcp != nil {
+		_ = n.dhcp.Underlying.Close()
+	}
+	if n.dnsTCP != nil {
+		_ = n.dnsTCP.Close()
+	}
+	if n.dnsUDP != nil {
+		_ = n.dnsUDP.Close()
+	}
+	n.serving.Wait()
+	n.stack.Destroy()
+}
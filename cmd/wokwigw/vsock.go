@@ -4,58 +4,351 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
-	"github.com/containers/gvisor-tap-vsock/pkg/virtualnetwork"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
+	"github.com/sirupsen/logrus"
 	"github.com/wokwi/wokwigw/pkg/loopback"
 )
 
+// vsockMode selects how the sessions are connected to the virtual network.
+type vsockMode int
+
+const (
+	// All the sessions are connected to a single virtual network
+	vsockShared vsockMode = iota
+	// Every session gets its own virtual network
+	vsockIsolated
+	// All the sessions are connected to a single virtual network, each with a unique MAC address
+	vsockLAN
+)
+
+func (m vsockMode) String() string {
+	switch m {
+	case vsockIsolated:
+		return "vsock-isolated"
+	case vsockLAN:
+		return "vsock-lan"
+	}
+	return "vsock"
+}
+
 type VsockBackend struct {
 	config *types.Configuration
-	vn     *virtualnetwork.VirtualNetwork
+	mode   vsockMode
+	shared *vsockNetwork
+	lan    *lanAllocator
+
+	// isolated networks, by session ID
+	networks     map[string]*vsockNetwork
+	networksLock sync.Mutex
+}
+
+// vsockNetwork is a gvisor-tap-vsock virtual network, with its services API.
+type vsockNetwork struct {
+	vn          *virtualNetwork
+	services    http.Handler
+	connections *forwardCounter
+}
+
+// forwardCounter counts the TCP connections the ports forwarder of a network opens to the
+// simulators. The forwarder dials them from the gateway address, to the remote address of a forward.
+type forwardCounter struct {
+	gateway netip.Addr
+	// The local addresses of the TCP forwards, by remote address (replaced when the forwards change)
+	forwards atomic.Pointer[map[netip.AddrPort]string]
+}
+
+// update replaces the forwards to count the connections of
+func (c *forwardCounter) update(forwards []forward) {
+	locals := make(map[netip.AddrPort]string)
+	for _, fwd := range forwards {
+		if remote, err := netip.ParseAddrPort(fwd.Remote); err == nil && fwd.Protocol == "tcp" {
+			locals[remote] = fwd.Local
+		}
+	}
+	c.forwards.Store(&locals)
+}
+
+// count counts the connection a frame to the simulator opens, if it's the SYN of a forward
+func (c *forwardCounter) count(s *session, frame []byte) {
+	forwards := c.forwards.Load()
+	if forwards == nil || len(*forwards) == 0 {
+		return
+	}
+	seg, ok := parseTCPSegment(frame)
+	if !ok || seg.flags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN || seg.srcIP != c.gateway {
+		return
+	}
+	if local, ok := (*forwards)[netip.AddrPortFrom(seg.dstIP, seg.dstPort)]; ok {
+		metrics.forwardConnection(s, local)
+	}
+}
+
+// vsockMaxFrame is the largest frame the switch sends, the size of its own read buffer
+const vsockMaxFrame = 128 * 1024
+
+var errUnknownSession = errors.New("unknown session")
+
+func NewVsockBackend(config *types.Configuration, mode vsockMode) *VsockBackend {
+	backend := &VsockBackend{
+		config:   config,
+		mode:     mode,
+		networks: make(map[string]*vsockNetwork),
+	}
+	if mode == vsockLAN {
+		backend.lan = newLANAllocator()
+	}
+	return backend
 }
 
-func NewVsockBackend(config *types.Configuration) *VsockBackend {
-	return &VsockBackend{
-		config: config,
+func newVsockNetwork(config *types.Configuration) (*vsockNetwork, error) {
+	// The gateway writes the capture file itself, with the frames of every session (see captureHub)
+	withoutCapture := *config
+	withoutCapture.CaptureFile = ""
+	vn, err := newVirtualNetwork(&withoutCapture)
+	if err != nil {
+		return nil, fmt.Errorf("error creating network %w", err)
+	}
+	gateway, _ := netip.ParseAddr(config.GatewayIP)
+	network := &vsockNetwork{
+		vn:          vn,
+		services:    vn.services,
+		connections: &forwardCounter{gateway: gateway},
 	}
+	network.updateConnections()
+	return network, nil
 }
 
 func (v *VsockBackend) Setup(ctx context.Context) error {
-	vn, err := virtualnetwork.New(v.config)
+	if v.mode == vsockIsolated {
+		// Every session gets its own network, see createIsolatedNetwork()
+		return nil
+	}
+
+	network, err := newVsockNetwork(v.config)
 	if err != nil {
-		return fmt.Errorf("error creating network %w", err)
+		return err
 	}
-	v.vn = vn
+	v.shared = network
 	return nil
 }
 
-func (v *VsockBackend) HandleConnection(ctx context.Context, conn net.Conn, remoteAddr string) error {
-	pipe1, pipe2, err := loopback.ConnLoopback()
-	if err != nil {
-		return fmt.Errorf("pipe creation failed: %w", err)
+func (v *VsockBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	network := v.shared
+	if v.mode == vsockIsolated {
+		var err error
+		network, err = v.createIsolatedNetwork(s)
+		if err != nil {
+			return err
+		}
+		defer v.destroyIsolatedNetwork(s)
 	}
+
+	// The session is attached to the switch with the BESS protocol, which reads and writes a frame
+	// at a time, so the frames don't need the length prefix of the QEMU protocol
+	pipe1, pipe2 := loopback.Pipe(loopback.DefaultPipeBuffer)
 	defer pipe1.Close()
 	defer pipe2.Close()
 
-	go v.vn.AcceptQemu(ctx, pipe1)
+	var rewriter *macRewriter
+	if v.lan != nil {
+		rewriter = v.lan.attach(s)
+		defer v.lan.detach(rewriter)
+	}
+
+	go network.vn.acceptBess(ctx, pipe1)
 
-	return handleWebSocketCommunication(ctx, conn, pipe2, remoteAddr)
+	return handleWebSocketCommunication(ctx, pipe2, s, rewriter, network.connections)
+}
+
+// createIsolatedNetwork creates a private copy of the configured network for the given session.
+// The configured forwards are exposed on a best-effort basis, since the host ports can only be
+// used by one session at a time.
+func (v *VsockBackend) createIsolatedNetwork(s *session) (*vsockNetwork, error) {
+	config := *v.config
+	config.Forwards = map[string]string{}
+
+	network, err := newVsockNetwork(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	for local, remote := range v.config.Forwards {
+		fwd := forwardFromConfig(local, remote)
+		if err := network.addForward(fwd); err != nil {
+			s.log().WithFields(logrus.Fields{"protocol": fwd.Protocol, "local": fwd.Local, "remote": fwd.Remote}).WithError(err).Warn("port forward not available")
+		}
+	}
+
+	v.networksLock.Lock()
+	v.networks[s.ID] = network
+	v.networksLock.Unlock()
+
+	s.log().Info("isolated network created")
+	return network, nil
+}
+
+// destroyIsolatedNetwork stops the network of the session, once the session is detached from it
+func (v *VsockBackend) destroyIsolatedNetwork(s *session) {
+	v.networksLock.Lock()
+	network := v.networks[s.ID]
+	delete(v.networks, s.ID)
+	v.networksLock.Unlock()
+
+	if network == nil {
+		return
+	}
+	network.close()
 }
 
 func (v *VsockBackend) Cleanup() error {
+	if v.shared != nil {
+		v.shared.close()
+	}
+	return nil
+}
+
+// network returns the network of the given session, or the shared network when sessionID is empty.
+func (v *VsockBackend) network(sessionID string) (*vsockNetwork, error) {
+	if v.mode != vsockIsolated {
+		if sessionID != "" {
+			return nil, fmt.Errorf("%w (%s): sessions share a single network", errUnknownSession, sessionID)
+		}
+		return v.shared, nil
+	}
+
+	if sessionID == "" {
+		return nil, errors.New("a session is required when every session has an isolated network")
+	}
+	v.networksLock.Lock()
+	defer v.networksLock.Unlock()
+	network, ok := v.networks[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("%w (%s)", errUnknownSession, sessionID)
+	}
+	return network, nil
+}
+
+func (v *VsockBackend) Forwards(sessionID string) ([]forward, error) {
+	network, err := v.network(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return network.forwards()
+}
+
+func (v *VsockBackend) AddForward(sessionID string, fwd forward) error {
+	network, err := v.network(sessionID)
+	if err != nil {
+		return err
+	}
+	return network.addForward(fwd)
+}
+
+func (v *VsockBackend) RemoveForward(sessionID string, fwd forward) error {
+	network, err := v.network(sessionID)
+	if err != nil {
+		return err
+	}
+	return network.removeForward(fwd)
+}
+
+// close releases the host ports of the forwards, then stops the network (see virtualNetwork)
+func (n *vsockNetwork) close() {
+	if forwards, err := n.forwards(); err == nil {
+		for _, fwd := range forwards {
+			_ = n.removeForward(fwd)
+		}
+	}
+	n.vn.close()
+}
+
+func (n *vsockNetwork) forwards() ([]forward, error) {
+	forwards := []forward{}
+	if err := n.servicesRequest(http.MethodGet, "/services/forwarder/all", nil, &forwards); err != nil {
+		return nil, err
+	}
+	sortForwards(forwards)
+	return forwards, nil
+}
+
+func (n *vsockNetwork) addForward(fwd forward) error {
+	defer n.updateConnections()
+	return n.servicesRequest(http.MethodPost, "/services/forwarder/expose", types.ExposeRequest{
+		Protocol: types.TransportProtocol(fwd.Protocol),
+		Local:    fwd.Local,
+		Remote:   fwd.Remote,
+	}, nil)
+}
+
+func (n *vsockNetwork) removeForward(fwd forward) error {
+	defer n.updateConnections()
+	return n.servicesRequest(http.MethodPost, "/services/forwarder/unexpose", types.UnexposeRequest{
+		Protocol: types.TransportProtocol(fwd.Protocol),
+		Local:    fwd.Local,
+	}, nil)
+}
+
+// updateConnections counts the connections of the forwards the network has now
+func (n *vsockNetwork) updateConnections() {
+	if forwards, err := n.forwards(); err == nil {
+		n.connections.update(forwards)
+	}
+}
+
+// servicesRequest calls the HTTP services API of gvisor-tap-vsock in-process; it's the only way
+// to reach the ports forwarder of a running virtual network.
+func (n *vsockNetwork) servicesRequest(method string, path string, body any, result any) error {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), method, path, reader)
+	if err != nil {
+		return err
+	}
+	response := &servicesResponse{header: http.Header{}, code: http.StatusOK}
+	n.services.ServeHTTP(response, req)
+	if response.code != http.StatusOK {
+		return errors.New(strings.TrimSpace(response.body.String()))
+	}
+
+	if result != nil {
+		return json.Unmarshal(response.body.Bytes(), result)
+	}
 	return nil
 }
 
-func handleWebSocketCommunication(ctx context.Context, conn net.Conn, pipe net.Conn, remoteAddr string) error {
+// servicesResponse is the response of the services API to servicesRequest
+type servicesResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *servicesResponse) Header() http.Header         { return r.header }
+func (r *servicesResponse) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *servicesResponse) WriteHeader(code int)        { r.code = code }
+
+func handleWebSocketCommunication(ctx context.Context, pipe net.Conn, s *session, rewriter *macRewriter, connections *forwardCounter) error {
 	wg := sync.WaitGroup{}
 	_, cancel := context.WithCancel(ctx)
 
@@ -63,33 +356,43 @@ func handleWebSocketCommunication(ctx context.Context, conn net.Conn, pipe net.C
 	cleanup := func() {
 		cancel()
 		// todo: need to handle errors here
-		_ = conn.Close()
+		s.disconnect()
 		_ = pipe.Close()
 		wg.Done()
 	}
 
+	// The scenario steps send frames to the network too (see session.writeToNetwork)
+	var pipeLock sync.Mutex
+	toNetwork := func(msg []byte) error {
+		if rewriter != nil {
+			rewriter.fromSimulator(msg)
+		}
+
+		pipeLock.Lock()
+		defer pipeLock.Unlock()
+		_, err := pipe.Write(msg)
+		return err
+	}
+	s.setNetworkWriter(toNetwork)
+	defer s.setNetworkWriter(nil)
+
 	go func() {
 		defer cleanup()
 
 		for {
-			msg, op, err := wsutil.ReadClientData(conn)
+			msg, op, err := s.readMessage()
 			if err != nil {
 				return
 			}
 			switch op {
 			case ws.OpBinary:
-				err := binary.Write(pipe, binary.BigEndian, uint32(len(msg)))
-				if err != nil {
-					return
-				}
-
-				_, err = pipe.Write(msg)
-				if err != nil {
+				if err := toNetwork(msg); err != nil {
+					s.end(endReasonBackendError, err)
 					return
 				}
 
 			case ws.OpText:
-				fmt.Printf("[%s] Incoming message: %v\n", remoteAddr, msg)
+				s.log().WithField("message", string(msg)).Info("text message received")
 			}
 		}
 	}()
@@ -97,20 +400,32 @@ func handleWebSocketCommunication(ctx context.Context, conn net.Conn, pipe net.C
 	go func() {
 		defer cleanup()
 
+		readBuf := make([]byte, vsockMaxFrame)
 		for {
-			var size uint32
-			err := binary.Read(pipe, binary.BigEndian, &size)
+			n, err := pipe.Read(readBuf)
 			if err != nil {
+				s.end(endReasonBackendError, err)
 				return
 			}
+			more := loopback.Buffered(pipe) > 0
+			if reason := s.checkFrame(readBuf[:n]); reason != "" {
+				s.invalidFrame(directionOut, reason)
+				if err := s.flushUnless(more); err != nil {
+					return
+				}
+				continue
+			}
 
-			buf := make([]byte, size)
-			_, err = io.ReadFull(pipe, buf[0:])
-			if err != nil {
-				return
+			frame := readBuf[:n]
+			if connections != nil {
+				connections.count(s, frame)
+			}
+			if rewriter != nil {
+				rewriter.toSimulator(frame)
 			}
 
-			err = wsutil.WriteServerBinary(conn, buf)
+			// The frames waiting in the pipe leave in the same write (with --coalesce)
+			err = s.writeFrame(frame, more)
 			if err != nil {
 				return
 			}
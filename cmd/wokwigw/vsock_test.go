@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVsockSessionFrames(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	cfg := defaultConfig()
+	cfg.Forwards = map[string]string{}
+	backend := NewVsockBackend(&cfg, vsockShared)
+	require.NoError(t, backend.Setup(context.Background()))
+	server := newTestGateway(t, backend)
+
+	conn := dialTestSession(t, server.URL, testSessionOptions{}).conn
+	defer conn.Close()
+
+	// Every frame goes through the switch on its own: ask the gateway its MAC address twice
+	simMAC := net.HardwareAddr{0x24, 0x0a, 0xc4, 0x00, 0x01, 0x10}
+	request := arpRequest(t, simMAC, net.ParseIP("10.13.37.2"), net.ParseIP(defaultGatewayAddr))
+	require.NoError(t, wsutil.WriteClientBinary(conn, request))
+	require.NoError(t, wsutil.WriteClientBinary(conn, request))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for range 2 {
+		frame, _, err := wsutil.ReadServerData(conn)
+		require.NoError(t, err)
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+		require.True(t, ok, "not an ARP frame: %x", frame)
+		assert.Equal(t, uint16(layers.ARPReply), arp.Operation)
+		assert.Equal(t, defaultGatewayMACAddr, net.HardwareAddr(arp.SourceHwAddress).String())
+		assert.Equal(t, simMAC, net.HardwareAddr(arp.DstHwAddress))
+	}
+}
+
+func TestVsockSessionResume(t *testing.T) {
+	useResumeWindow(t, 5*time.Second)
+	cfg := defaultConfig()
+	cfg.Forwards = map[string]string{}
+	backend := NewVsockBackend(&cfg, vsockIsolated)
+	require.NoError(t, backend.Setup(context.Background()))
+	server := newTestGateway(t, backend)
+
+	sim := dialTestSession(t, server.URL, testSessionOptions{})
+	s := sim.session
+	fwd := forward{Protocol: "tcp", Local: fmt.Sprintf("127.0.0.1:%d", freePort(t)), Remote: "10.13.37.2:80"}
+	require.NoError(t, backend.AddForward(s.ID, fwd))
+	network, err := backend.network(s.ID)
+	require.NoError(t, err)
+
+	// The isolated network and its forwards wait for the simulator to reconnect
+	require.NoError(t, sim.conn.Close())
+	sim = dialTestSession(t, server.URL, testSessionOptions{resume: sim.aloha.ResumeToken})
+	require.True(t, sim.aloha.Resumed)
+	require.Same(t, s, sim.session)
+	conn := sim.conn
+	resumed, err := backend.network(s.ID)
+	require.NoError(t, err)
+	assert.Same(t, network, resumed)
+	forwards, err := backend.Forwards(s.ID)
+	require.NoError(t, err)
+	assert.Contains(t, forwards, fwd)
+
+	simMAC := net.HardwareAddr{0x24, 0x0a, 0xc4, 0x00, 0x01, 0x10}
+	require.NoError(t, wsutil.WriteClientBinary(conn, arpRequest(t, simMAC, net.ParseIP("10.13.37.2"), net.ParseIP(defaultGatewayAddr))))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	frame, _, err := wsutil.ReadServerData(conn)
+	require.NoError(t, err)
+	arp, ok := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeARP).(*layers.ARP)
+	require.True(t, ok, "not an ARP frame: %x", frame)
+	assert.Equal(t, uint16(layers.ARPReply), arp.Operation)
+}
+
+func TestVsockIsolatedNetworksStop(t *testing.T) {
+	useTestFlags(t, flagCfg{allowedOrigins: []string{defaultOriginsKeyword}})
+	cfg := defaultConfig()
+	cfg.Forwards = map[string]string{}
+	backend := NewVsockBackend(&cfg, vsockIsolated)
+	require.NoError(t, backend.Setup(context.Background()))
+	server := newTestGateway(t, backend)
+
+	session := func() {
+		sim := dialTestSession(t, server.URL, testSessionOptions{})
+		conn, id := sim.conn, sim.session.ID
+		simMAC := net.HardwareAddr{0x24, 0x0a, 0xc4, 0x00, 0x01, 0x10}
+		require.NoError(t, wsutil.WriteClientBinary(conn, arpRequest(t, simMAC, net.ParseIP("10.13.37.2"), net.ParseIP(defaultGatewayAddr))))
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, _, err := wsutil.ReadServerData(conn)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		require.Eventually(t, func() bool {
+			_, err := backend.network(id)
+			return err != nil && sessions.get(id) == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Every isolated network has its own stack, with its workers and its DNS and DHCP servers:
+	// they all stop with the session
+	session()
+	baseline := runtime.NumGoroutine()
+	for range 5 {
+		session()
+	}
+	assert.Eventually(t, func() bool { return runtime.NumGoroutine() <= baseline+2 }, 5*time.Second, 20*time.Millisecond,
+		"goroutines: %d, before: %d", runtime.NumGoroutine(), baseline)
+}
+
+func TestVirtualNetworkExposeFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	cfg := defaultConfig()
+	cfg.Forwards = map[string]string{busy.Addr().String(): "10.13.37.2:80"}
+	var ports []int
+	for range 4 {
+		port := freePort(t)
+		ports = append(ports, port)
+		cfg.Forwards[fmt.Sprintf("127.0.0.1:%d", port)] = "10.13.37.2:80"
+	}
+	_, err = newVirtualNetwork(&cfg)
+	require.Error(t, err)
+
+	// The forwards exposed before the failure release their host ports
+	for _, port := range ports {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		require.NoError(t, listener.Close())
+	}
+}
+
+func arpRequest(t *testing.T, srcMAC net.HardwareAddr, srcIP, dstIP net.IP) []byte {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: srcIP.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    dstIP.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, arp))
+	return buf.Bytes()
+}
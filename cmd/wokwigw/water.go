@@ -6,26 +6,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
-	"os"
-	"sync"
-	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
-	"github.com/songgao/packets/ethernet"
+	"github.com/sirupsen/logrus"
 	"github.com/songgao/water"
 )
 
 type WaterBackend struct {
-	ifce       *water.Interface
-	config     *types.Configuration
-	pcapWriter *pcapgo.Writer
-	pcapFile   *os.File
+	ifce   *water.Interface
+	config *types.Configuration
 }
 
 func NewWaterBackend(config *types.Configuration) *WaterBackend {
@@ -41,96 +33,60 @@ func (w *WaterBackend) Setup(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error creating TAP interface: %w", err)
 	}
-	fmt.Println("Created a TAP interface with name:", ifce.Name())
+	logrus.WithField("interface", ifce.Name()).Info("TAP interface created")
 	w.ifce = ifce
-
-	// Setup PCAP file writing if capture file is specified
-	if w.config.CaptureFile != "" {
-		if err := w.setupPCAP(); err != nil {
-			return fmt.Errorf("error setting up PCAP file: %w", err)
-		}
-		fmt.Printf("PCAP capture enabled: %s\n", w.config.CaptureFile)
-	}
-
-	return nil
-}
-
-func (w *WaterBackend) setupPCAP() error {
-	file, err := os.Create(w.config.CaptureFile)
-	if err != nil {
-		return fmt.Errorf("error creating PCAP file: %w", err)
-	}
-
-	writer := pcapgo.NewWriter(file)
-	err = writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("error writing PCAP header: %w", err)
-	}
-
-	w.pcapFile = file
-	w.pcapWriter = writer
 	return nil
 }
 
-func (w *WaterBackend) writePCAP(data []byte, inbound bool) {
-	if w.pcapWriter == nil {
-		return
-	}
-
-	ci := gopacket.CaptureInfo{
-		Timestamp:     time.Now(),
-		CaptureLength: len(data),
-		Length:        len(data),
-	}
-
-	err := w.pcapWriter.WritePacket(ci, data)
-	if err != nil {
-		fmt.Printf("Error writing to PCAP file: %v\n", err)
-	}
-}
-
-func (w *WaterBackend) HandleConnection(ctx context.Context, conn net.Conn, remoteAddr string) error {
-	return handleWebSocketWithTAP(ctx, conn, w.ifce, remoteAddr, w)
+func (w *WaterBackend) HandleConnection(ctx context.Context, conn net.Conn, s *session) error {
+	return handleWebSocketWithTAP(ctx, w.ifce, s)
 }
 
 func (w *WaterBackend) Cleanup() error {
-	if w.pcapFile != nil {
-		w.pcapFile.Close()
-	}
 	if w.ifce != nil {
 		return w.ifce.Close()
 	}
 	return nil
 }
 
-func handleWebSocketWithTAP(ctx context.Context, conn net.Conn, ifce *water.Interface, remoteAddr string, backend *WaterBackend) error {
-	wg := sync.WaitGroup{}
-	_, cancel := context.WithCancel(ctx)
+func handleWebSocketWithTAP(ctx context.Context, ifce io.ReadWriter, s *session) error {
+	// The scenario steps send frames to the network too (see session.writeToNetwork)
+	s.setNetworkWriter(func(frame []byte) error {
+		_, err := ifce.Write(frame)
+		return err
+	})
+	defer s.setNetworkWriter(nil)
 
-	wg.Add(2)
-	cleanup := func() {
-		cancel()
-		_ = conn.Close()
-		wg.Done()
-	}
+	// A read from the TAP interface can't be interrupted without closing the interface, which all
+	// the sessions share. The session doesn't wait for its reader: the reader drops the next frame
+	// once the session has ended, or stops when the backend closes the interface.
+	ended := make(chan struct{})
+	defer close(ended)
 
 	// Read from TAP interface and send to websocket
 	go func() {
-		defer cleanup()
+		defer s.disconnect()
 
-		var frame ethernet.Frame
-		frame.Resize(1500)
+		// One more byte than the maximum frame size, to tell the frames that are too large
+		frame := make([]byte, s.frameLimit()+1)
 
 		for {
-			n, err := ifce.Read([]byte(frame))
+			n, err := ifce.Read(frame)
+			select {
+			case <-ended:
+				return
+			default:
+			}
 			if err != nil {
+				s.end(endReasonBackendError, err)
 				return
 			}
+			if reason := s.checkFrame(frame[:n]); reason != "" {
+				s.invalidFrame(directionOut, reason)
+				continue
+			}
 
-			backend.writePCAP(frame[:n], true)
-
-			err = wsutil.WriteServerBinary(conn, frame[:n])
+			err = s.writeMessage(ws.OpBinary, frame[:n])
 			if err != nil {
 				return
 			}
@@ -138,28 +94,21 @@ func handleWebSocketWithTAP(ctx context.Context, conn net.Conn, ifce *water.Inte
 	}()
 
 	// Read from websocket and write to TAP interface
-	go func() {
-		defer cleanup()
-
-		for {
-			msg, op, err := wsutil.ReadClientData(conn)
+	defer s.disconnect()
+	for {
+		msg, op, err := s.readMessage()
+		if err != nil {
+			return nil
+		}
+		switch op {
+		case ws.OpBinary:
+			_, err = ifce.Write(msg)
 			if err != nil {
-				return
-			}
-			switch op {
-			case ws.OpBinary:
-				backend.writePCAP(msg, false)
-
-				_, err = ifce.Write(msg)
-				if err != nil {
-					return
-				}
-			case ws.OpText:
-				fmt.Printf("[%s] Incoming message: %v\n", remoteAddr, msg)
+				s.end(endReasonBackendError, err)
+				return nil
 			}
+		case ws.OpText:
+			s.log().WithField("message", string(msg)).Info("text message received")
 		}
-	}()
-
-	wg.Wait()
-	return nil
+	}
 }
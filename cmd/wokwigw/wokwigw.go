@@ -4,15 +4,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/sirupsen/logrus"
 
@@ -25,11 +32,20 @@ var (
 	buildTime = ""
 
 	config = defaultConfig()
+
+	sessions = newSessionRegistry()
 )
 
 var flags = flagCfg{
-	listenPort:  defaultListenPort,
-	forwardList: []string{},
+	listenPort:     defaultListenPort,
+	forwardList:    []string{},
+	allowedOrigins: []string{defaultOriginsKeyword},
+	gracePeriod:    defaultGracePeriod,
+	pingInterval:   defaultPingInterval,
+	idleTimeout:    defaultIdleTimeout,
+	resumeWindow:   defaultResumeWindow,
+	logLevel:       defaultLogLevel,
+	logFormat:      logFormatText,
 }
 
 func execute() error {
@@ -49,7 +65,15 @@ wokwi IoT Gateway (ver:%s)
 `, version),
 		RunE: run,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			// You can bind cobra and viper in a few locations, but PersistencePreRunE on the root command works well
+			// Precedence (highest first): command line flags, environment variables, config file, defaults
+			if err := applyEnvironment(cmd.Flags()); err != nil {
+				return err
+			}
+			if flags.configFile != "" {
+				if err := loadConfigFile(flags.configFile, cmd.Flags(), flags, config); err != nil {
+					return err
+				}
+			}
 			return validateAndMapFlags(flags, config)
 		},
 	}
@@ -59,8 +83,41 @@ wokwi IoT Gateway (ver:%s)
 
 	f.StringSliceVar(&flags.forwardList, "forward", flags.forwardList, "forward port to the simulator. Format: [udp:]localPort:remoteAddress:remotePort tuples")
 	f.IntVar(&flags.listenPort, "listenPort", flags.listenPort, "listening port (on localhost)")
-	f.StringVar(&flags.captureFile, "captureFile", flags.captureFile, "packet capture (PCAP) file name (for debugging)")
+	f.StringSliceVar(&flags.listen, "listen", flags.listen, "listen on these addresses instead of localhost:listenPort. Format: host:port, [ipv6]:port or unix:/path/to/socket")
+	f.DurationVar(&flags.gracePeriod, "gracePeriod", flags.gracePeriod, "time to wait for the simulators to disconnect on shutdown")
+	f.StringVar(&flags.logLevel, "log-level", flags.logLevel, "log level: trace, debug, info, warn or error")
+	f.StringVar(&flags.logFormat, "log-format", flags.logFormat, "log format: text or json")
+	f.StringVar(&flags.captureFile, "captureFile", flags.captureFile, "packet capture (pcapng) file name, with one interface per session (for debugging)")
+	f.StringVar(&flags.captureMaxSize, "captureMaxSize", flags.captureMaxSize, "start a new capture file when it reaches this size, e.g. 100MB")
+	f.DurationVar(&flags.captureMaxDuration, "captureMaxDuration", flags.captureMaxDuration, "start a new capture file after this time, e.g. 1h")
+	f.IntVar(&flags.captureMaxFiles, "captureMaxFiles", flags.captureMaxFiles, "number of capture files to keep, including the current one (default: all)")
+	f.StringVar(&flags.captureFilter, "captureFilter", flags.captureFilter, "only capture the frames selected by this expression, e.g. \"tcp port 1883 or udp port 53\" (a subset of the tcpdump syntax)")
+	f.StringVar(&flags.captureRingBuffer, "captureRingBuffer", flags.captureRingBuffer, "keep the most recent frames in memory, up to this size (e.g. 64MB), to dump them with \"wokwigw capture dump\"")
 	f.BoolVar(&flags.bridge, "bridge", flags.bridge, "use bridge mode (experimental, see docs)")
+	f.BoolVar(&flags.isolate, "isolate", flags.isolate, "give every connection its own virtual network")
+	f.BoolVar(&flags.lan, "lan", flags.lan, "connect all the simulators to one virtual LAN, each with a unique MAC and IP address")
+	f.StringVar(&flags.impair, "impair", flags.impair, "impair the network of every session, e.g. 3g or \"delay=200ms,jitter=50ms,loss=2%,out.rate=1mbit\" (profiles: "+strings.Join(impairmentProfileNames(), ", ")+")")
+	f.StringVar(&flags.scenarioFile, "scenario", flags.scenarioFile, "YAML or TOML file with a timeline of network faults (drop, dns-servfail, tcp-reset, impair, disconnect)")
+	f.IntVar(&flags.maxFrameSize, "maxFrameSize", flags.maxFrameSize, "largest Ethernet frame exchanged with the simulators, in bytes; larger frames from the simulator close the session (default: the MTU plus 18)")
+	f.BoolVar(&flags.coalesce, "coalesce", flags.coalesce, "send the bursts of frames to a simulator in a single write, instead of a write per frame (vsock modes)")
+	f.DurationVar(&flags.pingInterval, "pingInterval", flags.pingInterval, "ping the simulators at this interval, to detect the ones that are gone (0 disables the pings)")
+	f.DurationVar(&flags.idleTimeout, "idleTimeout", flags.idleTimeout, "end the sessions that receive nothing from the simulator (not even a pong) for this long (0 disables the timeout)")
+	f.DurationVar(&flags.resumeWindow, "resumeWindow", flags.resumeWindow, "keep the sessions of the simulators that disconnect for this long, so they can reconnect to the same session (0 disables resumption)")
+	f.BoolVar(&flags.noCompression, "noCompression", flags.noCompression, "don't negotiate permessage-deflate compression with the simulators")
+	f.StringVar(&flags.configFile, "config", flags.configFile, "configuration file (YAML or TOML)")
+	f.StringSliceVar(&flags.authTokens, "authToken", flags.authTokens, "require clients to authenticate with this token. Format: [name:]token")
+	f.StringVar(&flags.authTokenFile, "authTokenFile", flags.authTokenFile, "require clients to authenticate with one of the tokens in this file (one [name:]token per line)")
+	f.StringVar(&flags.tlsCert, "tls-cert", flags.tlsCert, "TLS certificate file, to serve wss:// connections")
+	f.StringVar(&flags.tlsKey, "tls-key", flags.tlsKey, "TLS private key file")
+	f.BoolVar(&flags.tlsSelfSigned, "tls-self-signed", flags.tlsSelfSigned, "serve wss:// connections with a self-signed certificate, created on first run")
+	f.StringVar(&flags.tlsDir, "tls-dir", flags.tlsDir, "directory of the self-signed certificate (default: wokwigw/tls in the user config directory)")
+	f.StringSliceVar(&flags.allowedOrigins, "allowOrigin", flags.allowedOrigins, "allowed web page origins. Format: scheme://host[:port], host can start with *. (\"default\" stands for wokwi.com and localhost)")
+
+	rootCmd.AddCommand(newForwardCmd(flags))
+	rootCmd.AddCommand(newSessionsCmd(flags))
+	rootCmd.AddCommand(newCaptureCmd(flags))
+	rootCmd.AddCommand(newImpairCmd(flags))
+	rootCmd.AddCommand(newScenarioCmd(flags))
 
 	return rootCmd
 }
@@ -72,32 +129,80 @@ func validateAndMapFlags(flags *flagCfg, cfg *types.Configuration) (err error) {
 		return fmt.Errorf("bridge mode does not support port forwarding. remove the --forward flag")
 	}
 
+	if flags.bridge && flags.isolate {
+		return fmt.Errorf("bridge mode does not support isolated networks. remove the --isolate flag")
+	}
+
+	if flags.bridge && flags.lan {
+		return fmt.Errorf("bridge mode does not support the virtual LAN. remove the --lan flag")
+	}
+
+	if flags.isolate && flags.lan {
+		return fmt.Errorf("isolated networks and the virtual LAN cannot be used together. remove either --isolate or --lan")
+	}
+
 	// map command line arguments to configuration structure (forwardList)
-	// note: since we're using syntax similar to ssh -L option, we do the splitting ourselves here
 	for _, fwd := range flags.forwardList {
-		parts := strings.Split(fwd, ":")
-		prefix := ""
-		if len(parts) == 4 && parts[0] == "udp" {
-			prefix = "udp:"
-			parts = parts[1:]
-		}
-		if len(parts) != 3 {
-			return fmt.Errorf(string("arg ``%s`` is not formatted using the syntax '[udp:]localPort:addr:remotePort'"), fwd)
+		local, remote, err := parseForward(fwd)
+		if err != nil {
+			return err
 		}
+		cfg.Forwards[local] = remote
+	}
 
-		if v, e := strconv.Atoi(parts[0]); e != nil || v < 0 || v > 65535 {
-			return fmt.Errorf("invalid local port specified in forward argument (%s): %w", fwd, e)
-		}
+	if flags.origins, err = newOriginPolicy(flags.allowedOrigins); err != nil {
+		return err
+	}
 
-		if v, e := strconv.Atoi(parts[2]); e != nil || v < 0 || v > 65535 {
-			return fmt.Errorf("invalid remote port specified in forward argument (%s): %w", fwd, e)
-		}
+	if flags.auth, err = newAuthenticator(flags.authTokens, flags.authTokenFile); err != nil {
+		return err
+	}
+
+	if flags.listeners, err = parseListenEndpoints(flags); err != nil {
+		return err
+	}
+
+	if (flags.tlsCert == "") != (flags.tlsKey == "") {
+		return fmt.Errorf("both --tls-cert and --tls-key must be specified")
+	}
 
-		cfg.Forwards[prefix+":"+parts[0]] = net.JoinHostPort(parts[1], parts[2])
+	if flags.tlsCert != "" && flags.tlsSelfSigned {
+		return fmt.Errorf("--tls-self-signed cannot be used together with --tls-cert")
 	}
 
-	if flags.listenPort < 0 || flags.listenPort > 65535 {
-		return fmt.Errorf("invalid listen port specified (%d)", flags.listenPort)
+	if err := validateLogFlags(flags); err != nil {
+		return err
+	}
+
+	if flags.gracePeriod < 0 {
+		return fmt.Errorf("invalid grace period specified (%s)", flags.gracePeriod)
+	}
+
+	if err := validateKeepalive(flags); err != nil {
+		return err
+	}
+
+	if flags.resumeWindow < 0 {
+		return fmt.Errorf("invalid resume window specified (%s)", flags.resumeWindow)
+	}
+
+	if err := validateCaptureFlags(flags); err != nil {
+		return err
+	}
+
+	if flags.impairment, err = parseImpairment(flags.impair); err != nil {
+		return err
+	}
+
+	if flags.scenarioFile != "" {
+		if flags.scenario, err = loadScenario(flags.scenarioFile); err != nil {
+			return err
+		}
+		tcpTracking.Store(true)
+	}
+
+	if err := validateMaxFrameSize(flags, cfg.MTU); err != nil {
+		return err
 	}
 
 	cfg.CaptureFile = flags.captureFile
@@ -105,6 +210,30 @@ func validateAndMapFlags(flags *flagCfg, cfg *types.Configuration) (err error) {
 	return nil
 }
 
+// parseForward parses a forward argument and returns the matching key and value for types.Configuration.Forwards.
+// note: since we're using syntax similar to ssh -L option, we do the splitting ourselves here
+func parseForward(fwd string) (local string, remote string, err error) {
+	parts := strings.Split(fwd, ":")
+	prefix := ""
+	if len(parts) == 4 && parts[0] == "udp" {
+		prefix = "udp:"
+		parts = parts[1:]
+	}
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf(string("arg ``%s`` is not formatted using the syntax '[udp:]localPort:addr:remotePort'"), fwd)
+	}
+
+	if v, e := strconv.Atoi(parts[0]); e != nil || v < 0 || v > 65535 {
+		return "", "", fmt.Errorf("invalid local port specified in forward argument (%s): %w", fwd, e)
+	}
+
+	if v, e := strconv.Atoi(parts[2]); e != nil || v < 0 || v > 65535 {
+		return "", "", fmt.Errorf("invalid remote port specified in forward argument (%s): %w", fwd, e)
+	}
+
+	return prefix + ":" + parts[0], net.JoinHostPort(parts[1], parts[2]), nil
+}
+
 func banner() {
 
 	var gitStr string
@@ -116,7 +245,42 @@ func banner() {
 	mode := "vsock"
 	if flags.bridge {
 		mode = "bridge"
+	} else if flags.isolate {
+		mode = "vsock, isolated"
+	} else if flags.lan {
+		mode = "vsock, LAN"
 	}
+
+	if flags.logFormat == logFormatJSON {
+		// Keep the output machine-readable
+		listen := make([]string, len(flags.listeners))
+		for i, endpoint := range flags.listeners {
+			listen[i] = endpoint.String()
+		}
+		fields := logrus.Fields{
+			"version": version,
+			"mode":    mode,
+			"listen":  listen,
+			"tls":     flags.tlsEnabled(),
+			"auth":    flags.auth.enabled(),
+		}
+		if gitHash != "" {
+			fields["gitHash"] = gitHash
+		}
+		if flags.tlsFingerprint != "" {
+			fields["tlsFingerprint"] = flags.tlsFingerprint
+		}
+		if flags.impairment != nil {
+			fields["impairment"] = flags.impairment.Spec
+			fields["impairmentSeed"] = flags.impairment.Seed
+		}
+		if flags.scenario != nil {
+			fields["scenario"] = flags.scenarioFile
+		}
+		logrus.WithFields(fields).Info("gateway started")
+		return
+	}
+
 	fmt.Printf(`
        __              ,
 |  |  /  \  |_/  |  |  |
@@ -126,11 +290,48 @@ func banner() {
 
 Version: %s
 %s
-Listening on TCP Port %d (mode: %s)
-`, version, gitStr, flags.listenPort, mode)
+Mode: %s
+`, version, gitStr, mode)
+
+	scheme := "ws://"
+	if flags.tlsEnabled() {
+		scheme = "wss://"
+	}
+	fmt.Println("Listening on:")
+	for _, endpoint := range flags.listeners {
+		if endpoint.network == "unix" {
+			fmt.Printf("  %s\n", endpoint)
+		} else {
+			fmt.Printf("  %s%s\n", scheme, endpoint)
+		}
+	}
+
+	if flags.tlsFingerprint != "" {
+		fmt.Printf("TLS certificate fingerprint (SHA-256):\n  %s\n", flags.tlsFingerprint)
+	}
+
+	if flags.auth.enabled() {
+		fmt.Printf("Authentication required (%d tokens)\n", len(flags.auth.tokens))
+	}
+
+	if flags.impairment != nil {
+		// The seed reproduces the same losses in another run
+		fmt.Printf("Network impairment: %s (seed=%d)\n", flags.impairment.Spec, flags.impairment.Seed)
+	}
+
+	if flags.scenario != nil {
+		fmt.Printf("Scenario: %s (%d steps, timeline per %s)\n", flags.scenarioFile, len(flags.scenario.Steps), flags.scenario.Start)
+	}
 }
 
 func printForwards(config *types.Configuration) {
+	if flags.logFormat == logFormatJSON {
+		for local, remote := range config.Forwards {
+			logrus.WithFields(logrus.Fields{"local": local, "remote": remote}).Info("port forward")
+		}
+		return
+	}
+
 	// Print forwards
 	if len(config.Forwards) > 0 {
 		fmt.Println("\nPort forwards (local -> simulator):")
@@ -141,8 +342,147 @@ func printForwards(config *types.Configuration) {
 	}
 }
 
+// newWebSocketHandler accepts the WebSocket connections of the simulators and hands them to the backend
+func newWebSocketHandler(ctx context.Context, backend Backend) http.HandlerFunc {
+	name := backendName(backend)
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		remoteAddr := remoteAddr(r)
+		log := logrus.WithFields(logrus.Fields{"remoteAddr": remoteAddr, "origin": origin, "backend": name})
+		log.Info("client connected")
+
+		if !checkOrigin(flags.origins, origin) {
+			w.WriteHeader(http.StatusForbidden)
+			metrics.rejectedOrigins.Inc()
+			log.Warn("invalid origin")
+			return
+		}
+
+		identity, authErr := flags.auth.authenticate(r)
+		resumeToken := r.URL.Query().Get("resume")
+		resuming := sessions.byResumeToken(resumeToken)
+
+		upgrader := ws.HTTPUpgrader{}
+		compression := wsflate.Extension{Parameters: compressionParameters}
+		if !flags.noCompression && (resuming == nil || resuming.Compression) {
+			upgrader.Negotiate = compression.Negotiate
+		}
+		conn, rw, _, err := upgrader.Upgrade(r, w)
+		if err != nil {
+			metrics.upgradeErrors.Inc()
+			log.WithError(err).Warn("web socket error")
+			return
+		}
+
+		if authErr != nil {
+			metrics.authFailures.Inc()
+			log.WithError(authErr).Warn("authentication failed")
+			rejectConnection(conn, ws.StatusPolicyViolation, "unauthorized", authErr.Error())
+			return
+		}
+
+		_, compressed := compression.Accepted()
+		if resumeToken != "" && resumeSession(log, resuming, identity, compressed, resumedConn{conn: conn, reader: rw.Reader, remoteAddr: remoteAddr}) {
+			return
+		}
+
+		s := sessions.add(&session{
+			RemoteAddr:   remoteAddr,
+			Origin:       origin,
+			Device:       r.URL.Query().Get("device"),
+			Identity:     identity,
+			Backend:      name,
+			conn:         conn,
+			reader:       rw.Reader,
+			maxFrameSize: flags.maxFrameSize,
+			coalesce:     flags.coalesce,
+			idleTimeout:  flags.idleTimeout,
+			Compression:  compressed,
+		})
+		s.enableResume(flags.resumeWindow)
+		metrics.sessionStarted(s)
+		captures.sessionStarted(s)
+		if flags.impairment != nil {
+			s.setImpairment(flags.impairment)
+		}
+		stopScenario := flags.scenario.sessionStarted(ctx, s)
+		stopKeepalive := s.startKeepalive(flags.pingInterval)
+		defer func() {
+			s.disconnect()
+			stopKeepalive()
+			stopScenario()
+			s.faults.clear()
+			s.stopImpairment()
+			sessions.remove(s)
+			metrics.sessionEnded(s)
+			captures.sessionEnded(s)
+			reason, err := s.endReason()
+			log := s.log().WithFields(s.stats.fields()).WithFields(logrus.Fields{"duration": time.Since(s.Started).Round(time.Millisecond).String(), "reason": reason})
+			if err != nil {
+				log = log.WithError(err)
+			}
+			log.Info("session ended")
+		}()
+
+		if err := s.writeJSON(s.aloha(false)); err != nil {
+			s.log().WithError(err).Warn("write error")
+			return
+		}
+
+		s.log().Info("session started")
+
+		// Handle the connection using the appropriate backend
+		if err := backend.HandleConnection(ctx, conn, s); err != nil {
+			s.end(endReasonBackendError, err)
+			s.log().WithError(err).Error("connection handling error")
+		}
+	}
+}
+
+// newGatewayHandler serves the simulators, the API, the status and the metrics. The health checks
+// and the metrics are served while the backend is set up.
+func newGatewayHandler(ctx context.Context, backend Backend, status *gatewayStatus) http.Handler {
+	gateway := http.NewServeMux()
+	registerAPI(gateway, backend, sessions, flags.auth)
+	gateway.HandleFunc("/", newWebSocketHandler(ctx, backend))
+
+	mux := http.NewServeMux()
+	status.register(mux, flags.auth)
+	registerMetrics(mux, flags.auth)
+	registerCapture(mux, sessions, flags.auth)
+	mux.Handle("/", status.requireReady(gateway))
+	return withCORS(mux)
+}
+
+// writeJSONMessage sends v as a JSON text message
+func writeJSONMessage(conn net.Conn, v any) error {
+	writer := wsutil.NewWriter(conn, ws.StateServerSide, ws.OpText)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// rejectConnection tells the client why the connection is rejected, then closes it
+func rejectConnection(conn net.Conn, status ws.StatusCode, code string, reason string) {
+	defer conn.Close()
+	if err := writeJSONMessage(conn, makeErrorMessage(code, reason)); err != nil {
+		return
+	}
+	_ = ws.WriteFrame(conn, ws.NewCloseFrame(ws.NewCloseFrameBody(status, reason)))
+}
+
 func run(cmd *cobra.Command, _ []string) error {
-	logrus.SetLevel(logrus.WarnLevel)
+	setupLogging(&flags, &config)
+
+	var tlsConfig *tls.Config
+	if flags.tlsEnabled() {
+		var err error
+		if tlsConfig, err = loadTLSConfig(&flags); err != nil {
+			return err
+		}
+		flags.tlsFingerprint = certFingerprint(tlsConfig.Certificates[0].Leaf)
+	}
 
 	banner()
 
@@ -152,50 +492,88 @@ func run(cmd *cobra.Command, _ []string) error {
 		backend = NewWaterBackend(&config)
 	} else {
 		printForwards(&config)
-		backend = NewVsockBackend(&config)
+		mode := vsockShared
+		if flags.isolate {
+			mode = vsockIsolated
+		} else if flags.lan {
+			mode = vsockLAN
+		}
+		backend = NewVsockBackend(&config, mode)
 	}
 
-	// Setup the backend
-	ctx := cmd.Context()
-	if err := backend.Setup(ctx); err != nil {
-		return fmt.Errorf("error setting up backend: %w", err)
+	defer captures.stop()
+	captures.setFilter(flags.captureFilterExpr)
+	if config.CaptureFile != "" {
+		if err := captures.openFile(config.CaptureFile, flags.captureRotation); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"file": config.CaptureFile, "filter": flags.captureFilter}).Info("packet capture enabled")
+	}
+	if flags.captureRingSize > 0 {
+		captures.startRing(flags.captureRingSize)
+		logrus.WithField("size", flags.captureRingBuffer).Info("capture ring buffer enabled")
 	}
-	defer backend.Cleanup()
-
-	err := http.ListenAndServe(net.JoinHostPort(defaultListenAddr, strconv.Itoa(flags.listenPort)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		fmt.Printf("[%s] Client connected (%s)\n", r.RemoteAddr, origin)
 
-		if !checkOrigin(origin) {
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Printf("[%s] Invalid origin: %s\n", r.RemoteAddr, origin)
-			return
+	listeners := make([]net.Listener, 0, len(flags.listeners))
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
 		}
-
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
+	}()
+	for _, endpoint := range flags.listeners {
+		listener, err := endpoint.listen()
 		if err != nil {
-			fmt.Printf("[%s] Web socket error: %s\n", r.RemoteAddr, err)
-			return
+			return fmt.Errorf("error listening on %s: %w", endpoint, err)
 		}
+		listeners = append(listeners, listener)
+	}
 
-		writer := wsutil.NewWriter(conn, ws.StateServerSide, ws.OpText)
-		encoder := json.NewEncoder(writer)
-		err = encoder.Encode(makeAlohaMessage(version))
-		if err != nil {
-			return
-		}
+	ctx := cmd.Context()
+	status := newGatewayStatus(backend, sessions)
 
-		err = writer.Flush()
-		if err != nil {
-			fmt.Printf("[%s] Write error: %s\n", r.RemoteAddr, err)
-			return
-		}
+	server := &http.Server{
+		Handler:   newGatewayHandler(ctx, backend, status),
+		TLSConfig: tlsConfig,
+	}
+	// Shutdown() waits for the live captures, which only end when the client disconnects
+	server.RegisterOnShutdown(captures.close)
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if tlsConfig != nil {
+				errs <- server.ServeTLS(listener, "", "")
+			} else {
+				errs <- server.Serve(listener)
+			}
+		}(listener)
+	}
 
-		// Handle the connection using the appropriate backend
-		if err := backend.HandleConnection(ctx, conn, r.RemoteAddr); err != nil {
-			fmt.Printf("[%s] Connection handling error: %s\n", r.RemoteAddr, err)
+	// Setup the backend
+	if err := backend.Setup(ctx); err != nil {
+		_ = server.Close()
+		// Release whatever the backend set up before it failed
+		if err := backend.Cleanup(); err != nil {
+			logrus.WithError(err).Error("error cleaning up backend")
 		}
-	}))
+		return fmt.Errorf("error setting up backend: %w", err)
+	}
+	status.ready.Store(true)
 
+	signals, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if flags.scenario != nil && flags.scenario.Start == scenarioStartGateway {
+		go flags.scenario.play(signals, nil)
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-signals.Done():
+		// A second signal terminates the gateway immediately
+		stop()
+	}
+	status.ready.Store(false)
+	shutdown(server, backend, flags.gracePeriod)
 	return err
 }
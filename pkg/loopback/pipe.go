@@ -0,0 +1,224 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package loopback
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultPipeBuffer is the number of messages a Pipe buffers in each direction
+const DefaultPipeBuffer = 256
+
+// Pipe returns the two ends of an in-memory connection that keeps the message boundaries, like
+// a SOCK_SEQPACKET socket: every Write is returned by a single Read, when the Read buffer is large
+// enough (otherwise the rest of the message is returned by the following Reads).
+//
+// Unlike net.Pipe, Writes don't wait for the other end to Read: up to bufferSize messages are
+// buffered in each direction, then Write blocks. Both ends support deadlines. Once an end is
+// closed, the other end reads the messages already buffered, then io.EOF.
+func Pipe(bufferSize int) (net.Conn, net.Conn) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultPipeBuffer
+	}
+	ab := make(chan []byte, bufferSize)
+	ba := make(chan []byte, bufferSize)
+	aDone := make(chan struct{})
+	bDone := make(chan struct{})
+	a := &pipeConn{rx: ba, tx: ab, localDone: aDone, remoteDone: bDone, readDeadline: makePipeDeadline(), writeDeadline: makePipeDeadline()}
+	b := &pipeConn{rx: ab, tx: ba, localDone: bDone, remoteDone: aDone, readDeadline: makePipeDeadline(), writeDeadline: makePipeDeadline()}
+	return a, b
+}
+
+// Buffered returns the number of messages waiting to be read from conn when it's an end of a
+// Pipe, or 0 for other connections
+func Buffered(conn net.Conn) int {
+	if c, ok := conn.(*pipeConn); ok {
+		return len(c.rx)
+	}
+	return 0
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "loopback" }
+func (pipeAddr) String() string  { return "loopback" }
+
+type pipeConn struct {
+	readLock sync.Mutex
+	rx       <-chan []byte
+	pending  []byte // the rest of a message longer than the Read buffer
+
+	writeLock sync.Mutex
+	tx        chan<- []byte
+
+	closeOnce  sync.Once
+	localDone  chan struct{}
+	remoteDone <-chan struct{}
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	switch {
+	case isClosedChan(c.localDone):
+		return 0, io.ErrClosedPipe
+	case isClosedChan(c.readDeadline.wait()):
+		return 0, os.ErrDeadlineExceeded
+	case len(c.pending) > 0:
+		return c.deliver(p, c.pending), nil
+	}
+
+	select {
+	case msg := <-c.rx:
+		return c.deliver(p, msg), nil
+	case <-c.remoteDone:
+		// The messages written before the other end closed are still delivered
+		select {
+		case msg := <-c.rx:
+			return c.deliver(p, msg), nil
+		default:
+			return 0, io.EOF
+		}
+	case <-c.localDone:
+		return 0, io.ErrClosedPipe
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *pipeConn) deliver(p []byte, msg []byte) int {
+	n := copy(p, msg)
+	c.pending = msg[n:]
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return n
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	switch {
+	case isClosedChan(c.localDone), isClosedChan(c.remoteDone):
+		return 0, io.ErrClosedPipe
+	case isClosedChan(c.writeDeadline.wait()):
+		return 0, os.ErrDeadlineExceeded
+	case len(p) == 0:
+		return 0, nil
+	}
+
+	// The caller may reuse p as soon as Write returns
+	msg := append([]byte(nil), p...)
+	select {
+	case c.tx <- msg:
+		return len(p), nil
+	case <-c.localDone:
+		return 0, io.ErrClosedPipe
+	case <-c.remoteDone:
+		return 0, io.ErrClosedPipe
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.localDone) })
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	if isClosedChan(c.localDone) || isClosedChan(c.remoteDone) {
+		return io.ErrClosedPipe
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	if isClosedChan(c.localDone) || isClosedChan(c.remoteDone) {
+		return io.ErrClosedPipe
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	if isClosedChan(c.localDone) || isClosedChan(c.remoteDone) {
+		return io.ErrClosedPipe
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// pipeDeadline is a deadline that Read and Write wait for in a select: its channel is closed when
+// the deadline passes
+type pipeDeadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. The zero time clears it; a time in the past expires it right away.
+func (d *pipeDeadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired: wait until it closes the channel
+	}
+	d.timer = nil
+
+	expired := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if wait := time.Until(t); wait > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(wait, func() { close(cancel) })
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+func (d *pipeDeadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
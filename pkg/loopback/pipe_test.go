@@ -0,0 +1,269 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: © 2025 Uri Shaked <uri@wokwi.com>
+
+package loopback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	conn1, conn2 := Pipe(0)
+	defer conn1.Close()
+	defer conn2.Close()
+
+	// The messages keep their boundaries, and the writer can reuse its buffer
+	msg := []byte("first")
+	for _, text := range []string{"first", "second message"} {
+		msg = append(msg[:0], text...)
+		if _, err := conn1.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg[0] = 'X'
+	buf := make([]byte, 64)
+	for _, want := range []string{"first", "second message"} {
+		n, err := conn2.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("Read %q, want %q", buf[:n], want)
+		}
+	}
+
+	// The rest of a message longer than the Read buffer comes with the following Reads
+	if _, err := conn2.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for len(got) < 10 {
+		n, err := conn1.Read(buf[:4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "0123456789" {
+		t.Errorf("Read %q, want %q", got, "0123456789")
+	}
+}
+
+func TestPipeDeadline(t *testing.T) {
+	conn1, conn2 := Pipe(1)
+	defer conn1.Close()
+	defer conn2.Close()
+
+	if err := conn1.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn1.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read returned %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Read returned after %s, before the deadline", elapsed)
+	}
+	var netErr net.Error
+	if _, err := conn1.Read(make([]byte, 10)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read returned %v after the deadline, want a timeout", err)
+	}
+
+	// Clearing the deadline makes Read wait again
+	if err := conn1.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = conn2.Write([]byte("late"))
+	}()
+	if _, err := conn1.Read(make([]byte, 10)); err != nil {
+		t.Errorf("Read returned %v after clearing the deadline", err)
+	}
+
+	// Write blocks once the buffer is full
+	if _, err := conn1.Write([]byte("fits")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn1.SetWriteDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn1.Write([]byte("full")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write returned %v, want a deadline error", err)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	conn1, conn2 := Pipe(0)
+
+	if _, err := conn1.Write([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn1.Write([]byte("closed")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Write on a closed end returned %v, want io.ErrClosedPipe", err)
+	}
+	if _, err := conn2.Write([]byte("closed")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Write to a closed end returned %v, want io.ErrClosedPipe", err)
+	}
+
+	// The other end reads the messages written before Close, then EOF
+	buf := make([]byte, 10)
+	n, err := conn2.Read(buf)
+	if err != nil || string(buf[:n]) != "last" {
+		t.Errorf("Read returned %q, %v, want %q", buf[:n], err, "last")
+	}
+	if _, err := conn2.Read(buf); err != io.EOF {
+		t.Errorf("Read returned %v, want io.EOF", err)
+	}
+
+	// Close unblocks a pending Read
+	conn3, conn4 := Pipe(0)
+	defer conn4.Close()
+	done := make(chan error)
+	go func() {
+		_, err := conn3.Read(buf)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conn3.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("Read returned %v, want io.ErrClosedPipe", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Read still blocked after Close")
+	}
+}
+
+// FuzzPipe splits the input into messages, and reads them back with buffers of various sizes
+func FuzzPipe(f *testing.F) {
+	f.Add([]byte("\x05hello\x00\x03abc"), uint8(4))
+	f.Add(bytes.Repeat([]byte{0xff}, 600), uint8(1))
+	f.Fuzz(func(t *testing.T, input []byte, readSize uint8) {
+		// Every message is a length byte, then up to that many bytes
+		var messages [][]byte
+		for len(input) > 0 {
+			n := min(int(input[0]), len(input)-1)
+			messages = append(messages, input[1:1+n])
+			input = input[1+n:]
+		}
+
+		conn1, conn2 := Pipe(len(messages) + 1)
+		defer conn2.Close()
+		for _, msg := range messages {
+			if _, err := conn1.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn1.Close()
+
+		buf := make([]byte, int(readSize)+1)
+		for _, msg := range messages {
+			if len(msg) == 0 {
+				continue // empty Writes send nothing
+			}
+			var got []byte
+			for len(got) < len(msg) {
+				n, err := conn2.Read(buf)
+				if err != nil {
+					t.Fatalf("Read returned %v after %d bytes of a %d bytes message", err, len(got), len(msg))
+				}
+				got = append(got, buf[:n]...)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("Read %x, want %x", got, msg)
+			}
+		}
+		if n, err := conn2.Read(buf); err != io.EOF {
+			t.Fatalf("Read returned %d bytes, %v after the last message, want io.EOF", n, err)
+		}
+	})
+}
+
+// The benchmarks send Ethernet frames through the loopback, the way the vsock backend does:
+// ConnLoopback with the 4-byte length prefix of the QEMU protocol, Pipe a frame per Write.
+var benchmarkFrameSizes = []int{64, 512, 1500}
+
+func BenchmarkConnLoopback(b *testing.B) {
+	for _, size := range benchmarkFrameSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			conn1, conn2, err := ConnLoopback()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn1.Close()
+			defer conn2.Close()
+
+			benchmarkFrames(b, size, func(frame []byte) error {
+				if err := binary.Write(conn1, binary.BigEndian, uint32(len(frame))); err != nil {
+					return err
+				}
+				_, err := conn1.Write(frame)
+				return err
+			}, func(buf []byte) (int, error) {
+				var size uint32
+				if err := binary.Read(conn2, binary.BigEndian, &size); err != nil {
+					return 0, err
+				}
+				return io.ReadFull(conn2, buf[:size])
+			})
+		})
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	for _, size := range benchmarkFrameSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			conn1, conn2 := Pipe(DefaultPipeBuffer)
+			defer conn1.Close()
+			defer conn2.Close()
+
+			benchmarkFrames(b, size, func(frame []byte) error {
+				_, err := conn1.Write(frame)
+				return err
+			}, conn2.Read)
+		})
+	}
+}
+
+func benchmarkFrames(b *testing.B, size int, write func(frame []byte) error, read func(buf []byte) (int, error)) {
+	frame := bytes.Repeat([]byte{0xaa}, size)
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for i := 0; i < b.N; i++ {
+			n, err := read(buf)
+			if err == nil && n != size {
+				err = fmt.Errorf("read %d bytes, want %d", n, size)
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}